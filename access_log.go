@@ -0,0 +1,151 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/malfunkt/hyperfox/pkg/plugins/logger"
+	"github.com/malfunkt/hyperfox/pkg/proxy"
+	"golang.org/x/term"
+)
+
+var (
+	flagLogFormat  = flag.String("log-format", "", "Access log format: tty, common, combined, json or a template (e.g. '{{.Method}} {{.URL}} {{.Duration}}'). Defaults to tty on terminals and common otherwise.")
+	flagLogOutput  = flag.String("log-output", "stdout", "Access log output: stdout, stderr, syslog, syslog://host:port, a file path or none.")
+	flagLogMaxSize = flag.Int64("log-max-size", 0, "Rotate the access log file when it grows beyond this many megabytes.")
+	flagLogRotate  = flag.Duration("log-rotate", 0, "Rotate the access log file after this long (e.g. 24h).")
+)
+
+var (
+	// terminalState is the state of the terminal before it was put in raw
+	// mode, it's restored on exit.
+	terminalState   *term.State
+	terminalStateMu sync.Mutex
+)
+
+// setupAccessLog attaches the access logger to the proxy. When logging to an
+// interactive terminal it returns the TTY logger, so it can read keyboard
+// commands.
+func setupAccessLog(p *proxy.Proxy) (*logger.TTY, func(), error) {
+	if *flagLogOutput == "none" {
+		return nil, func() {}, nil
+	}
+
+	// The terminal UI takes over the screen.
+	if *flagTUI && (*flagLogOutput == "stdout" || *flagLogOutput == "stderr") {
+		return nil, func() {}, nil
+	}
+
+	output, err := logger.OpenOutput(*flagLogOutput, *flagLogMaxSize<<20, *flagLogRotate)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	formatName := *flagLogFormat
+	if formatName == "" {
+		formatName = "common"
+		if output == os.Stdout && term.IsTerminal(int(os.Stdout.Fd())) {
+			formatName = "tty"
+		}
+	}
+
+	if formatName == "tty" {
+		tty := logger.NewTTY(output)
+		p.AddLogger(tty)
+
+		// Keep other messages from breaking the status line.
+		log.SetOutput(tty.Writer())
+
+		return tty, func() { log.SetOutput(os.Stderr) }, nil
+	}
+
+	format, err := logger.ParseFormat(formatName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accessLog := logger.New(output, format)
+	p.AddLogger(accessLog)
+
+	return nil, func() { accessLog.Close() }, nil
+}
+
+// makeRaw puts the terminal in raw mode, so key presses are read as they
+// come. It returns false if stdin is not a terminal.
+func makeRaw() bool {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return false
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		log.Printf("MakeRaw: %q", err)
+		return false
+	}
+
+	terminalStateMu.Lock()
+	terminalState = state
+	terminalStateMu.Unlock()
+
+	return true
+}
+
+// restoreTerminal takes the terminal out of raw mode, if it was put in it.
+func restoreTerminal() {
+	terminalStateMu.Lock()
+	defer terminalStateMu.Unlock()
+
+	if terminalState == nil {
+		return
+	}
+	_ = term.Restore(int(os.Stdin.Fd()), terminalState)
+	terminalState = nil
+}
+
+// fatalf is like log.Fatalf, but leaves the terminal as it was found.
+func fatalf(format string, v ...interface{}) {
+	closeTUI()
+	restoreTerminal()
+	log.Fatalf(format, v...)
+}
+
+// readCommands passes key presses to the TTY logger. Ctrl-C is delivered as
+// an interrupt signal, since the terminal is in raw mode.
+func readCommands(tty *logger.TTY) {
+	err := tty.ReadCommands(os.Stdin)
+	restoreTerminal()
+
+	if err == logger.ErrInterrupted {
+		self, _ := os.FindProcess(os.Getpid())
+		if self == nil || self.Signal(os.Interrupt) != nil {
+			os.Exit(130)
+		}
+	} else if err != nil && err != io.EOF {
+		log.Printf("ReadCommands: %q", err)
+	}
+}
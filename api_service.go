@@ -23,12 +23,8 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -36,18 +32,20 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/malfunkt/hyperfox/pkg/content"
+	"github.com/malfunkt/hyperfox/pkg/dnsserver"
 	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+	"github.com/malfunkt/hyperfox/pkg/store"
 	_ "github.com/malfunkt/hyperfox/ui/statik"
-	"upper.io/db.v3"
 )
 
 var (
-	reUnsafeChars   = regexp.MustCompile(`[^0-9a-zA-Z\s\.]`)
-	reUnsafeFile    = regexp.MustCompile(`[^0-9a-zA-Z-_]`)
-	reRepeatedDash  = regexp.MustCompile(`-+`)
-	reRepeatedBlank = regexp.MustCompile(`\s+`)
+	reUnsafeFile   = regexp.MustCompile(`[^0-9a-zA-Z-_]`)
+	reUnsafeName   = regexp.MustCompile(`[^0-9a-zA-Z-_.]`)
+	reRepeatedDash = regexp.MustCompile(`-+`)
 )
 
 type writeOption uint8
@@ -58,6 +56,7 @@ const (
 	writeEmbed        writeOption = 2
 	writeRequestBody  writeOption = 4
 	writeResponseBody writeOption = 8
+	writeDecoded      writeOption = 16
 )
 
 const (
@@ -81,6 +80,7 @@ func replyBinary(w http.ResponseWriter, r *http.Request, record *capture.Record,
 		optResponseBody = opts&writeResponseBody > 0
 		optWire         = opts&writeWire > 0
 		optEmbed        = opts&writeEmbed > 0
+		optDecoded      = opts&writeDecoded > 0
 	)
 
 	if opts == writeNone {
@@ -105,6 +105,9 @@ func replyBinary(w http.ResponseWriter, r *http.Request, record *capture.Record,
 	if optWire {
 		basename = basename + "-raw"
 	}
+	if optDecoded {
+		basename = basename + "-decoded"
+	}
 
 	ext := path.Ext(u.Path)
 	if ext == "" {
@@ -131,42 +134,46 @@ func replyBinary(w http.ResponseWriter, r *http.Request, record *capture.Record,
 	}
 
 	if optRequestBody || optResponseBody {
-		var header http.Header
-
-		var bodyContentType string
+		header, body := record.Header.Header, record.Body
 		if optRequestBody {
-			header = record.RequestHeader.Header
-			buf.Write(record.RequestBody)
+			header, body = record.RequestHeader.Header, record.RequestBody
 		}
-		if optResponseBody {
-			header = record.Header.Header
-			buf.Write(record.Body)
+
+		if optEmbed || optDecoded {
+			decoded, err := content.Decode(header, body)
+			if err != nil && optDecoded {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				_, _ = w.Write([]byte(err.Error()))
+				return
+			}
+			// Embedded bodies that can't be decoded are shown as they are.
+			body = decoded
 		}
-		bodyContentType = header.Get("Content-Type")
 
+		var embedContentType string
 		if optEmbed {
-			embedContentType := "text/plain; charset=utf-8"
+			bodyContentType := header.Get("Content-Type")
 			if strings.HasPrefix(bodyContentType, "image/") {
 				embedContentType = bodyContentType
+			} else if sniffed := http.DetectContentType(body); strings.HasPrefix(sniffed, "image/") {
+				embedContentType = sniffed
+			} else {
+				// Text is shown in UTF-8, whatever charset it was sent in.
+				embedContentType = "text/plain; charset=utf-8"
+				if text, _, err := content.ToUTF8(bodyContentType, body); err == nil {
+					body = text
+				}
 			}
+		}
+		buf.Write(body)
+
+		if optEmbed {
 			w.Header().Set(
 				"Content-Type",
 				embedContentType,
 			)
 
-			out := bytes.NewBuffer(nil)
-			tee := io.TeeReader(buf, out)
-
-			gz, err := gzip.NewReader(tee)
-			if err == nil {
-				dst := bytes.NewBuffer(nil)
-				_, _ = io.Copy(dst, gz)
-				out = dst
-			} else {
-				_, _ = ioutil.ReadAll(tee)
-			}
-
-			_, err = w.Write(out.Bytes())
+			_, err = w.Write(buf.Bytes())
 			if err != nil {
 				log.Printf("failed to send raw text: %v", err)
 			}
@@ -198,57 +205,17 @@ func replyJSON(w http.ResponseWriter, data interface{}) {
 }
 
 func getCaptureRecord(uuid string) (*capture.Record, error) {
-	var record capture.Record
-
-	res := storage.Find(
-		db.Cond{"uuid": uuid},
-	).Select(
-		"uuid",
-		"origin",
-		"method",
-		"status",
-		"content_type",
-		"content_length",
-		"host",
-		"url",
-		"path",
-		"scheme",
-		"date_start",
-		"date_end",
-		"time_taken",
-		"header",
-		"request_header",
-		db.Raw("hex(body) AS body"),
-		db.Raw("hex(request_body) AS request_body"),
-	)
-
-	if err := res.One(&record); err != nil {
-		return nil, err
-	}
-
-	{
-		body, err := hex.DecodeString(string(record.RequestBody))
-		if err != nil {
-			return nil, err
-		}
-		record.RequestBody = body
-	}
-
-	{
-		body, err := hex.DecodeString(string(record.Body))
-		if err != nil {
-			return nil, err
-		}
-		record.Body = body
-	}
-
-	return &record, nil
+	return storage.Get(uuid)
 }
 
 func recordMetaHandler(w http.ResponseWriter, r *http.Request) {
 	uuid := chi.URLParam(r, "uuid")
 
 	record, err := getCaptureRecord(uuid)
+	if err == store.ErrNotFound {
+		replyCode(w, http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Printf("getCaptureRecord: %q", err)
 		replyCode(w, http.StatusInternalServerError)
@@ -262,6 +229,10 @@ func recordHandler(w http.ResponseWriter, r *http.Request, opts writeOption) {
 	uuid := chi.URLParam(r, "uuid")
 
 	record, err := getCaptureRecord(uuid)
+	if err == store.ErrNotFound {
+		replyCode(w, http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Printf("getCaptureRecord: %q", err)
 		replyCode(w, http.StatusInternalServerError)
@@ -279,6 +250,10 @@ func requestWireHandler(w http.ResponseWriter, r *http.Request) {
 	recordHandler(w, r, writeRequestBody|writeWire)
 }
 
+func requestDecodedHandler(w http.ResponseWriter, r *http.Request) {
+	recordHandler(w, r, writeRequestBody|writeDecoded)
+}
+
 func requestEmbedHandler(w http.ResponseWriter, r *http.Request) {
 	recordHandler(w, r, writeRequestBody|writeEmbed)
 }
@@ -291,20 +266,127 @@ func responseWireHandler(w http.ResponseWriter, r *http.Request) {
 	recordHandler(w, r, writeResponseBody|writeWire)
 }
 
+func responseDecodedHandler(w http.ResponseWriter, r *http.Request) {
+	recordHandler(w, r, writeResponseBody|writeDecoded)
+}
+
 func responseEmbedHandler(w http.ResponseWriter, r *http.Request) {
 	recordHandler(w, r, writeResponseBody|writeEmbed)
 }
 
+// messageBody returns the header and body of the request or the response
+// of a record.
+func messageBody(record *capture.Record, opts writeOption) (http.Header, []byte) {
+	if opts&writeRequestBody > 0 {
+		return record.RequestHeader.Header, record.RequestBody
+	}
+	return record.Header.Header, record.Body
+}
+
+// parsedHandler replies with a structured view of a request or response
+// body, requests also get their query string parameters.
+func parsedHandler(w http.ResponseWriter, r *http.Request, opts writeOption) {
+	record, err := getCaptureRecord(chi.URLParam(r, "uuid"))
+	if err == store.ErrNotFound {
+		replyCode(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("getCaptureRecord: %q", err)
+		replyCode(w, http.StatusInternalServerError)
+		return
+	}
+
+	u, err := url.Parse(record.URL)
+	if err != nil {
+		replyCode(w, http.StatusInternalServerError)
+		return
+	}
+
+	header, body := messageBody(record, opts)
+	parsed := content.Parse(header, body, content.Options{
+		Path:    u.Path,
+		Request: opts&writeRequestBody > 0,
+		Trailer: record.Trailer.Header,
+		Schema:  protoSchema,
+	})
+	if opts&writeRequestBody > 0 {
+		// Badly escaped parameters are given as they are.
+		parsed.Query, _ = content.ParsePairs(u.RawQuery)
+	}
+
+	replyJSON(w, parsed)
+}
+
+// partHandler serves a part of a multipart request or response body.
+func partHandler(w http.ResponseWriter, r *http.Request, opts writeOption) {
+	i, err := strconv.Atoi(chi.URLParam(r, "part"))
+	if err != nil {
+		replyCode(w, http.StatusBadRequest)
+		return
+	}
+
+	record, err := getCaptureRecord(chi.URLParam(r, "uuid"))
+	if err == store.ErrNotFound {
+		replyCode(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("getCaptureRecord: %q", err)
+		replyCode(w, http.StatusInternalServerError)
+		return
+	}
+
+	header, body := messageBody(record, opts)
+	part, data, err := content.PartContent(header, body, i)
+	if err == content.ErrNoPart {
+		replyCode(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	filename := part.Filename
+	if filename == "" {
+		filename = fmt.Sprintf("part-%d", i)
+	}
+	filename = reUnsafeName.ReplaceAllString(path.Base(filename), "-")
+
+	if part.ContentType != "" {
+		w.Header().Set("Content-Type", part.ContentType)
+	}
+	w.Header().Set(
+		"Content-Disposition",
+		fmt.Sprintf(`attachment; filename="%s"`, filename),
+	)
+	http.ServeContent(w, r, "", record.DateEnd, bytes.NewReader(data))
+}
+
+func requestParsedHandler(w http.ResponseWriter, r *http.Request) {
+	parsedHandler(w, r, writeRequestBody)
+}
+
+func requestPartHandler(w http.ResponseWriter, r *http.Request) {
+	partHandler(w, r, writeRequestBody)
+}
+
+func responseParsedHandler(w http.ResponseWriter, r *http.Request) {
+	parsedHandler(w, r, writeResponseBody)
+}
+
+func responsePartHandler(w http.ResponseWriter, r *http.Request) {
+	partHandler(w, r, writeResponseBody)
+}
+
 // capturesHandler service serves paginated requests.
 func capturesHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
 	var response pullResponse
 
 	q := r.URL.Query().Get("q")
 
-	q = reUnsafeChars.ReplaceAllString(q, " ")
-	q = reRepeatedBlank.ReplaceAllString(q, " ")
-
 	page := uint(1)
 	{
 		i, err := strconv.ParseUint(r.URL.Query().Get("page"), 10, 64)
@@ -321,60 +403,264 @@ func capturesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Result set
-	res := storage.Find().
-		Select(
-			"id",
-			"uuid",
-			"origin",
-			"method",
-			"status",
-			"content_type",
-			"content_length",
-			"host",
-			"url",
-			"path",
-			"scheme",
-			"date_start",
-			"date_end",
-			"time_taken",
-		).
-		OrderBy("id")
-
-	if q != "" {
-		terms := strings.Split(q, " ")
-		conds := db.And()
-
-		for _, term := range terms {
-			conds = conds.And(
-				db.Or(
-					db.Cond{"keywords LIKE": "%" + term + "%"},
-					db.Cond{"host LIKE": "%" + term + "%"},
-					db.Cond{"origin LIKE": "%" + term + "%"},
-					db.Cond{"path LIKE": "%" + term + "%"},
-					db.Cond{"content_type LIKE": "%" + term + "%"},
-					db.Cond{"method": term},
-					db.Cond{"scheme": term},
-					db.Cond{"status": term},
-				),
-			)
+	if page < 1 {
+		page = 1
+	}
+
+	// Pulling information page.
+	records, total, err := storage.Query(store.Query{
+		Search: q,
+		Offset: int((page - 1) * pageSize),
+		Limit:  int(pageSize),
+	})
+	if err != nil {
+		log.Printf("Query: %q", err)
+		replyCode(w, http.StatusInternalServerError)
+		return
+	}
+
+	response.Records = records
+
+	// Getting total number of pages.
+	response.Page = page
+	response.Pages = 1
+	if pageSize > 0 {
+		response.Pages = uint((total + uint64(pageSize) - 1) / uint64(pageSize))
+	}
+
+	replyJSON(w, response)
+}
+
+// exportRecord is a record as it's exported, text bodies are given in UTF-8
+// along with the raw ones.
+type exportRecord struct {
+	*capture.Record
+	RequestBodyText string `json:"request_body_text,omitempty"`
+	BodyText        string `json:"body_text,omitempty"`
+}
+
+// bodyText returns a body as UTF-8 text, or "" if it's not text.
+func bodyText(header http.Header, body []byte) string {
+	decoded, err := content.Decode(header, body)
+	if err != nil {
+		return ""
+	}
+	if text, ok := content.Text(header.Get("Content-Type"), decoded); ok {
+		return string(text)
+	}
+	return ""
+}
+
+// exportHandler streams the records that match the search query q, bodies
+// included, as JSON objects, one per line.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="hyperfox-export.ndjson"`)
+
+	enc := json.NewEncoder(w)
+	err := storage.Stream(store.Query{Search: r.URL.Query().Get("q")}, func(record *capture.Record) error {
+		return enc.Encode(exportRecord{
+			Record:          record,
+			RequestBodyText: bodyText(record.RequestHeader.Header, record.RequestBody),
+			BodyText:        bodyText(record.Header.Header, record.Body),
+		})
+	})
+	if err != nil {
+		// Headers are gone by now, all we can do is cut the export short.
+		log.Printf("Stream: %q", err)
+	}
+}
+
+type deleteResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// deleteRecordHandler deletes a single record.
+func deleteRecordHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := storage.Delete(chi.URLParam(r, "uuid"))
+	if err != nil {
+		log.Printf("Delete: %q", err)
+		replyCode(w, http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		replyCode(w, http.StatusNotFound)
+		return
+	}
+
+	replyJSON(w, deleteResponse{Deleted: n})
+}
+
+// deleteRecordsHandler deletes the records that match the search query q
+// and started before the RFC 3339 time given by before, at least one of them
+// is required.
+func deleteRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	var q store.Query
+
+	q.Search = r.URL.Query().Get("q")
+	if before := r.URL.Query().Get("before"); before != "" {
+		t, err := time.Parse(time.RFC3339, before)
+		if err != nil {
+			replyCode(w, http.StatusBadRequest)
+			return
 		}
+		q.Before = t
+	}
 
-		res = res.Where(conds)
+	if strings.TrimSpace(q.Search) == "" && q.Before.IsZero() {
+		replyCode(w, http.StatusBadRequest)
+		return
 	}
 
-	res = res.Paginate(pageSize).Page(page)
+	n, err := store.DeleteMatching(storage, q)
+	if err != nil {
+		log.Printf("DeleteMatching: %q", err)
+		replyCode(w, http.StatusInternalServerError)
+		return
+	}
 
-	// Pulling information page.
-	if err = res.All(&response.Records); err != nil {
-		log.Printf("res.All: %q", err)
+	replyJSON(w, deleteResponse{Deleted: n})
+}
+
+type hostOverride struct {
+	Pattern string `json:"pattern"`
+	Target  string `json:"target"`
+}
+
+// hostsHandler lists the proxy's host overrides.
+func hostsHandler(w http.ResponseWriter, r *http.Request) {
+	replyJSON(w, px.HostOverrides())
+}
+
+// setHostHandler adds or replaces a host override.
+func setHostHandler(w http.ResponseWriter, r *http.Request) {
+	var override hostOverride
+
+	if err := json.NewDecoder(r.Body).Decode(&override); err != nil {
+		replyCode(w, http.StatusBadRequest)
+		return
+	}
+
+	if err := px.SetHostOverride(override.Pattern, override.Target); err != nil {
+		log.Printf("SetHostOverride: %q", err)
+		replyCode(w, http.StatusBadRequest)
+		return
+	}
+
+	replyJSON(w, px.HostOverrides())
+}
+
+// deleteHostHandler removes a host override.
+func deleteHostHandler(w http.ResponseWriter, r *http.Request) {
+	px.RemoveHostOverride(chi.URLParam(r, "pattern"))
+
+	replyJSON(w, px.HostOverrides())
+}
+
+type dnsQueriesResponse struct {
+	Queries []dnsserver.Query `json:"queries"`
+	Pages   uint              `json:"pages"`
+	Page    uint              `json:"page"`
+}
+
+// dnsQueriesHandler serves the paginated log of the DNS server.
+func dnsQueriesHandler(w http.ResponseWriter, r *http.Request) {
+	var response dnsQueriesResponse
+
+	if dnsLog == nil {
+		replyCode(w, http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+
+	page := uint(1)
+	{
+		i, err := strconv.ParseUint(r.URL.Query().Get("page"), 10, 64)
+		if err == nil {
+			page = uint(i)
+		}
+	}
+
+	pageSize := defaultPageSize
+	{
+		i, err := strconv.ParseUint(r.URL.Query().Get("page_size"), 10, 64)
+		if err == nil {
+			pageSize = uint(i)
+		}
+	}
+
+	if page < 1 {
+		page = 1
+	}
+
+	queries, total, err := dnsLog.DNSQueries(store.Query{
+		Search: q,
+		Offset: int((page - 1) * pageSize),
+		Limit:  int(pageSize),
+	})
+	if err != nil {
+		log.Printf("DNSQueries: %q", err)
 		replyCode(w, http.StatusInternalServerError)
 		return
 	}
 
-	// Getting total number of pages.
+	response.Queries = queries
+
 	response.Page = page
-	response.Pages, _ = res.TotalPages()
+	response.Pages = 1
+	if pageSize > 0 {
+		response.Pages = uint((total + uint64(pageSize) - 1) / uint64(pageSize))
+	}
 
 	replyJSON(w, response)
 }
+
+type dnsTarget struct {
+	Pattern string `json:"pattern"`
+}
+
+// dnsTargetsHandler lists the names intercepted by the DNS server.
+func dnsTargetsHandler(w http.ResponseWriter, r *http.Request) {
+	if dnss == nil {
+		replyCode(w, http.StatusNotFound)
+		return
+	}
+
+	replyJSON(w, dnss.Targets())
+}
+
+// addDNSTargetHandler adds a name to be intercepted by the DNS server.
+func addDNSTargetHandler(w http.ResponseWriter, r *http.Request) {
+	if dnss == nil {
+		replyCode(w, http.StatusNotFound)
+		return
+	}
+
+	var target dnsTarget
+
+	if err := json.NewDecoder(r.Body).Decode(&target); err != nil {
+		replyCode(w, http.StatusBadRequest)
+		return
+	}
+
+	if err := dnss.AddTarget(target.Pattern); err != nil {
+		log.Printf("AddTarget: %q", err)
+		replyCode(w, http.StatusBadRequest)
+		return
+	}
+
+	replyJSON(w, dnss.Targets())
+}
+
+// deleteDNSTargetHandler stops intercepting a name.
+func deleteDNSTargetHandler(w http.ResponseWriter, r *http.Request) {
+	if dnss == nil {
+		replyCode(w, http.StatusNotFound)
+		return
+	}
+
+	dnss.RemoveTarget(chi.URLParam(r, "pattern"))
+
+	replyJSON(w, dnss.Targets())
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/gencert"
+)
+
+func init() {
+	commands["gen-ca"] = genCACommand
+}
+
+// splitConstraints splits a comma separated list of domains and CIDR ranges.
+func splitConstraints(s string) (domains []string, ranges []*net.IPNet, err error) {
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			_, ipNet, err := net.ParseCIDR(item)
+			if err != nil {
+				return nil, nil, err
+			}
+			ranges = append(ranges, ipNet)
+			continue
+		}
+		domains = append(domains, item)
+	}
+	return domains, ranges, nil
+}
+
+// genCACommand creates a root or intermediate CA, optionally restricted with
+// name constraints.
+func genCACommand(args []string) error {
+	fs := flag.NewFlagSet("gen-ca", flag.ExitOnError)
+
+	var (
+		certFile   = fs.String("cert", "rootCA.crt", "Output path for the CA certificate.")
+		keyFile    = fs.String("key", "rootCA.key", "Output path for the CA key.")
+		commonName = fs.String("cn", "Hyperfox CA", "Common name of the CA.")
+		days       = fs.Uint("days", 365*5, "Validity of the CA in days.")
+		permit     = fs.String("permit", "", "Comma separated domains and CIDR ranges the CA is restricted to, a CA restricted to domains only can't sign IP addresses.")
+		exclude    = fs.String("exclude", "", "Comma separated domains and CIDR ranges the CA must not sign.")
+		parentCert = fs.String("parent-cert", "", "Path to the CA certificate that signs the new one (creates an intermediate).")
+		parentKey  = fs.String("parent-key", "", "Path to the key of --parent-cert.")
+	)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	opts := gencert.CAOptions{
+		CommonName: *commonName,
+		ValidFor:   time.Duration(*days) * time.Hour * 24,
+		ParentCert: *parentCert,
+		ParentKey:  *parentKey,
+	}
+
+	var err error
+	if opts.PermittedDNSDomains, opts.PermittedIPRanges, err = splitConstraints(*permit); err != nil {
+		return err
+	}
+	if opts.ExcludedDNSDomains, opts.ExcludedIPRanges, err = splitConstraints(*exclude); err != nil {
+		return err
+	}
+
+	if err := gencert.CreateCA(*certFile, *keyFile, opts); err != nil {
+		return err
+	}
+
+	log.Printf("Created CA certificate %s and key %s", *certFile, *keyFile)
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/store"
+)
+
+func init() {
+	commands["prune"] = pruneCommand
+}
+
+// pruneCommand deletes captures and DNS queries from a database that is not
+// being written to and gives the space back to the system.
+func pruneCommand(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+
+	var (
+		database = fs.String("db", "", "Path to the SQLite database to prune, or a postgres:// URL.")
+		maxAge   = fs.Duration("max-age", 0, "Delete captures and DNS queries older than this (e.g. 168h).")
+		maxCount = fs.Int("max-count", 0, "Keep at most this many captures and as many DNS queries, the oldest are deleted first.")
+		maxSize  = fs.Int64("max-size", 0, "Keep the SQLite database under this many megabytes, the oldest captures and DNS queries are deleted first.")
+		query    = fs.String("q", "", "Delete the captures that match this search query (e.g. 'example.com 404').")
+	)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *database == "" {
+		fs.Usage()
+		return errors.New("missing --db")
+	}
+	if !isPostgreSQL(*database) {
+		if _, err := os.Stat(*database); err != nil {
+			return err
+		}
+	}
+
+	retention := store.Retention{
+		MaxAge:   *maxAge,
+		MaxCount: *maxCount,
+		MaxSize:  *maxSize << 20,
+	}
+	if retention == (store.Retention{}) && *query == "" {
+		fs.Usage()
+		return errors.New("nothing to prune, use --max-age, --max-count, --max-size or -q")
+	}
+
+	*flagDatabase = *database
+
+	st, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	var deleted int
+
+	if *query != "" {
+		n, err := store.DeleteMatching(st, store.Query{Search: *query})
+		deleted += n
+		if err != nil {
+			return err
+		}
+	}
+
+	n, queries, err := store.Prune(st, retention, time.Now())
+	deleted += n
+	if err != nil {
+		return err
+	}
+
+	if c, ok := st.(store.Compactor); ok {
+		if err := c.Compact(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Deleted %d captures and %d DNS queries\n", deleted, queries)
+	return nil
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+	"github.com/malfunkt/hyperfox/pkg/store"
+	"github.com/malfunkt/hyperfox/pkg/tui"
+)
+
+var flagTUI = flag.Bool("tui", false, "Browse captures in a full-screen terminal UI while proxying.")
+
+func init() {
+	commands["tui"] = tuiCommand
+}
+
+// captureSource feeds the terminal UI with records from the store.
+type captureSource struct{}
+
+func (captureSource) Records(q string, afterID uint64, limit int) ([]capture.RecordMeta, error) {
+	records, _, err := storage.Query(store.Query{
+		Search:  q,
+		AfterID: afterID,
+		Limit:   limit,
+	})
+	return records, err
+}
+
+func (captureSource) Record(uuid string) (*capture.Record, error) {
+	return getCaptureRecord(uuid)
+}
+
+// replayResult describes the response to a replayed request.
+func replayResult(status string, size int64) string {
+	return fmt.Sprintf("%s (%d bytes)", status, size)
+}
+
+// replayClient returns a function that sends recorded requests with client.
+func replayClient(client *http.Client) func(*capture.Record) (string, error) {
+	return func(record *capture.Record) (string, error) {
+		req, err := tui.NewRequest(record)
+		if err != nil {
+			return "", err
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+
+		size, err := io.Copy(ioutil.Discard, res.Body)
+		if err != nil {
+			return "", err
+		}
+		return replayResult(res.Status, size), nil
+	}
+}
+
+// replayWriter is the http.ResponseWriter for requests replayed through the
+// running proxy.
+type replayWriter struct {
+	header http.Header
+	status int
+	size   int64
+}
+
+func (w *replayWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *replayWriter) WriteHeader(status int) {
+	// Informational responses are relayed before the final one, switching
+	// protocols is not supported.
+	if status < http.StatusOK {
+		return
+	}
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *replayWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.size += int64(len(b))
+	return len(b), nil
+}
+
+// replayProxy sends a recorded request through the running proxy, so the
+// replay is captured like any other request.
+func replayProxy(record *capture.Record) (string, error) {
+	req, err := tui.NewRequest(record)
+	if err != nil {
+		return "", err
+	}
+
+	req.RequestURI = req.URL.RequestURI()
+	req.RemoteAddr = "127.0.0.1:0"
+	if req.URL.Scheme == "https" {
+		req.TLS = &tls.ConnectionState{ServerName: req.URL.Hostname()}
+	}
+
+	w := &replayWriter{header: http.Header{}}
+	px.ServeHTTP(w, req)
+
+	if w.status == 0 {
+		return "", errors.New("no response")
+	}
+	return replayResult(fmt.Sprintf("%d %s", w.status, http.StatusText(w.status)), w.size), nil
+}
+
+var (
+	// shownTUI is the terminal UI run by the proxy, shownTUIDone is closed
+	// once it has given the screen back.
+	shownTUI     *tui.UI
+	shownTUIDone chan struct{}
+	shownTUIMu   sync.Mutex
+)
+
+// runTUI shows ui until the user quits or a signal is received on sig.
+func runTUI(ui *tui.UI, sig <-chan os.Signal) error {
+	done := make(chan struct{})
+
+	shownTUIMu.Lock()
+	shownTUI, shownTUIDone = ui, done
+	shownTUIMu.Unlock()
+
+	defer close(done)
+
+	// Signals are only taken while the UI runs, later ones are left to the
+	// shutdown.
+	stopped := make(chan struct{})
+	defer close(stopped)
+
+	go func() {
+		select {
+		case <-sig:
+			ui.Close()
+		case <-stopped:
+		}
+	}()
+
+	// Keep other messages from breaking the screen.
+	log.SetOutput(ui.Writer())
+	defer log.SetOutput(os.Stderr)
+
+	return ui.Run()
+}
+
+// closeTUI closes the terminal UI run by the proxy, if any, and waits for it
+// to give the screen back.
+func closeTUI() {
+	shownTUIMu.Lock()
+	ui, done := shownTUI, shownTUIDone
+	shownTUIMu.Unlock()
+
+	if ui == nil {
+		return
+	}
+	ui.Close()
+	<-done
+}
+
+// newTUI creates the terminal UI.
+func newTUI(replay func(*capture.Record) (string, error), exportDir string) (*tui.UI, error) {
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return nil, err
+	}
+	return tui.New(screen, captureSource{}, tui.Options{
+		Replay:    replay,
+		ExportDir: exportDir,
+	}), nil
+}
+
+// tuiCommand browses the captures of an existing database.
+func tuiCommand(args []string) error {
+	fs := flag.NewFlagSet("tui", flag.ExitOnError)
+
+	var (
+		database  = fs.String("db", "", "Path to the SQLite database to browse, or a postgres:// URL.")
+		exportDir = fs.String("export-dir", ".", "Directory where exported records are written.")
+		proxyURL  = fs.String("proxy", "", "Replay requests through this proxy (e.g. http://127.0.0.1:1080).")
+		insecure  = fs.Bool("insecure", false, "Skip certificate verification when replaying requests.")
+	)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *database == "" {
+		fs.Usage()
+		return errors.New("missing --db")
+	}
+	if !isPostgreSQL(*database) {
+		if _, err := os.Stat(*database); err != nil {
+			return err
+		}
+	}
+
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: *insecure},
+	}
+	if *proxyURL != "" {
+		u, err := url.Parse(*proxyURL)
+		if err != nil {
+			return err
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   30 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// The database may belong to a running Hyperfox, so it's neither migrated
+	// nor compacted here.
+	var err error
+	if storage, err = store.Open(*database, store.Options{ReadOnly: true}); err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	ui, err := newTUI(replayClient(client), *exportDir)
+	if err != nil {
+		return err
+	}
+	return ui.Run()
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+	"github.com/malfunkt/hyperfox/pkg/proxy"
+	"github.com/malfunkt/hyperfox/pkg/tui"
+)
+
+func TestReplayProxyEarlyHints(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</fox.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		_, _ = w.Write([]byte("fox"))
+	}))
+	defer upstream.Close()
+
+	const addr = "127.0.0.1:13090"
+
+	px = proxy.NewProxy()
+	defer func() {
+		px.Stop()
+		px = nil
+	}()
+
+	go func() {
+		if err := px.Start(addr); err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+			t.Errorf("could not start HTTP server: %v", err)
+		}
+	}()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	record := &capture.Record{}
+	record.Method = "GET"
+	record.URL = upstream.URL + "/"
+
+	result, err := replayProxy(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := replayResult("200 OK", 3); result != expected {
+		t.Fatalf("expecting %q, got %q", expected, result)
+	}
+}
+
+type emptySource struct{}
+
+func (emptySource) Records(q string, afterID uint64, limit int) ([]capture.RecordMeta, error) {
+	return nil, nil
+}
+
+func (emptySource) Record(uuid string) (*capture.Record, error) {
+	return nil, errors.New("not found")
+}
+
+func TestRunTUI(t *testing.T) {
+	newUI := func() *tui.UI {
+		return tui.New(tcell.NewSimulationScreen("UTF-8"), emptySource{}, tui.Options{})
+	}
+	defer func() {
+		shownTUI, shownTUIDone = nil, nil
+	}()
+
+	wait := func(errc <-chan error) {
+		t.Helper()
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the UI did not quit")
+		}
+	}
+
+	// A signal quits the UI.
+	sig := make(chan os.Signal, 1)
+	errc := make(chan error, 1)
+	go func() { errc <- runTUI(newUI(), sig) }()
+	sig <- syscall.SIGTERM
+	wait(errc)
+
+	shownTUIMu.Lock()
+	shownTUI, shownTUIDone = nil, nil
+	shownTUIMu.Unlock()
+
+	// closeTUI quits the UI and waits for it.
+	errc = make(chan error, 1)
+	go func() { errc <- runTUI(newUI(), sig) }()
+	for {
+		shownTUIMu.Lock()
+		running := shownTUI != nil
+		shownTUIMu.Unlock()
+		if running {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	closeTUI()
+	wait(errc)
+}
@@ -1,49 +1,31 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
-	"upper.io/db.v3"
-	"upper.io/db.v3/sqlite"
+	"github.com/malfunkt/hyperfox/pkg/store"
 )
 
 const (
-	defaultCaptureCollection = `capture`
-	defaultDatabase          = `hyperfox-%05d.db`
+	defaultDatabase = `hyperfox-%05d.db`
 )
 
-const collectionCreateSQL = `CREATE TABLE "` + defaultCaptureCollection + `" (
-	"id" INTEGER PRIMARY KEY,
-	"uuid" VARCHAR(36) NOT NULL,
-	"origin" VARCHAR(255),
-	"method" VARCHAR(10),
-	"status" INTEGER,
-	"content_type" VARCHAR(255),
-	"content_length" INTEGER,
-	"host" VARCHAR(255),
-	"url" TEXT,
-	"scheme" VARCHAR(10),
-	"path" TEXT,
-	"header" TEXT,
-	"body" BLOB,
-	"keywords" BLOB,
-	"request_header" TEXT,
-	"request_body" BLOB,
-	"date_start" DATETIME,
-	"date_end" DATETIME,
-	"time_taken" INTEGER
-)`
+var flagCompress = flag.Bool("db-compress", false, "Compress captured bodies with zstd before saving them.")
 
-func initDB() (db.Database, error) {
+// openStore opens the store given by --db, a new SQLite database is created
+// when it's empty.
+func openStore() (store.Store, error) {
 
-	databaseName := *flagDatabase
-	if databaseName == "" {
+	dsn := *flagDatabase
+	if dsn == "" {
 		// Let's find an unused database file.
 		for i := 0; ; i++ {
-			databaseName = fmt.Sprintf(defaultDatabase, i)
-			if _, err := os.Stat(databaseName); err != nil {
+			dsn = fmt.Sprintf(defaultDatabase, i)
+			if _, err := os.Stat(dsn); err != nil {
 				// File does not exists (yet).
 				// And that's OK.
 				break
@@ -51,27 +33,24 @@ func initDB() (db.Database, error) {
 		}
 	}
 
-	// Attempting to open database.
-	sess, err := sqlite.Open(sqlite.ConnectionURL{Database: databaseName})
+	st, err := store.Open(dsn, store.Options{Compress: *flagCompress})
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("Using SQLite database: %s", databaseName)
-
-	// Collection lookup.
-	col := sess.Collection(defaultCaptureCollection)
-	if col.Exists() {
-		return sess, nil
+	switch {
+	case isPostgreSQL(dsn):
+		log.Printf("Using PostgreSQL database")
+	case dsn == "memory:":
+		log.Printf("Using in-memory store, captures are lost on exit")
+	default:
+		log.Printf("Using SQLite database: %s", dsn)
 	}
 
-	// Collection does not exists, let's create it.
-	// Execute CREATE TABLE.
-	if _, err = sess.Exec(collectionCreateSQL); err != nil {
-		return nil, err
-	}
-
-	sess.ClearCache()
+	return st, nil
+}
 
-	return sess, nil
+// isPostgreSQL tells whether dsn points to a PostgreSQL database.
+func isPostgreSQL(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
 }
@@ -0,0 +1,225 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/malfunkt/hyperfox/pkg/dnsserver"
+	"github.com/malfunkt/hyperfox/pkg/proxy"
+	"github.com/malfunkt/hyperfox/pkg/resolver"
+	"github.com/malfunkt/hyperfox/pkg/store"
+	"github.com/miekg/dns"
+)
+
+var (
+	flagDNSServer    = flag.String("dns-server", "", "Bind address of the built-in DNS server (e.g. 0.0.0.0:53), disabled if empty.")
+	flagDNSIntercept = flag.String("dns-intercept", "", "Comma separated names the DNS server answers with the proxy address (e.g. example.com,*.example.org).")
+	flagDNSUpstream  = flag.String("dns-upstream", "", "DNS server that answers the queries that are not intercepted (defaults to --dns or the OS settings).")
+	flagDNSAnswer    = flag.String("dns-answer", "", "Comma separated addresses given in intercepted answers (defaults to the proxy address).")
+)
+
+const dnsQueryQueueSize = 256
+
+// dnsQueryLogger saves DNS queries to the database from a single goroutine,
+// queries are dropped when the queue is full so a slow store never delays
+// answers.
+type dnsQueryLogger struct {
+	log store.DNSLog
+
+	mu      sync.Mutex
+	queries chan *dnsserver.Query
+
+	wg sync.WaitGroup
+}
+
+// newDNSQueryLogger starts a dnsQueryLogger that saves queries to l.
+func newDNSQueryLogger(l store.DNSLog) *dnsQueryLogger {
+	w := &dnsQueryLogger{
+		log:     l,
+		queries: make(chan *dnsserver.Query, dnsQueryQueueSize),
+	}
+
+	w.wg.Add(1)
+	go w.run(w.queries)
+
+	return w
+}
+
+func (w *dnsQueryLogger) LogQuery(q *dnsserver.Query) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.queries == nil {
+		return errors.New("query log is closed")
+	}
+	select {
+	case w.queries <- q:
+		return nil
+	default:
+		return errors.New("query log is full")
+	}
+}
+
+// Close saves the queries that are still queued and stops the logger.
+// Queries logged after Close are never saved.
+func (w *dnsQueryLogger) Close() {
+	w.mu.Lock()
+	if w.queries != nil {
+		close(w.queries)
+		w.queries = nil
+	}
+	w.mu.Unlock()
+
+	w.wg.Wait()
+}
+
+func (w *dnsQueryLogger) run(queries <-chan *dnsserver.Query) {
+	defer w.wg.Done()
+
+	for q := range queries {
+		if err := w.log.InsertDNSQueries(q); err != nil {
+			log.Printf("Failed to save DNS query: %q", err)
+		}
+	}
+}
+
+// dnsUpstream returns the DNS server the built-in server forwards queries to.
+func dnsUpstream() (string, error) {
+	if *flagDNSUpstream != "" {
+		return *flagDNSUpstream, nil
+	}
+	if *flagDNS != "" {
+		return *flagDNS, nil
+	}
+	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return "", fmt.Errorf("missing --dns-upstream: %v", err)
+	}
+	if len(config.Servers) == 0 {
+		return "", errors.New("missing --dns-upstream")
+	}
+	return net.JoinHostPort(config.Servers[0], config.Port), nil
+}
+
+// parseIPs parses a comma separated list of IP addresses.
+func parseIPs(s string) ([]net.IP, error) {
+	var ips []net.IP
+
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", addr)
+		}
+		ips = append(ips, ip)
+	}
+
+	return ips, nil
+}
+
+// dnsAnswer returns the addresses given in intercepted answers.
+func dnsAnswer() ([]net.IP, error) {
+	ips, err := parseIPs(*flagDNSAnswer)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+
+	if ip := net.ParseIP(*flagAddress); ip != nil && !ip.IsUnspecified() {
+		return []net.IP{ip}, nil
+	}
+
+	addr, err := localAddr()
+	if err != nil {
+		return nil, err
+	}
+	return []net.IP{net.ParseIP(addr)}, nil
+}
+
+// startDNSServer starts the built-in DNS server, if enabled.
+func startDNSServer(p *proxy.Proxy, bootstrap []net.IP) (*dnsserver.Server, error) {
+	if *flagDNSServer == "" {
+		return nil, nil
+	}
+
+	upstream, err := dnsUpstream()
+	if err != nil {
+		return nil, err
+	}
+
+	exchanger, err := resolver.NewExchangerWithOptions(upstream, resolver.Options{Bootstrap: bootstrap})
+	if err != nil {
+		return nil, err
+	}
+
+	// Intercepted names must still resolve to their real addresses when
+	// Hyperfox connects to them.
+	if *flagDNS == "" {
+		if err := p.SetCustomDNS(upstream, bootstrap...); err != nil {
+			return nil, err
+		}
+	}
+
+	ips, err := dnsAnswer()
+	if err != nil {
+		return nil, err
+	}
+
+	s := dnsserver.New(exchanger)
+	s.SetAddress(ips...)
+
+	for _, pattern := range strings.Split(*flagDNSIntercept, ",") {
+		if strings.TrimSpace(pattern) == "" {
+			continue
+		}
+		if err := s.AddTarget(pattern); err != nil {
+			return nil, fmt.Errorf("%s: %v", pattern, err)
+		}
+	}
+
+	if dnsLog != nil {
+		dnsQueries = newDNSQueryLogger(dnsLog)
+		s.AddQueryLogger(dnsQueries)
+	}
+
+	go func() {
+		if err := s.ListenAndServe(*flagDNSServer); err != nil {
+			fatalf("Failed to bind to %s (DNS): %v", *flagDNSServer, err)
+		}
+	}()
+
+	log.Printf("DNS server listening on %s, answering %v with %v", *flagDNSServer, s.Targets(), ips)
+
+	return s, nil
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/malfunkt/hyperfox/pkg/dnsserver"
+	"github.com/malfunkt/hyperfox/pkg/store"
+)
+
+func TestDNSQueryLoggerClose(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	l := st.(store.DNSLog)
+	w := newDNSQueryLogger(l)
+
+	for i := 0; i < dnsQueryQueueSize; i++ {
+		if err := w.LogQuery(&dnsserver.Query{Name: fmt.Sprintf("%d.example.com.", i), Type: "A"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	// Queries that were queued are saved by Close.
+	_, total, err := l.DNSQueries(store.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != dnsQueryQueueSize {
+		t.Fatalf("expecting %d queries, got %d", dnsQueryQueueSize, total)
+	}
+
+	if err := w.LogQuery(&dnsserver.Query{Name: "late.example.com."}); err == nil {
+		t.Fatal("expecting queries logged after Close to be refused")
+	}
+	w.Close()
+}
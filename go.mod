@@ -1,20 +1,38 @@
 module github.com/malfunkt/hyperfox
 
-go 1.12
+go 1.24
 
 require (
+	github.com/andybalholm/brotli v1.1.1
+	github.com/bufbuild/protocompile v0.14.1
+	github.com/gdamore/tcell/v2 v2.8.1
 	github.com/go-chi/chi v4.0.3+incompatible
 	github.com/go-chi/cors v1.0.1
 	github.com/google/uuid v1.1.1
 	github.com/gorilla/websocket v1.4.1
-	github.com/mattn/go-sqlite3 v1.11.0 // indirect
+	github.com/klauspost/compress v1.18.0
 	github.com/mdp/qrterminal/v3 v3.0.0
 	github.com/miekg/dns v1.1.29
 	github.com/pkg/browser v0.0.0-20180916011732-0a3d74bf9ce4
 	github.com/rakyll/statik v0.1.7
-	github.com/stretchr/testify v1.5.1 // indirect
-	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b
-	golang.org/x/tools v0.0.0-20200417140056-c07e33ef3290 // indirect
-	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22 // indirect
+	golang.org/x/net v0.25.0
+	golang.org/x/term v0.28.0
+	golang.org/x/text v0.21.0
+	google.golang.org/protobuf v1.34.2
 	upper.io/db.v3 v3.6.1+incompatible
 )
+
+require (
+	github.com/gdamore/encoding v1.0.1 // indirect
+	github.com/lib/pq v1.9.0 // indirect
+	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
+	github.com/mattn/go-runewidth v0.0.16 // indirect
+	github.com/mattn/go-sqlite3 v1.11.0 // indirect
+	github.com/rivo/uniseg v0.4.3 // indirect
+	github.com/satori/go.uuid v1.2.0 // indirect
+	golang.org/x/crypto v0.23.0 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22 // indirect
+	rsc.io/qr v0.2.0 // indirect
+)
@@ -22,16 +22,23 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/malfunkt/hyperfox/pkg/dnsserver"
 	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
-	"github.com/malfunkt/hyperfox/pkg/plugins/logger"
 	"github.com/malfunkt/hyperfox/pkg/proxy"
-	"upper.io/db.v3"
+	"github.com/malfunkt/hyperfox/pkg/store"
+	"github.com/malfunkt/hyperfox/pkg/tui"
 )
 
 const Version = "2.0.0"
@@ -43,29 +50,94 @@ const (
 )
 
 var (
-	flagHelp        = flag.Bool("h", false, "Shows usage options.")
-	flagVersion     = flag.Bool("v", false, "Shows Hyperfox version.")
-	flagDatabase    = flag.String("db", "", "Path to SQLite database.")
-	flagAddress     = flag.String("addr", defaultAddress, "Bind address.")
-	flagPort        = flag.Uint("http", defaultPort, "Bind port (HTTP mode).")
-	flagTLSPort     = flag.Uint("https", defaultTLSPort, "Bind port (SSL/TLS mode). Requires --ca-cert and --ca-key.")
-	flagTLSCertFile = flag.String("ca-cert", "", "Path to root CA certificate.")
-	flagTLSKeyFile  = flag.String("ca-key", "", "Path to root CA key.")
-	flagDNS         = flag.String("dns", "", "Custom DNS server that bypasses the OS settings")
+	flagHelp            = flag.Bool("h", false, "Shows usage options.")
+	flagVersion         = flag.Bool("v", false, "Shows Hyperfox version.")
+	flagDatabase        = flag.String("db", "", "Path to SQLite database, or a postgres:// URL to share captures with a team.")
+	flagAddress         = flag.String("addr", defaultAddress, "Bind address.")
+	flagPort            = flag.Uint("http", defaultPort, "Bind port (HTTP mode).")
+	flagTLSPort         = flag.Uint("https", defaultTLSPort, "Bind port (SSL/TLS mode). Requires --ca-cert and --ca-key.")
+	flagTLSCertFile     = flag.String("ca-cert", "", "Path to root CA certificate.")
+	flagTLSKeyFile      = flag.String("ca-key", "", "Path to root CA key.")
+	flagDNS             = flag.String("dns", "", "Custom DNS server that bypasses the OS settings (host:port, https://host/dns-query or tls://host).")
+	flagDNSBootstrap    = flag.String("dns-bootstrap", "", "Comma separated IP addresses of DNS-over-HTTPS or DNS-over-TLS servers given by hostname.")
+	flagTLSDefaultHost  = flag.String("tls-default-host", "", "Certificate name used for TLS clients that send no SNI (defaults to the destination IP).")
+	flagHosts           = flag.String("hosts", "", "Comma separated host overrides (e.g. api.example.com=10.0.3.7,*.staging.test=127.0.0.1).")
+	flagHostsFile       = flag.String("hosts-file", "", "Path to a file with host overrides in hosts file format.")
+	flagKeyLog          = flag.String("keylog", "", "Path to a file where TLS secrets are appended in NSS key log format.")
+	flagVia             = flag.String("via", "", "Name of the proxy in Via headers added to requests and responses (none by default).")
+	flagForwarded       = flag.Bool("forwarded", false, "Add a Forwarded header with the client's address to requests.")
+	flagXForwardedFor   = flag.Bool("x-forwarded-for", false, "Append the client's address to X-Forwarded-For headers.")
+	flagShutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "How long requests in flight are waited for when shutting down.")
 )
 
 var (
-	sess    db.Database
-	storage db.Collection
+	storage    store.Store
+	dnsLog     store.DNSLog
+	dnsQueries *dnsQueryLogger
+	px         *proxy.Proxy
+	dnss       *dnsserver.Server
 )
 
+// commands holds the subcommands, by name.
+var commands = map[string]func(args []string) error{}
+
+// setupHostOverrides loads host overrides from --hosts-file and --hosts.
+func setupHostOverrides(p *proxy.Proxy) error {
+	if *flagHostsFile != "" {
+		f, err := os.Open(*flagHostsFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if err := p.LoadHostOverrides(f); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range strings.Split(*flagHosts, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		chunks := strings.SplitN(entry, "=", 2)
+		if len(chunks) != 2 {
+			return fmt.Errorf("expecting pattern=target, got %q", entry)
+		}
+		if err := p.SetHostOverride(chunks[0], chunks[1]); err != nil {
+			return fmt.Errorf("%s: %v", entry, err)
+		}
+	}
+
+	return nil
+}
+
 func main() {
 
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+
 	flag.Parse()
 
 	if *flagHelp {
-		fmt.Printf("Usage: hyperfox [options]\n\n")
+		fmt.Printf("Usage: hyperfox [options]\n")
+		fmt.Printf("       hyperfox <command> [options]\n\n")
 		flag.PrintDefaults()
+		fmt.Printf("\nCommands:\n")
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  %s\n", name)
+		}
 		return
 	}
 
@@ -78,15 +150,23 @@ func main() {
 
 	// Opening database.
 	var err error
-	sess, err = initDB()
+	storage, err = openStore()
 	if err != nil {
 		log.Fatal("Failed to setup database: ", err)
 	}
-	defer sess.Close()
+	defer storage.Close()
+
+	// The DNS log lives next to the captures.
+	dnsLog, _ = storage.(store.DNSLog)
+
+	retention := retentionPolicy()
+	if _, ok := storage.(store.Compactor); !ok && retention.MaxSize > 0 {
+		log.Fatal("--retention-max-size is only supported by SQLite databases")
+	}
+	defer startRetention(storage, retention, *flagRetentionInterval)()
 
-	storage = sess.Collection(defaultCaptureCollection)
-	if !storage.Exists() {
-		log.Fatalf("No such table %q", defaultCaptureCollection)
+	if protoSchema, err = loadProtoSchema(); err != nil {
+		log.Fatal("Failed to load Protobuf definitions: ", err)
 	}
 
 	// Is TLS enabled?
@@ -113,38 +193,80 @@ func main() {
 
 	// Creating proxy.
 	p := proxy.NewProxy()
+	px = p
+
+	bootstrap, err := parseIPs(*flagDNSBootstrap)
+	if err != nil {
+		log.Fatalf("invalid DNS bootstrap addresses: %v", err)
+	}
 
 	if *flagDNS != "" {
-		if err := p.SetCustomDNS(*flagDNS); err != nil {
+		if err := p.SetCustomDNS(*flagDNS, bootstrap...); err != nil {
 			log.Fatalf("unable to set custom DNS server: %v", err)
 		}
 	}
 
+	if *flagKeyLog != "" {
+		keyLog, err := os.OpenFile(*flagKeyLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalf("unable to open key log file: %v", err)
+		}
+		defer keyLog.Close()
+
+		p.SetKeyLogWriter(keyLog)
+	}
+
+	p.SetDefaultServerName(*flagTLSDefaultHost)
+
+	p.SetForwarding(proxy.Forwarding{
+		Via:           *flagVia,
+		Forwarded:     *flagForwarded,
+		XForwardedFor: *flagXForwardedFor,
+	})
+
+	if err := setupHostOverrides(p); err != nil {
+		log.Fatalf("unable to set host overrides: %v", err)
+	}
+
+	if err := setupUpstreamTLS(p); err != nil {
+		log.Fatalf("unable to set upstream TLS settings: %v", err)
+	}
+
+	if dnss, err = startDNSServer(p, bootstrap); err != nil {
+		log.Fatalf("unable to start DNS server: %v", err)
+	}
+
+	var ui *tui.UI
+	if *flagTUI {
+		if ui, err = newTUI(replayProxy, "."); err != nil {
+			log.Fatalf("unable to create terminal UI: %v", err)
+		}
+	}
+
 	// Attaching logger.
-	p.AddLogger(logger.Stdout{})
+	tty, closeLog, err := setupAccessLog(p)
+	if err != nil {
+		log.Fatalf("unable to set up access log: %v", err)
+	}
+	defer closeLog()
+
+	// Saving captured data from a single writer.
+	writer := newRecordWriter(storage, *flagBatchSize, *flagFlushInterval, func(lastID int64) {
+		message := struct {
+			LastRecordID int64 `json:"last_record_id"`
+		}{lastID}
+		if err := wsBroadcast(message); err != nil {
+			log.Print("wsBroadcast: ", err)
+		}
+		if ui != nil {
+			ui.Refresh()
+		}
+	})
 
 	// Attaching capture tool.
-	res := make(chan *capture.Record, 256)
-
-	p.AddBodyWriteCloser(capture.New(res))
-
-	// Saving captured data with a goroutine.
-	go func(res chan *capture.Record) {
-		for r := range res {
-			go func(r *capture.Record) {
-				id, err := storage.Insert(r)
-				if err != nil {
-					log.Printf("Failed to save to database: %s", err)
-				}
-				message := struct {
-					LastRecordID int64 `json:"last_record_id"`
-				}{id.(int64)}
-				if err := wsBroadcast(message); err != nil {
-					log.Print("wsBroadcast: ", err)
-				}
-			}(r)
-		}
-	}(res)
+	capt := capture.New(writer.Queue())
+	p.AddBodyWriteCloser(capt)
+	p.AddHandshakeLogger(capt)
 
 	if *flagUI || *flagAPI {
 		if err = startServices(); err != nil {
@@ -153,6 +275,11 @@ func main() {
 		fmt.Println("")
 	}
 
+	if tty != nil && makeRaw() {
+		defer restoreTerminal()
+		go readCommands(tty)
+	}
+
 	var wg sync.WaitGroup
 
 	// Starting proxy servers.
@@ -161,7 +288,7 @@ func main() {
 		go func() {
 			defer wg.Done()
 			if err := p.Start(fmt.Sprintf("%s:%d", *flagAddress, *flagPort)); err != nil {
-				log.Fatalf("Failed to bind to %s:%d (HTTP): %v", *flagAddress, *flagPort, err)
+				fatalf("Failed to bind to %s:%d (HTTP): %v", *flagAddress, *flagPort, err)
 			}
 		}()
 	}
@@ -171,10 +298,71 @@ func main() {
 		go func() {
 			defer wg.Done()
 			if err := p.StartTLS(fmt.Sprintf("%s:%d", *flagAddress, *flagTLSPort)); err != nil {
-				log.Fatalf("Failed to bind to %s:%d (TLS): %v", *flagAddress, *flagTLSPort, err)
+				fatalf("Failed to bind to %s:%d (TLS): %v", *flagAddress, *flagTLSPort, err)
 			}
 		}()
 	}
 
-	wg.Wait()
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	if ui != nil {
+		if err := runTUI(ui, sig); err != nil {
+			log.Printf("ui.Run: %v", err)
+		}
+	} else {
+		select {
+		case <-sig:
+		case <-stopped:
+		}
+	}
+
+	go func() {
+		<-sig
+		log.Printf("Forced shutdown")
+		restoreTerminal()
+		os.Exit(1)
+	}()
+
+	shutdown(p, writer)
+}
+
+// shutdown stops accepting requests, waits up to --shutdown-timeout for the
+// ones in flight and saves the records and DNS queries that are still
+// queued.
+func shutdown(p *proxy.Proxy, writer *recordWriter) {
+	restoreTerminal()
+	log.Printf("Shutting down...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), *flagShutdownTimeout)
+	defer cancel()
+
+	if dnss != nil {
+		if err := dnss.Close(); err != nil {
+			log.Printf("dnss.Close: %q", err)
+		}
+	}
+
+	// Answered queries may still be queued.
+	if dnsQueries != nil {
+		dnsQueries.Close()
+	}
+
+	if err := p.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %q", err)
+	}
+
+	// The proxy queues records before answering, so they are all in.
+	writer.Close()
+
+	wsCloseAll()
+	if err := shutdownServices(ctx); err != nil {
+		log.Printf("shutdownServices: %q", err)
+	}
 }
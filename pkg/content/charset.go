@@ -0,0 +1,115 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package content
+
+import (
+	"bytes"
+	"mime"
+	"regexp"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+)
+
+// prescanLength is how far into a body charset declarations are looked for.
+const prescanLength = 1024
+
+var (
+	reXMLEncoding = regexp.MustCompile(`^\s*<\?xml[^>]*\sencoding\s*=\s*["']([A-Za-z0-9._:-]+)["']`)
+	reMetaCharset = regexp.MustCompile(`(?i)<meta[^>]*\scharset\s*=\s*["']?\s*([A-Za-z0-9._:-]+)`)
+)
+
+var boms = []struct {
+	bom     []byte
+	charset string
+}{
+	{[]byte{0xef, 0xbb, 0xbf}, "utf-8"},
+	{[]byte{0xfe, 0xff}, "utf-16be"},
+	{[]byte{0xff, 0xfe}, "utf-16le"},
+}
+
+// Charset returns the canonical name of the charset of a decoded body, it's
+// told by a byte order mark, the charset parameter of contentType or an XML
+// or HTML declaration, in that order. It returns "" when the charset is not
+// known.
+func Charset(contentType string, body []byte) string {
+	for _, b := range boms {
+		if bytes.HasPrefix(body, b.bom) {
+			return b.charset
+		}
+	}
+
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if _, name := charset.Lookup(params["charset"]); name != "" {
+			return name
+		}
+	}
+
+	head := body
+	if len(head) > prescanLength {
+		head = head[:prescanLength]
+	}
+	for _, re := range []*regexp.Regexp{reXMLEncoding, reMetaCharset} {
+		if m := re.FindSubmatch(head); m != nil {
+			if _, name := charset.Lookup(string(m[1])); name != "" {
+				return name
+			}
+		}
+	}
+
+	return ""
+}
+
+// ToUTF8 transcodes a decoded text body to UTF-8 and returns it along with
+// the charset it was in. Bodies in unknown charsets are returned as they
+// are.
+func ToUTF8(contentType string, body []byte) ([]byte, string, error) {
+	name := Charset(contentType, body)
+
+	for _, b := range boms {
+		if b.charset == name {
+			body = bytes.TrimPrefix(body, b.bom)
+			break
+		}
+	}
+
+	if name == "" || name == "utf-8" {
+		return body, name, nil
+	}
+
+	enc, _ := charset.Lookup(name)
+	text, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return body, name, err
+	}
+	return text, name, nil
+}
+
+// Text returns a decoded body as UTF-8 text, or false if it doesn't look
+// like text.
+func Text(contentType string, body []byte) ([]byte, bool) {
+	text, _, err := ToUTF8(contentType, body)
+	if err != nil || !utf8.Valid(text) {
+		return body, false
+	}
+	return text, true
+}
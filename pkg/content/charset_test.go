@@ -0,0 +1,80 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package content
+
+import (
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func encode(t *testing.T, enc encoding.Encoding, text string) []byte {
+	data, err := enc.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestToUTF8(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        []byte
+		charset     string
+		text        string
+	}{
+		{"text/plain; charset=Shift_JIS", encode(t, japanese.ShiftJIS, "こんにちは"), "shift_jis", "こんにちは"},
+		{"text/html", append([]byte("<html><head><meta charset=\"iso-8859-1\"></head>"), encode(t, charmap.ISO8859_1, "Mañana")...), "windows-1252", "<html><head><meta charset=\"iso-8859-1\"></head>Mañana"},
+		{"text/html", append([]byte(`<meta http-equiv="Content-Type" content="text/html; charset=EUC-JP">`), encode(t, japanese.EUCJP, "日本")...), "euc-jp", `<meta http-equiv="Content-Type" content="text/html; charset=EUC-JP">日本`},
+		{"application/xml", encode(t, japanese.ShiftJIS, `<?xml version="1.0" encoding="Shift_JIS"?><a>東京</a>`), "shift_jis", `<?xml version="1.0" encoding="Shift_JIS"?><a>東京</a>`},
+		{"", encode(t, unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), "Grüße"), "utf-16le", "Grüße"},
+		{"", encode(t, unicode.UTF16(unicode.BigEndian, unicode.UseBOM), "Grüße"), "utf-16be", "Grüße"},
+		// A byte order mark wins over the declared charset.
+		{"text/plain; charset=iso-8859-1", []byte("\xef\xbb\xbfGrüße"), "utf-8", "Grüße"},
+		{"text/plain", []byte("plain"), "", "plain"},
+	}
+
+	for _, test := range tests {
+		text, name, err := ToUTF8(test.contentType, test.body)
+		if err != nil {
+			t.Fatalf("%q: %v", test.contentType, err)
+		}
+		if name != test.charset {
+			t.Fatalf("%q: expecting charset %q, got %q", test.contentType, test.charset, name)
+		}
+		if string(text) != test.text {
+			t.Fatalf("%q: expecting %q, got %q", test.contentType, test.text, text)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	if text, ok := Text("text/plain; charset=shift_jis", encode(t, japanese.ShiftJIS, "テスト")); !ok || string(text) != "テスト" {
+		t.Fatalf("expecting text, got %q", text)
+	}
+	if _, ok := Text("image/png", []byte{0x89, 'P', 'N', 'G', 0xff, 0xfe, 0x00}); ok {
+		t.Fatal("expecting binary bodies not to be text")
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package content
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	var (
+		buf bytes.Buffer
+		w   io.WriteCloser
+		err error
+	)
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	case "flate":
+		w, err = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		w, err = zstd.NewWriter(&buf)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	body := []byte("<html><body>hello</body></html>")
+
+	tests := []struct {
+		contentEncoding string
+		data            []byte
+	}{
+		{"", body},
+		{"identity", body},
+		{"gzip", compress(t, "gzip", body)},
+		{"x-gzip", compress(t, "gzip", body)},
+		{"deflate", compress(t, "zlib", body)},
+		{"deflate", compress(t, "flate", body)},
+		{"br", compress(t, "br", body)},
+		{"zstd", compress(t, "zstd", body)},
+		{"gzip, br", compress(t, "br", compress(t, "gzip", body))},
+		{"ZSTD , identity,Deflate", compress(t, "zlib", compress(t, "zstd", body))},
+	}
+
+	for _, test := range tests {
+		header := http.Header{}
+		if test.contentEncoding != "" {
+			header.Set("Content-Encoding", test.contentEncoding)
+		}
+		decoded, err := Decode(header, test.data)
+		if err != nil {
+			t.Fatalf("%q: %v", test.contentEncoding, err)
+		}
+		if !bytes.Equal(decoded, body) {
+			t.Fatalf("%q: unexpected body %q", test.contentEncoding, decoded)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	header := http.Header{"Content-Encoding": {"compress"}}
+	if _, err := Decode(header, []byte("x")); err == nil {
+		t.Fatal("expecting an error for unsupported encodings")
+	}
+
+	// The body is returned as is when it can't be decoded.
+	header = http.Header{"Content-Encoding": {"gzip"}}
+	body, err := Decode(header, []byte("not gzip"))
+	if err == nil {
+		t.Fatal("expecting an error for a corrupt body")
+	}
+	if string(body) != "not gzip" {
+		t.Fatalf("expecting the raw body, got %q", body)
+	}
+
+	defer func(size int64) { MaxDecodedSize = size }(MaxDecodedSize)
+	MaxDecodedSize = 10
+
+	bomb := compress(t, "gzip", []byte(strings.Repeat("a", 1000)))
+	if _, err := Decode(header, bomb); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expecting %v, got %v", ErrTooLarge, err)
+	}
+}
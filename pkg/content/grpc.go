@@ -0,0 +1,218 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package content
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// grpcCodes are the names of gRPC status codes, by number.
+var grpcCodes = []string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+const (
+	grpcFlagCompressed = 0x01
+	// gRPC-Web sends the trailers as the last frame of the body.
+	grpcFlagTrailer = 0x80
+)
+
+// GRPCFrame is a length-prefixed message of a gRPC body.
+type GRPCFrame struct {
+	Compressed bool     `json:"compressed"`
+	Size       int      `json:"size"`
+	Message    *Message `json:"message,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// GRPCStatus is the outcome of a gRPC call.
+type GRPCStatus struct {
+	Code    int      `json:"code"`
+	Name    string   `json:"name,omitempty"`
+	Message string   `json:"message,omitempty"`
+	Details *Message `json:"details,omitempty"`
+}
+
+// GRPC is a gRPC request or response body.
+type GRPC struct {
+	Service  string      `json:"service,omitempty"`
+	Method   string      `json:"method,omitempty"`
+	Type     string      `json:"type,omitempty"`
+	Encoding string      `json:"encoding,omitempty"`
+	Messages []GRPCFrame `json:"messages"`
+	Status   *GRPCStatus `json:"status,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// parseGRPC splits a gRPC or gRPC-Web body into its messages and decodes
+// them with the types of the method that was called, if the schema knows
+// it.
+func parseGRPC(mediaType string, header http.Header, body []byte, opts Options) *GRPC {
+	g := &GRPC{Encoding: header.Get("Grpc-Encoding")}
+
+	if parts := strings.Split(strings.Trim(opts.Path, "/"), "/"); len(parts) == 2 {
+		g.Service, g.Method = parts[0], parts[1]
+		if md := opts.Schema.method(g.Service, g.Method); md != nil {
+			if opts.Request {
+				g.Type = string(md.Input().FullName())
+			} else {
+				g.Type = string(md.Output().FullName())
+			}
+		}
+	}
+
+	if strings.HasPrefix(mediaType, "application/grpc-web-text") {
+		decoded, err := decodeBase64Chunks(body)
+		if err != nil {
+			g.Error = err.Error()
+			return g
+		}
+		body = decoded
+	}
+
+	// Trailers-only responses carry the status in the headers.
+	trailer := opts.Trailer
+	if trailer.Get("Grpc-Status") == "" {
+		trailer = header
+	}
+
+	g.Messages = []GRPCFrame{}
+	for len(body) > 0 {
+		if len(body) < 5 {
+			g.Error = fmt.Sprintf("truncated message prefix (%d bytes)", len(body))
+			break
+		}
+		flags, size := body[0], binary.BigEndian.Uint32(body[1:5])
+		body = body[5:]
+		if uint64(size) > uint64(len(body)) {
+			g.Error = fmt.Sprintf("truncated message, expecting %d bytes, got %d", size, len(body))
+			break
+		}
+		data := body[:size]
+		body = body[size:]
+
+		if flags&grpcFlagTrailer != 0 {
+			if t, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(append([]byte(nil), data...), "\r\n"...)))).ReadMIMEHeader(); err == nil {
+				trailer = http.Header(t)
+			} else {
+				g.Error = fmt.Sprintf("trailer frame: %v", err)
+			}
+			continue
+		}
+
+		frame := GRPCFrame{
+			Compressed: flags&grpcFlagCompressed != 0,
+			Size:       int(size),
+		}
+		if frame.Compressed {
+			decoded, err := decode(strings.ToLower(g.Encoding), data)
+			if err != nil {
+				frame.Error = fmt.Sprintf("%s: %v", g.Encoding, err)
+				g.Messages = append(g.Messages, frame)
+				continue
+			}
+			data = decoded
+		}
+		frame.Message = DecodeMessage(data, g.Type, opts.Schema)
+		g.Messages = append(g.Messages, frame)
+	}
+
+	if !opts.Request {
+		g.Status = grpcStatus(trailer, opts.Schema)
+	}
+	return g
+}
+
+// grpcStatus reads the status of a call from its trailers.
+func grpcStatus(trailer http.Header, schema *Schema) *GRPCStatus {
+	value := trailer.Get("Grpc-Status")
+	if value == "" {
+		return nil
+	}
+
+	s := &GRPCStatus{}
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		s.Code, s.Name = -1, value
+		return s
+	}
+	s.Code = code
+	if code >= 0 && code < len(grpcCodes) {
+		s.Name = grpcCodes[code]
+	}
+
+	// The message is percent-encoded.
+	s.Message = trailer.Get("Grpc-Message")
+	if m, err := url.PathUnescape(s.Message); err == nil {
+		s.Message = m
+	}
+
+	if details := trailer.Get("Grpc-Status-Details-Bin"); details != "" {
+		data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(details, "="))
+		if err == nil {
+			s.Details = DecodeMessage(data, "google.rpc.Status", schema)
+		}
+	}
+	return s
+}
+
+// decodeBase64Chunks decodes a gRPC-Web text body, each of its messages may
+// have been encoded on its own, with padding.
+func decodeBase64Chunks(body []byte) ([]byte, error) {
+	var out []byte
+	chunks := strings.FieldsFunc(strings.TrimSpace(string(body)), func(r rune) bool {
+		return r == '='
+	})
+	for _, chunk := range chunks {
+		decoded, err := base64.RawStdEncoding.DecodeString(chunk)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, decoded...)
+	}
+	return out, nil
+}
@@ -0,0 +1,449 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package content
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// Kinds of bodies told apart by Parse.
+const (
+	KindEmpty     = "empty"
+	KindJSON      = "json"
+	KindXML       = "xml"
+	KindForm      = "form"
+	KindMultipart = "multipart"
+	KindGRPC      = "grpc"
+	KindProtobuf  = "protobuf"
+	KindText      = "text"
+	KindBinary    = "binary"
+)
+
+// ErrNoPart is returned by PartContent when a multipart body has no such part.
+var ErrNoPart = errors.New("no such part")
+
+// Options tell Parse what it can't learn from a body and its headers.
+type Options struct {
+	// Path of the request, gRPC methods are told by it.
+	Path string
+	// Request is set for request bodies.
+	Request bool
+	// Trailer of the response, it holds the status of gRPC calls.
+	Trailer http.Header
+	// Schema is used to decode Protobuf messages, they're decoded without
+	// one when it's nil or doesn't know their types.
+	Schema *Schema
+}
+
+// Pair is a name and value from a query string or form, pairs are kept in
+// the order they were sent and names may repeat.
+type Pair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Part describes a part of a multipart body.
+type Part struct {
+	Index       int         `json:"index"`
+	Name        string      `json:"name,omitempty"`
+	Filename    string      `json:"filename,omitempty"`
+	ContentType string      `json:"content_type,omitempty"`
+	Header      http.Header `json:"header"`
+	Size        int         `json:"size"`
+}
+
+// XMLNode is an element of an XML document.
+type XMLNode struct {
+	Name     string     `json:"name"`
+	Attrs    []Pair     `json:"attrs,omitempty"`
+	Text     string     `json:"text,omitempty"`
+	Children []*XMLNode `json:"children,omitempty"`
+}
+
+// Parsed is a structured view of a body. Bodies that can't be parsed as
+// what they claim to be come with an Error and, if they're text, the Text.
+type Parsed struct {
+	Kind        string `json:"kind"`
+	ContentType string `json:"content_type,omitempty"`
+	Charset     string `json:"charset,omitempty"`
+	// Size of the body after removing its content encodings.
+	Size  int    `json:"size"`
+	Error string `json:"error,omitempty"`
+
+	Pretty string      `json:"pretty,omitempty"`
+	JSON   interface{} `json:"json,omitempty"`
+	XML    *XMLNode    `json:"xml,omitempty"`
+	Form   []Pair      `json:"form,omitempty"`
+	Parts  []Part      `json:"parts,omitempty"`
+	Text   string      `json:"text,omitempty"`
+
+	GRPC     *GRPC    `json:"grpc,omitempty"`
+	Protobuf *Message `json:"protobuf,omitempty"`
+
+	// Query is filled by callers that know the URL of the request.
+	Query []Pair `json:"query,omitempty"`
+}
+
+// ParsePairs parses a query string or an application/x-www-form-urlencoded
+// body. Pairs that are not properly escaped are kept as they are and
+// reported by the error.
+func ParsePairs(s string) ([]Pair, error) {
+	var (
+		pairs []Pair
+		bad   []string
+	)
+	for _, field := range strings.Split(s, "&") {
+		if field == "" {
+			continue
+		}
+		name, value := field, ""
+		if i := strings.Index(field, "="); i >= 0 {
+			name, value = field[:i], field[i+1:]
+		}
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		} else {
+			bad = append(bad, field)
+		}
+		if v, err := url.QueryUnescape(value); err == nil {
+			value = v
+		} else {
+			bad = append(bad, field)
+		}
+		pairs = append(pairs, Pair{Name: name, Value: value})
+	}
+	if len(bad) > 0 {
+		return pairs, fmt.Errorf("invalid escapes in %q", bad)
+	}
+	return pairs, nil
+}
+
+// protobufTypes are the media types of Protobuf messages.
+var protobufTypes = map[string]bool{
+	"application/protobuf":            true,
+	"application/x-protobuf":          true,
+	"application/x-google-protobuf":   true,
+	"application/vnd.google.protobuf": true,
+}
+
+// kind tells what a body is from its media type, or from the body itself
+// when the type is not specific.
+func kind(mediaType string, body []byte) string {
+	switch {
+	case strings.HasPrefix(mediaType, "application/grpc"):
+		// Calls that fail right away have no messages but a status.
+		return KindGRPC
+	case len(body) == 0:
+		return KindEmpty
+	case mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json"):
+		return KindJSON
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		return KindXML
+	case mediaType == "application/x-www-form-urlencoded":
+		return KindForm
+	case strings.HasPrefix(mediaType, "multipart/"):
+		return KindMultipart
+	case protobufTypes[mediaType]:
+		return KindProtobuf
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	switch {
+	case (bytes.HasPrefix(trimmed, []byte("{")) || bytes.HasPrefix(trimmed, []byte("["))) && json.Valid(trimmed):
+		return KindJSON
+	case bytes.HasPrefix(trimmed, []byte("<?xml")):
+		return KindXML
+	case strings.HasPrefix(mediaType, "text/"):
+		return KindText
+	}
+	return KindBinary
+}
+
+// Parse removes the content encodings of body and returns a structured view
+// of it according to the Content-Type in header.
+func Parse(header http.Header, body []byte, opts Options) *Parsed {
+	p := &Parsed{ContentType: header.Get("Content-Type")}
+
+	decoded, err := Decode(header, body)
+	if err != nil {
+		p.Kind, p.Size, p.Error = KindBinary, len(body), err.Error()
+		return p
+	}
+	p.Size = len(decoded)
+
+	mediaType, params, _ := mime.ParseMediaType(p.ContentType)
+	p.Kind = kind(mediaType, decoded)
+
+	switch p.Kind {
+	case KindEmpty:
+		return p
+	case KindMultipart:
+		parts, _, err := readParts(params["boundary"], decoded)
+		p.Parts = parts
+		if err != nil {
+			p.Error = err.Error()
+		}
+		return p
+	case KindGRPC:
+		p.GRPC = parseGRPC(mediaType, header, decoded, opts)
+		return p
+	case KindProtobuf:
+		// The type may be given as a parameter, e.g.
+		// application/x-protobuf; proto=package.Message
+		typeName := params["proto"]
+		if typeName == "" {
+			typeName = params["messagetype"]
+		}
+		p.Protobuf = DecodeMessage(decoded, typeName, opts.Schema)
+		return p
+	}
+
+	text, name, err := ToUTF8(p.ContentType, decoded)
+	p.Charset = name
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+
+	switch p.Kind {
+	case KindJSON:
+		err = parseJSON(p, text)
+	case KindXML:
+		err = parseXML(p, text)
+	case KindForm:
+		p.Form, err = ParsePairs(strings.TrimSpace(string(text)))
+	}
+	if err != nil {
+		p.Error = err.Error()
+	}
+
+	// Bodies of unspecific types may still be text, e.g. scripts.
+	if p.Kind == KindBinary && strings.HasPrefix(http.DetectContentType(text), "text/") {
+		p.Kind = KindText
+	}
+	if (p.Kind == KindText || (err != nil && p.Form == nil)) && utf8.Valid(text) {
+		p.Text = string(text)
+	}
+
+	return p
+}
+
+func parseJSON(p *Parsed, text []byte) error {
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, bytes.TrimSpace(text), "", "  "); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(text))
+	// Numbers are kept as they were written.
+	dec.UseNumber()
+	if err := dec.Decode(&p.JSON); err != nil {
+		return err
+	}
+
+	p.Pretty = pretty.String()
+	return nil
+}
+
+func parseXML(p *Parsed, text []byte) error {
+	dec := xml.NewDecoder(bytes.NewReader(text))
+	// The text is UTF-8 by now, whatever the declaration says.
+	dec.CharsetReader = func(_ string, r io.Reader) (io.Reader, error) {
+		return r, nil
+	}
+
+	var (
+		pretty bytes.Buffer
+		stack  []*XMLNode
+		root   *XMLNode
+		// Whether the last element written has children.
+		nested bool
+	)
+	indent := func() {
+		if pretty.Len() > 0 {
+			pretty.WriteString("\n")
+		}
+		pretty.WriteString(strings.Repeat("  ", len(stack)))
+	}
+
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			node := &XMLNode{Name: xmlName(t.Name)}
+			for _, attr := range t.Attr {
+				node.Attrs = append(node.Attrs, Pair{Name: xmlName(attr.Name), Value: attr.Value})
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, node)
+			} else if root == nil {
+				root = node
+			} else {
+				return errors.New("XML document has more than one root element")
+			}
+
+			indent()
+			pretty.WriteString("<" + node.Name)
+			for _, attr := range node.Attrs {
+				pretty.WriteString(" " + attr.Name + `="`)
+				_ = xml.EscapeText(&pretty, []byte(attr.Value))
+				pretty.WriteString(`"`)
+			}
+			pretty.WriteString(">")
+
+			stack = append(stack, node)
+			nested = false
+		case xml.EndElement:
+			if len(stack) == 0 || stack[len(stack)-1].Name != xmlName(t.Name) {
+				return fmt.Errorf("unexpected closing tag </%s>", xmlName(t.Name))
+			}
+			stack = stack[:len(stack)-1]
+			if nested {
+				indent()
+			}
+			pretty.WriteString("</" + xmlName(t.Name) + ">")
+			nested = true
+		case xml.CharData:
+			s := strings.TrimSpace(string(t))
+			if s == "" {
+				continue
+			}
+			if len(stack) == 0 {
+				return errors.New("text outside of the root element")
+			}
+			node := stack[len(stack)-1]
+			node.Text += s
+			if len(node.Children) > 0 {
+				indent()
+			}
+			_ = xml.EscapeText(&pretty, []byte(s))
+		case xml.Comment:
+			indent()
+			pretty.WriteString("<!--" + string(t) + "-->")
+		case xml.ProcInst:
+			indent()
+			pretty.WriteString("<?" + t.Target + " " + string(t.Inst) + "?>")
+		case xml.Directive:
+			indent()
+			pretty.WriteString("<!" + string(t) + ">")
+		}
+	}
+
+	if len(stack) > 0 {
+		return fmt.Errorf("unclosed tag <%s>", stack[len(stack)-1].Name)
+	}
+	if root == nil {
+		return errors.New("XML document has no root element")
+	}
+
+	p.XML = root
+	p.Pretty = pretty.String()
+	return nil
+}
+
+func xmlName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// readParts reads the parts of a multipart body and their contents. Parts
+// read before an error are returned along with it.
+func readParts(boundary string, body []byte) ([]Part, [][]byte, error) {
+	if boundary == "" {
+		return nil, nil, errors.New("multipart body without boundary")
+	}
+
+	var (
+		parts    []Part
+		contents [][]byte
+	)
+	r := multipart.NewReader(bytes.NewReader(body), boundary)
+	for i := 0; ; i++ {
+		mp, err := r.NextPart()
+		if err == io.EOF {
+			return parts, contents, nil
+		}
+		if err != nil {
+			return parts, contents, err
+		}
+
+		data, err := ioutil.ReadAll(mp)
+		if err != nil {
+			return parts, contents, err
+		}
+
+		parts = append(parts, Part{
+			Index:       i,
+			Name:        mp.FormName(),
+			Filename:    mp.FileName(),
+			ContentType: mp.Header.Get("Content-Type"),
+			Header:      http.Header(mp.Header),
+			Size:        len(data),
+		})
+		contents = append(contents, data)
+	}
+}
+
+// PartContent returns the description and contents of the part number i of
+// the multipart body of a message.
+func PartContent(header http.Header, body []byte, i int) (*Part, []byte, error) {
+	decoded, err := Decode(header, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parts, contents, err := readParts(params["boundary"], decoded)
+	if i < 0 || i >= len(parts) {
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrNoPart
+	}
+	return &parts[i], contents[i], nil
+}
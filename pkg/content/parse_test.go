@@ -0,0 +1,172 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package content
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/japanese"
+)
+
+func contentType(value string) http.Header {
+	return http.Header{"Content-Type": {value}}
+}
+
+func TestParseJSON(t *testing.T) {
+	header := contentType("application/json")
+	header.Set("Content-Encoding", "gzip")
+
+	p := Parse(header, compress(t, "gzip", []byte(`{"b":[1,2.50],"a":"x"}`)), Options{})
+	if p.Kind != KindJSON || p.Error != "" {
+		t.Fatalf("unexpected result %#v", p)
+	}
+	if p.Pretty != "{\n  \"b\": [\n    1,\n    2.50\n  ],\n  \"a\": \"x\"\n}" {
+		t.Fatalf("unexpected pretty JSON %q", p.Pretty)
+	}
+	if value := p.JSON.(map[string]interface{})["b"].([]interface{})[1]; value != json.Number("2.50") {
+		t.Fatalf("expecting numbers to be kept as written, got %v", value)
+	}
+
+	// Unspecific types are sniffed.
+	if p := Parse(contentType("text/plain"), []byte(` [true] `), Options{}); p.Kind != KindJSON || p.Pretty == "" {
+		t.Fatalf("expecting JSON, got %#v", p)
+	}
+
+	p = Parse(contentType("application/json"), []byte(`{"a":`), Options{})
+	if p.Kind != KindJSON || p.Error == "" || p.Text != `{"a":` || p.JSON != nil {
+		t.Fatalf("expecting malformed JSON to fall back to text, got %#v", p)
+	}
+}
+
+func TestParseXML(t *testing.T) {
+	doc := `<?xml version="1.0" encoding="Shift_JIS"?><s:Envelope xmlns:s="urn:x"><s:Body id="1">東京<b>a &amp; b</b></s:Body><!-- c --></s:Envelope>`
+
+	p := Parse(contentType("text/xml"), encode(t, japanese.ShiftJIS, doc), Options{})
+	if p.Kind != KindXML || p.Error != "" || p.Charset != "shift_jis" {
+		t.Fatalf("unexpected result %#v", p)
+	}
+
+	root := p.XML
+	if root.Name != "s:Envelope" || len(root.Children) != 1 {
+		t.Fatalf("unexpected root %#v", root)
+	}
+	body := root.Children[0]
+	if body.Name != "s:Body" || body.Text != "東京" || body.Attrs[0] != (Pair{"id", "1"}) || body.Children[0].Text != "a & b" {
+		t.Fatalf("unexpected element %#v", body)
+	}
+
+	expected := `<?xml version="1.0" encoding="Shift_JIS"?>
+<s:Envelope xmlns:s="urn:x">
+  <s:Body id="1">東京
+    <b>a &amp; b</b>
+  </s:Body>
+  <!-- c -->
+</s:Envelope>`
+	if p.Pretty != expected {
+		t.Fatalf("unexpected pretty XML:\n%s", p.Pretty)
+	}
+
+	for _, doc := range []string{`<a><b></a>`, `<a>`, `<a/><b/>`} {
+		p := Parse(contentType("application/xml"), []byte(doc), Options{})
+		if p.Error == "" || p.XML != nil || p.Text != doc {
+			t.Fatalf("%q: expecting malformed XML to fall back to text, got %#v", doc, p)
+		}
+	}
+}
+
+func TestParseForm(t *testing.T) {
+	p := Parse(contentType("application/x-www-form-urlencoded"), []byte("b=2&a=1+2&b=%E6%9D%B1&flag"), Options{})
+	expected := []Pair{{"b", "2"}, {"a", "1 2"}, {"b", "東"}, {"flag", ""}}
+	if p.Kind != KindForm || p.Error != "" || len(p.Form) != len(expected) {
+		t.Fatalf("unexpected result %#v", p)
+	}
+	for i := range expected {
+		if p.Form[i] != expected[i] {
+			t.Fatalf("expecting %v, got %v", expected[i], p.Form[i])
+		}
+	}
+
+	p = Parse(contentType("application/x-www-form-urlencoded"), []byte("a=%zz&b=1"), Options{})
+	if p.Error == "" || len(p.Form) != 2 || p.Form[0].Value != "%zz" || p.Form[1].Value != "1" {
+		t.Fatalf("expecting badly escaped pairs to be kept, got %#v", p)
+	}
+}
+
+func TestParseMultipart(t *testing.T) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	_ = mw.WriteField("name", "hyperfox")
+	fw, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="file"; filename="fox.png"`},
+		"Content-Type":        {"image/png"},
+	})
+	_, _ = fw.Write([]byte{0x89, 'P', 'N', 'G'})
+	_ = mw.Close()
+
+	header := contentType(mw.FormDataContentType())
+	p := Parse(header, buf.Bytes(), Options{})
+	if p.Kind != KindMultipart || p.Error != "" || len(p.Parts) != 2 {
+		t.Fatalf("unexpected result %#v", p)
+	}
+	if part := p.Parts[1]; part.Index != 1 || part.Name != "file" || part.Filename != "fox.png" || part.ContentType != "image/png" || part.Size != 4 {
+		t.Fatalf("unexpected part %#v", part)
+	}
+
+	part, data, err := PartContent(header, buf.Bytes(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.Name != "name" || string(data) != "hyperfox" {
+		t.Fatalf("unexpected part %#v with %q", part, data)
+	}
+	if _, _, err := PartContent(header, buf.Bytes(), 2); err != ErrNoPart {
+		t.Fatalf("expecting ErrNoPart, got %v", err)
+	}
+
+	truncated := buf.Bytes()[:buf.Len()-10]
+	if p := Parse(header, truncated, Options{}); p.Error == "" || len(p.Parts) != 1 {
+		t.Fatalf("expecting the parts before the error, got %#v", p)
+	}
+}
+
+func TestParseOther(t *testing.T) {
+	if p := Parse(nil, nil, Options{}); p.Kind != KindEmpty {
+		t.Fatalf("expecting an empty body, got %#v", p)
+	}
+	if p := Parse(contentType("application/javascript"), []byte("alert(1)"), Options{}); p.Kind != KindText || p.Text != "alert(1)" {
+		t.Fatalf("expecting text, got %#v", p)
+	}
+	if p := Parse(contentType("image/png"), []byte{0x89, 'P', 'N', 'G', 0, 0}, Options{}); p.Kind != KindBinary || p.Text != "" || p.Size != 6 {
+		t.Fatalf("expecting a binary body, got %#v", p)
+	}
+
+	header := http.Header{"Content-Encoding": {"br"}}
+	if p := Parse(header, []byte("not brotli"), Options{}); p.Error == "" || !strings.HasPrefix(p.Error, "br:") {
+		t.Fatalf("expecting a decoding error, got %#v", p)
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package content
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// maxFieldDepth is how deep length-delimited values and groups are looked
+// into for nested messages when decoding without a schema.
+const maxFieldDepth = 16
+
+// Field is a field of a Protobuf message decoded without a schema.
+type Field struct {
+	Number   int32  `json:"number"`
+	WireType string `json:"wire_type"`
+	// Value holds numbers, and length-delimited values that are neither
+	// text nor messages (as base64).
+	Value interface{} `json:"value,omitempty"`
+	// String holds length-delimited values that look like text.
+	String string `json:"string,omitempty"`
+	// Message holds groups and length-delimited values that look like
+	// messages.
+	Message []Field `json:"message,omitempty"`
+}
+
+// Message is a decoded Protobuf message, it's given as JSON when its type is
+// known by the schema and as a list of fields otherwise.
+type Message struct {
+	Type   string          `json:"type,omitempty"`
+	JSON   json.RawMessage `json:"json,omitempty"`
+	Fields []Field         `json:"fields,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// DecodeFields decodes a Protobuf message without its schema, the fields
+// read before an error are returned along with it.
+func DecodeFields(data []byte) ([]Field, error) {
+	return decodeFields(data, 0)
+}
+
+func decodeFields(b []byte, depth int) ([]Field, error) {
+	var fields []Field
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fields, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := Field{Number: int32(num)}
+		switch typ {
+		case protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			f.WireType, f.Value = "varint", v
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.WireType, f.Value = "fixed32", v
+		case protowire.Fixed64Type:
+			var v uint64
+			v, n = protowire.ConsumeFixed64(b)
+			f.WireType, f.Value = "fixed64", v
+		case protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			f.WireType = "bytes"
+			if n >= 0 {
+				f.String, f.Message, f.Value = guessBytes(v, depth)
+			}
+		case protowire.StartGroupType:
+			var v []byte
+			v, n = protowire.ConsumeGroup(num, b)
+			f.WireType = "group"
+			if n >= 0 {
+				if depth >= maxFieldDepth {
+					// Too deep to be decoded, the group is kept as is.
+					f.Value = v
+					break
+				}
+				var err error
+				if f.Message, err = decodeFields(v, depth+1); err != nil {
+					return fields, err
+				}
+			}
+		default:
+			return fields, fmt.Errorf("field %d has invalid wire type %d", num, typ)
+		}
+		if n < 0 {
+			return fields, fmt.Errorf("field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// guessBytes tells whether a length-delimited value is text, a message or
+// just bytes, there's no way to be sure without the schema.
+func guessBytes(v []byte, depth int) (string, []Field, interface{}) {
+	if len(v) == 0 {
+		return "", nil, v
+	}
+	if isPrintable(v) {
+		return string(v), nil, nil
+	}
+	if depth < maxFieldDepth {
+		if fields, err := decodeFields(v, depth+1); err == nil {
+			return "", fields, nil
+		}
+	}
+	return "", nil, v
+}
+
+func isPrintable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if r < ' ' && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// resolver finds Protobuf descriptors and types.
+type resolver interface {
+	FindDescriptorByName(protoreflect.FullName) (protoreflect.Descriptor, error)
+	protoregistry.MessageTypeResolver
+	protoregistry.ExtensionTypeResolver
+}
+
+// descriptorSet resolves the contents of a FileDescriptorSet.
+type descriptorSet struct {
+	*protoregistry.Files
+	*dynamicpb.Types
+}
+
+// Schema holds the Protobuf definitions used to decode messages.
+type Schema struct {
+	resolvers []resolver
+}
+
+// LoadSchema reads .proto files and descriptor sets (as written by protoc
+// --descriptor_set_out --include_imports). Imports of .proto files are
+// looked for in importPaths and in the directories of the files.
+func LoadSchema(files []string, importPaths []string) (*Schema, error) {
+	s := &Schema{}
+
+	var protos []string
+	for _, name := range files {
+		if strings.HasSuffix(name, ".proto") {
+			protos = append(protos, name)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var set descriptorpb.FileDescriptorSet
+		if err := proto.Unmarshal(data, &set); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		reg, err := protodesc.NewFiles(&set)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		s.resolvers = append(s.resolvers, descriptorSet{reg, dynamicpb.NewTypes(reg)})
+	}
+
+	if len(protos) > 0 {
+		// Files are compiled by their path relative to an import path, as
+		// other files import them.
+		paths := append([]string{}, importPaths...)
+		for i, name := range protos {
+			if rel := relativeTo(importPaths, name); rel != "" {
+				protos[i] = rel
+				continue
+			}
+			paths = append(paths, filepath.Dir(name))
+			protos[i] = filepath.Base(name)
+		}
+		compiler := protocompile.Compiler{
+			Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+				ImportPaths: paths,
+			}),
+		}
+		compiled, err := compiler.Compile(context.Background(), protos...)
+		if err != nil {
+			return nil, err
+		}
+		s.resolvers = append(s.resolvers, compiled.AsResolver())
+	}
+
+	return s, nil
+}
+
+// relativeTo returns the path of name relative to the first of dirs that
+// holds it, or "".
+func relativeTo(dirs []string, name string) string {
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(dir, name)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return ""
+}
+
+// FindDescriptorByName looks up a descriptor by its full name.
+func (s *Schema) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	for _, r := range s.resolvers {
+		if d, err := r.FindDescriptorByName(name); err == nil {
+			return d, nil
+		}
+	}
+	return nil, protoregistry.NotFound
+}
+
+// FindMessageByName looks up a message type by its full name.
+func (s *Schema) FindMessageByName(name protoreflect.FullName) (protoreflect.MessageType, error) {
+	for _, r := range s.resolvers {
+		if t, err := r.FindMessageByName(name); err == nil {
+			return t, nil
+		}
+	}
+	return nil, protoregistry.NotFound
+}
+
+// FindMessageByURL looks up a message type by the URL of an Any.
+func (s *Schema) FindMessageByURL(url string) (protoreflect.MessageType, error) {
+	for _, r := range s.resolvers {
+		if t, err := r.FindMessageByURL(url); err == nil {
+			return t, nil
+		}
+	}
+	return nil, protoregistry.NotFound
+}
+
+// FindExtensionByName looks up an extension by its full name.
+func (s *Schema) FindExtensionByName(name protoreflect.FullName) (protoreflect.ExtensionType, error) {
+	for _, r := range s.resolvers {
+		if t, err := r.FindExtensionByName(name); err == nil {
+			return t, nil
+		}
+	}
+	return nil, protoregistry.NotFound
+}
+
+// FindExtensionByNumber looks up an extension of a message by its number.
+func (s *Schema) FindExtensionByNumber(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionType, error) {
+	for _, r := range s.resolvers {
+		if t, err := r.FindExtensionByNumber(message, field); err == nil {
+			return t, nil
+		}
+	}
+	return nil, protoregistry.NotFound
+}
+
+// method returns the descriptor of a method of a gRPC service, or nil if
+// it's unknown.
+func (s *Schema) method(service, name string) protoreflect.MethodDescriptor {
+	if s == nil {
+		return nil
+	}
+	d, err := s.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil
+	}
+	if sd, ok := d.(protoreflect.ServiceDescriptor); ok {
+		return sd.Methods().ByName(protoreflect.Name(name))
+	}
+	return nil
+}
+
+// DecodeMessage decodes a Protobuf message of the given type, it's decoded
+// without a schema when the type is unknown.
+func DecodeMessage(data []byte, typeName string, schema *Schema) *Message {
+	m := &Message{}
+
+	if schema != nil && typeName != "" {
+		d, err := schema.FindDescriptorByName(protoreflect.FullName(typeName))
+		if md, ok := d.(protoreflect.MessageDescriptor); ok && err == nil {
+			msg := dynamicpb.NewMessage(md)
+			err := proto.UnmarshalOptions{Resolver: schema}.Unmarshal(data, msg)
+			if err == nil {
+				m.JSON, err = protojson.MarshalOptions{Resolver: schema}.Marshal(msg)
+			}
+			if err == nil {
+				m.Type = typeName
+				return m
+			}
+			m.Error = fmt.Sprintf("%s: %v", typeName, err)
+		} else {
+			m.Error = fmt.Sprintf("unknown message type %q", typeName)
+		}
+	}
+
+	fields, err := DecodeFields(data)
+	m.Fields = fields
+	if err != nil && m.Error == "" {
+		m.Error = err.Error()
+	}
+	return m
+}
@@ -0,0 +1,283 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package content
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const foxProto = `syntax = "proto3";
+
+package fox;
+
+import "google/protobuf/timestamp.proto";
+
+message FindRequest {
+  string name = 1;
+  int32 limit = 2;
+}
+
+message FindResponse {
+  repeated string tags = 1;
+  google.protobuf.Timestamp seen = 2;
+}
+
+service Foxes {
+  rpc Find(FindRequest) returns (FindResponse);
+}
+`
+
+// findRequest encodes fox.FindRequest{name: "red", limit: 3}.
+func findRequest() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, "red")
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, 3)
+	return b
+}
+
+func grpcFrame(flags byte, data []byte) []byte {
+	frame := []byte{flags, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+func loadFoxSchema(t *testing.T) (*Schema, string) {
+	dir, err := ioutil.TempDir("", "hyperfox-proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "fox.proto")
+	if err := ioutil.WriteFile(name, []byte(foxProto), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	schema, err := LoadSchema([]string{name}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schema, dir
+}
+
+func TestDecodeFields(t *testing.T) {
+	var nested []byte
+	nested = protowire.AppendTag(nested, 1, protowire.VarintType)
+	nested = protowire.AppendVarint(nested, 7)
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, 150)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, "hello")
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendBytes(b, nested)
+	b = protowire.AppendTag(b, 4, protowire.Fixed32Type)
+	b = protowire.AppendFixed32(b, 42)
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	b = protowire.AppendBytes(b, []byte{0xff, 0x00})
+
+	fields, err := DecodeFields(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(fields)
+	expected := `[{"number":1,"wire_type":"varint","value":150},` +
+		`{"number":2,"wire_type":"bytes","string":"hello"},` +
+		`{"number":3,"wire_type":"bytes","message":[{"number":1,"wire_type":"varint","value":7}]},` +
+		`{"number":4,"wire_type":"fixed32","value":42},` +
+		`{"number":5,"wire_type":"bytes","value":"/wA="}]`
+	if string(data) != expected {
+		t.Fatalf("unexpected fields %s", data)
+	}
+
+	fields, err = DecodeFields(b[:len(b)-1])
+	if err == nil || len(fields) != 4 {
+		t.Fatalf("expecting the fields before the error, got %d (%v)", len(fields), err)
+	}
+
+	// Groups are looked into up to maxFieldDepth and kept as bytes below.
+	group := nested
+	for i := 0; i < 100; i++ {
+		g := protowire.AppendTag(nil, 1, protowire.StartGroupType)
+		g = append(g, group...)
+		group = protowire.AppendTag(g, 1, protowire.EndGroupType)
+	}
+	fields, err = DecodeFields(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for depth := 0; ; depth++ {
+		if len(fields) != 1 || fields[0].WireType != "group" {
+			t.Fatalf("unexpected fields at depth %d: %#v", depth, fields)
+		}
+		if fields[0].Message == nil {
+			if depth != maxFieldDepth {
+				t.Fatalf("expecting groups to be decoded up to depth %d, got %d", maxFieldDepth, depth)
+			}
+			if _, ok := fields[0].Value.([]byte); !ok {
+				t.Fatalf("expecting raw bytes, got %#v", fields[0].Value)
+			}
+			break
+		}
+		fields = fields[0].Message
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	schema, dir := loadFoxSchema(t)
+	defer os.RemoveAll(dir)
+
+	m := DecodeMessage(findRequest(), "fox.FindRequest", schema)
+	if m.Error != "" || m.Type != "fox.FindRequest" || m.Fields != nil {
+		t.Fatalf("unexpected message %#v", m)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(m.JSON, &v); err != nil || v["name"] != "red" || v["limit"] != 3.0 {
+		t.Fatalf("unexpected JSON %s (%v)", m.JSON, err)
+	}
+
+	// Unknown types are decoded without a schema.
+	m = DecodeMessage(findRequest(), "fox.Unknown", schema)
+	if m.Error == "" || len(m.Fields) != 2 || m.Fields[0].String != "red" {
+		t.Fatalf("unexpected message %#v", m)
+	}
+
+	// Descriptor sets work as well as .proto files.
+	d, _ := schema.FindDescriptorByName("fox.FindRequest")
+	file := d.(protoreflect.MessageDescriptor).ParentFile()
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(file.Imports().Get(0).FileDescriptor),
+		protodesc.ToFileDescriptorProto(file),
+	}}
+	data, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "fox.protoset")
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fromSet, err := LoadSchema([]string{name}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := DecodeMessage(findRequest(), "fox.FindRequest", fromSet); m.Error != "" || m.JSON == nil {
+		t.Fatalf("unexpected message %#v", m)
+	}
+}
+
+func TestParseGRPC(t *testing.T) {
+	schema, dir := loadFoxSchema(t)
+	defer os.RemoveAll(dir)
+
+	header := http.Header{
+		"Content-Type":  {"application/grpc"},
+		"Grpc-Encoding": {"gzip"},
+	}
+	body := append(grpcFrame(0, findRequest()), grpcFrame(1, compress(t, "gzip", findRequest()))...)
+
+	p := Parse(header, body, Options{Path: "/fox.Foxes/Find", Request: true, Schema: schema})
+	g := p.GRPC
+	if p.Kind != KindGRPC || g == nil || g.Error != "" {
+		t.Fatalf("unexpected result %#v", p)
+	}
+	if g.Service != "fox.Foxes" || g.Method != "Find" || g.Type != "fox.FindRequest" || len(g.Messages) != 2 {
+		t.Fatalf("unexpected call %#v", g)
+	}
+	if m := g.Messages[1]; !m.Compressed || m.Message == nil || m.Message.Type != "fox.FindRequest" {
+		t.Fatalf("unexpected compressed message %#v", m)
+	}
+	if g.Status != nil {
+		t.Fatalf("expecting no status in requests, got %#v", g.Status)
+	}
+
+	// Responses get the status from the trailers.
+	trailer := http.Header{"Grpc-Status": {"5"}, "Grpc-Message": {"no%20such%20fox"}}
+	p = Parse(http.Header{"Content-Type": {"application/grpc+proto"}}, nil, Options{Trailer: trailer})
+	if s := p.GRPC.Status; s == nil || s.Code != 5 || s.Name != "NOT_FOUND" || s.Message != "no such fox" {
+		t.Fatalf("unexpected status %#v", p.GRPC.Status)
+	}
+
+	p = Parse(http.Header{"Content-Type": {"application/grpc"}}, grpcFrame(0, findRequest())[:6], Options{})
+	if p.GRPC.Error == "" || len(p.GRPC.Messages) != 0 {
+		t.Fatalf("expecting truncated messages to be reported, got %#v", p.GRPC)
+	}
+}
+
+func TestParseGRPCWeb(t *testing.T) {
+	body := append(grpcFrame(0, findRequest()), grpcFrame(0x80, []byte("grpc-status: 0\r\ngrpc-message: ok\r\n"))...)
+
+	p := Parse(http.Header{"Content-Type": {"application/grpc-web+proto"}}, body, Options{})
+	if g := p.GRPC; len(g.Messages) != 1 || g.Status == nil || g.Status.Name != "OK" || g.Status.Message != "ok" {
+		t.Fatalf("unexpected call %#v", g)
+	}
+
+	// Frames after the trailer are read as sent and the body is left as is.
+	body = append(grpcFrame(0x80, []byte("grpc-status: 0\r\n")), grpcFrame(0, findRequest())...)
+	sent := append([]byte(nil), body...)
+	p = Parse(http.Header{"Content-Type": {"application/grpc-web+proto"}}, body, Options{})
+	if g := p.GRPC; g.Error != "" || len(g.Messages) != 1 || g.Status == nil || g.Status.Name != "OK" {
+		t.Fatalf("unexpected call %#v", g)
+	}
+	if !bytes.Equal(body, sent) {
+		t.Fatalf("body was modified: %q", body)
+	}
+
+	// Messages of text bodies may be encoded one by one.
+	text := base64.StdEncoding.EncodeToString(grpcFrame(0, findRequest())) +
+		base64.StdEncoding.EncodeToString(grpcFrame(0, []byte{0x08, 0x01}))
+	p = Parse(http.Header{"Content-Type": {"application/grpc-web-text"}}, []byte(text), Options{Request: true})
+	if g := p.GRPC; g.Error != "" || len(g.Messages) != 2 || g.Messages[1].Message.Fields[0].Value != uint64(1) {
+		t.Fatalf("unexpected call %#v", g)
+	}
+}
+
+func TestParseProtobuf(t *testing.T) {
+	schema, dir := loadFoxSchema(t)
+	defer os.RemoveAll(dir)
+
+	header := http.Header{"Content-Type": {"application/x-protobuf; proto=fox.FindRequest"}}
+	p := Parse(header, findRequest(), Options{Schema: schema})
+	if p.Kind != KindProtobuf || p.Protobuf == nil || p.Protobuf.Type != "fox.FindRequest" {
+		t.Fatalf("unexpected result %#v", p)
+	}
+
+	p = Parse(header, findRequest(), Options{})
+	if p.Protobuf == nil || len(p.Protobuf.Fields) != 2 {
+		t.Fatalf("expecting the message to be decoded without a schema, got %#v", p.Protobuf)
+	}
+}
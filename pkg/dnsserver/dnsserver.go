@@ -0,0 +1,354 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Package dnsserver provides a DNS server that answers chosen names with the
+// address of the proxy and forwards any other query to an upstream resolver.
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/resolver"
+	"github.com/miekg/dns"
+)
+
+const (
+	// answerTTL is the TTL of intercepted answers, kept short so devices go
+	// back to the real addresses soon after the server stops.
+	answerTTL = 60
+	// forwardTimeout limits how long to wait for the upstream resolver.
+	forwardTimeout = time.Second * 5
+)
+
+// Query is a DNS query answered by the server.
+type Query struct {
+	ID          int64     `json:"id" db:"id,omitempty"`
+	Time        time.Time `json:"time" db:"time"`
+	Client      string    `json:"client" db:"client"`
+	Proto       string    `json:"proto" db:"proto"`
+	Name        string    `json:"name" db:"name"`
+	Type        string    `json:"type" db:"type"`
+	Rcode       string    `json:"rcode" db:"rcode"`
+	Answer      string    `json:"answer" db:"answer"`
+	Intercepted bool      `json:"intercepted" db:"intercepted"`
+	Error       string    `json:"error,omitempty" db:"error"`
+	TimeTaken   int64     `json:"time_taken" db:"time_taken"`
+}
+
+// QueryLogger is notified of every query the server answers.
+type QueryLogger interface {
+	LogQuery(*Query) error
+}
+
+// Server is a DNS server that steers the targeted names to the proxy.
+type Server struct {
+	upstream resolver.Exchanger
+
+	mu      sync.RWMutex
+	targets map[string]struct{}
+	ipv4    net.IP
+	ipv6    net.IP
+
+	loggers []QueryLogger
+
+	srvMu   sync.Mutex
+	servers []*dns.Server
+}
+
+// New creates a Server that forwards the queries it does not intercept to
+// upstream.
+func New(upstream resolver.Exchanger) *Server {
+	return &Server{
+		upstream: upstream,
+		targets:  map[string]struct{}{},
+	}
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+// AddTarget intercepts names matching pattern. A pattern may be an exact
+// name or a wildcard like "*.example.org" (matching any subdomain).
+func (s *Server) AddTarget(pattern string) error {
+	pattern = normalizeName(pattern)
+
+	name := strings.TrimPrefix(pattern, "*.")
+	if name == "" || strings.ContainsAny(name, "*:/ ") {
+		return errors.New("invalid name pattern")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.targets[pattern] = struct{}{}
+	return nil
+}
+
+// RemoveTarget stops intercepting names matching pattern.
+func (s *Server) RemoveTarget(pattern string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.targets, normalizeName(pattern))
+}
+
+// Targets returns the patterns of intercepted names.
+func (s *Server) Targets() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	targets := make([]string, 0, len(s.targets))
+	for pattern := range s.targets {
+		targets = append(targets, pattern)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// SetAddress sets the addresses given in intercepted answers, at most one
+// IPv4 and one IPv6 address are used.
+func (s *Server) SetAddress(ips ...net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ipv4, s.ipv6 = nil, nil
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if s.ipv4 == nil {
+				s.ipv4 = ip4
+			}
+			continue
+		}
+		if s.ipv6 == nil && ip.To16() != nil {
+			s.ipv6 = ip
+		}
+	}
+}
+
+// AddQueryLogger adds a QueryLogger to the server.
+func (s *Server) AddQueryLogger(l QueryLogger) {
+	s.loggers = append(s.loggers, l)
+}
+
+func (s *Server) intercepted(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name = normalizeName(name)
+	if _, ok := s.targets[name]; ok {
+		return true
+	}
+	for {
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+		if _, ok := s.targets["*."+name]; ok {
+			return true
+		}
+	}
+}
+
+// intercept answers req with the proxy's address. Queries for other types
+// get an empty answer, so clients can't learn real addresses from records
+// like HTTPS or SVCB.
+func (s *Server) intercept(req *dns.Msg) *dns.Msg {
+	s.mu.RLock()
+	ipv4, ipv6 := s.ipv4, s.ipv6
+	s.mu.RUnlock()
+
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Authoritative = true
+	res.RecursionAvailable = true
+
+	q := req.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: answerTTL}
+
+	switch {
+	case q.Qtype == dns.TypeA && ipv4 != nil:
+		hdr.Rrtype = dns.TypeA
+		res.Answer = append(res.Answer, &dns.A{Hdr: hdr, A: ipv4})
+	case q.Qtype == dns.TypeAAAA && ipv6 != nil:
+		hdr.Rrtype = dns.TypeAAAA
+		res.Answer = append(res.Answer, &dns.AAAA{Hdr: hdr, AAAA: ipv6})
+	}
+
+	return res
+}
+
+func (s *Server) forward(req *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	defer cancel()
+
+	res, err := s.upstream.Exchange(ctx, req.Copy())
+	if err != nil {
+		return nil, err
+	}
+	res.Id = req.Id
+	return res, nil
+}
+
+// ServeDNS implements dns.Handler.
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	start := time.Now()
+
+	query := &Query{
+		Time:   start,
+		Client: w.RemoteAddr().String(),
+		Proto:  w.RemoteAddr().Network(),
+	}
+
+	var res *dns.Msg
+	if len(req.Question) != 1 {
+		res = &dns.Msg{}
+		res.SetRcode(req, dns.RcodeFormatError)
+	} else {
+		q := req.Question[0]
+		query.Name = normalizeName(q.Name)
+		query.Type = dns.TypeToString[q.Qtype]
+
+		if s.intercepted(q.Name) {
+			query.Intercepted = true
+			res = s.intercept(req)
+		} else {
+			var err error
+			if res, err = s.forward(req); err != nil {
+				query.Error = err.Error()
+				res = &dns.Msg{}
+				res.SetRcode(req, dns.RcodeServerFailure)
+			}
+		}
+	}
+
+	answers := make([]string, 0, len(res.Answer))
+	for _, rr := range res.Answer {
+		value := strings.TrimPrefix(rr.String(), rr.Header().String())
+		answers = append(answers, dns.TypeToString[rr.Header().Rrtype]+" "+value)
+	}
+	query.Answer = strings.Join(answers, ", ")
+	query.Rcode = dns.RcodeToString[res.Rcode]
+
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		res.Truncate(size)
+	}
+
+	if err := w.WriteMsg(res); err != nil && query.Error == "" {
+		query.Error = err.Error()
+	}
+
+	query.TimeTaken = time.Now().UnixNano() - start.UnixNano()
+
+	for _, l := range s.loggers {
+		_ = l.LogQuery(query)
+	}
+}
+
+// Serve answers queries arriving on pc (UDP) and ln (TCP), any of them may be
+// nil. It blocks until the server is closed or fails.
+func (s *Server) Serve(pc net.PacketConn, ln net.Listener) error {
+	var servers []*dns.Server
+	if pc != nil {
+		servers = append(servers, &dns.Server{PacketConn: pc, Handler: s})
+	}
+	if ln != nil {
+		servers = append(servers, &dns.Server{Listener: ln, Handler: s})
+	}
+	if len(servers) == 0 {
+		return errors.New("nothing to serve")
+	}
+
+	started := make(chan struct{}, len(servers))
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		srv.NotifyStartedFunc = func() { started <- struct{}{} }
+		go func(srv *dns.Server) {
+			errs <- srv.ActivateAndServe()
+		}(srv)
+	}
+
+	// Wait for all servers to start, so Close can shut them down.
+	for range servers {
+		select {
+		case <-started:
+		case err := <-errs:
+			for _, srv := range servers {
+				_ = srv.Shutdown()
+			}
+			return err
+		}
+	}
+
+	s.srvMu.Lock()
+	s.servers = append(s.servers, servers...)
+	s.srvMu.Unlock()
+
+	err := <-errs
+	for _, srv := range servers {
+		_ = srv.Shutdown()
+	}
+	return err
+}
+
+// ListenAndServe answers queries over UDP and TCP on addr.
+func (s *Server) ListenAndServe(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	// Bind TCP to the same port, even when addr asked for any port.
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	return s.Serve(pc, ln)
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	s.srvMu.Lock()
+	defer s.srvMu.Unlock()
+
+	for _, srv := range s.servers {
+		_ = srv.Shutdown()
+	}
+	s.servers = nil
+	return nil
+}
@@ -0,0 +1,164 @@
+package dnsserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type fakeUpstream struct{}
+
+func (fakeUpstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	q := req.Question[0]
+	if q.Name == "broken.test." {
+		return nil, errors.New("upstream is down")
+	}
+
+	res := &dns.Msg{}
+	res.SetReply(req)
+	if q.Qtype == dns.TypeA {
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+	}
+	return res, nil
+}
+
+type queryLog struct {
+	mu      sync.Mutex
+	queries []*Query
+}
+
+func (l *queryLog) LogQuery(q *Query) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.queries = append(l.queries, q)
+	return nil
+}
+
+func startServer(t *testing.T, s *Server) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() { _ = s.Serve(pc, ln) }()
+
+	// Wait for both listeners.
+	for _, network := range []string{"udp", "tcp"} {
+		c := &dns.Client{Net: network}
+		msg := &dns.Msg{}
+		msg.SetQuestion("ready.test.", dns.TypeA)
+		for i := 0; ; i++ {
+			if _, _, err := c.Exchange(msg, pc.LocalAddr().String()); err == nil {
+				break
+			} else if i > 100 {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return pc.LocalAddr().String()
+}
+
+func exchange(t *testing.T, network, addr, name string, qtype uint16) *dns.Msg {
+	msg := &dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+
+	c := &dns.Client{Net: network}
+	res, _, err := c.Exchange(msg, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestServer(t *testing.T) {
+	s := New(fakeUpstream{})
+
+	l := &queryLog{}
+	s.AddQueryLogger(l)
+
+	addr := startServer(t, s)
+	defer s.Close()
+
+	s.SetAddress(net.ParseIP("10.0.0.7"))
+	if err := s.AddTarget("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddTarget("*.Example.org."); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddTarget("*"); err == nil {
+		t.Fatal("expecting invalid pattern error")
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		for _, name := range []string{"example.com", "api.example.org", "a.b.EXAMPLE.org"} {
+			res := exchange(t, network, addr, name, dns.TypeA)
+			if len(res.Answer) != 1 || !res.Answer[0].(*dns.A).A.Equal(net.IPv4(10, 0, 0, 7)) {
+				t.Fatalf("%s: expecting proxy address, got %v", name, res.Answer)
+			}
+		}
+
+		// No IPv6 address was set.
+		res := exchange(t, network, addr, "example.com", dns.TypeAAAA)
+		if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 0 {
+			t.Fatalf("expecting empty answer, got %v", res)
+		}
+
+		for _, name := range []string{"example.org", "www.example.com"} {
+			res := exchange(t, network, addr, name, dns.TypeA)
+			if len(res.Answer) != 1 || !res.Answer[0].(*dns.A).A.Equal(net.IPv4(192, 0, 2, 1)) {
+				t.Fatalf("%s: expecting upstream address, got %v", name, res.Answer)
+			}
+		}
+
+		res = exchange(t, network, addr, "broken.test", dns.TypeA)
+		if res.Rcode != dns.RcodeServerFailure {
+			t.Fatalf("expecting SERVFAIL, got %s", dns.RcodeToString[res.Rcode])
+		}
+	}
+
+	s.SetAddress(net.ParseIP("10.0.0.7"), net.ParseIP("fd00::7"))
+	res := exchange(t, "udp", addr, "example.com", dns.TypeAAAA)
+	if len(res.Answer) != 1 || !res.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("fd00::7")) {
+		t.Fatalf("expecting proxy address, got %v", res.Answer)
+	}
+
+	s.RemoveTarget("example.com")
+	if targets := s.Targets(); len(targets) != 1 || targets[0] != "*.example.org" {
+		t.Fatalf("unexpected targets %v", targets)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Skip the queries sent while waiting for the server.
+	for len(l.queries) > 0 && l.queries[0].Name == "ready.test" {
+		l.queries = l.queries[1:]
+	}
+
+	if len(l.queries) != 15 {
+		t.Fatalf("expecting 15 logged queries, got %d", len(l.queries))
+	}
+
+	q := l.queries[0]
+	if q.Name != "example.com" || q.Type != "A" || !q.Intercepted || q.Answer != "A 10.0.0.7" || q.Proto != "udp" {
+		t.Fatalf("unexpected query %#v", q)
+	}
+	q = l.queries[6]
+	if q.Name != "broken.test" || q.Rcode != "SERVFAIL" || q.Error == "" || q.Intercepted {
+		t.Fatalf("unexpected query %#v", q)
+	}
+}
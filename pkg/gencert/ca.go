@@ -0,0 +1,172 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gencert
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"time"
+)
+
+const defaultCAValidity = time.Hour * 24 * 365 * 5
+
+var (
+	allIPv4 = &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+	allIPv6 = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+)
+
+// CAOptions defines the properties of a CA certificate created by CreateCA.
+type CAOptions struct {
+	// CommonName of the CA.
+	CommonName string
+	// ValidFor defines how long the CA is valid, defaults to five years.
+	ValidFor time.Duration
+
+	// PermittedDNSDomains and ExcludedDNSDomains restrict the names the CA is
+	// allowed to sign certificates for. A domain matches itself and all its
+	// subdomains, a domain starting with "." matches subdomains only.
+	PermittedDNSDomains []string
+	ExcludedDNSDomains  []string
+	// PermittedIPRanges and ExcludedIPRanges restrict the IP addresses the CA
+	// is allowed to sign certificates for. A CA restricted to domains only
+	// can't sign any IP address.
+	PermittedIPRanges []*net.IPNet
+	ExcludedIPRanges  []*net.IPNet
+
+	// ParentCert and ParentKey are the paths to the CA that signs the new
+	// certificate. If empty, a self-signed root CA is created.
+	ParentCert string
+	ParentKey  string
+}
+
+// CreateCA creates a root or intermediate CA certificate and writes it to
+// certFile and its key to keyFile. When creating an intermediate, certFile
+// holds the complete chain (except for the root) so it can be used with
+// SetRootCACert directly.
+func CreateCA(certFile, keyFile string, opts CAOptions) error {
+	if opts.CommonName == "" {
+		return errors.New("missing common name")
+	}
+
+	validFor := opts.ValidFor
+	if validFor == 0 {
+		validFor = defaultCAValidity
+	}
+
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+
+	priv, err := rsa.GenerateKey(rand.Reader, rsaBits)
+	if err != nil {
+		return err
+	}
+
+	notBefore := time.Now().Add(-time.Hour)
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"Hyperfox"},
+			CommonName:   opts.CommonName,
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validFor),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          bigIntHash(priv.N),
+
+		PermittedDNSDomains: opts.PermittedDNSDomains,
+		ExcludedDNSDomains:  opts.ExcludedDNSDomains,
+		PermittedIPRanges:   opts.PermittedIPRanges,
+		ExcludedIPRanges:    opts.ExcludedIPRanges,
+	}
+
+	parent := template
+	var signer interface{} = priv
+	var chain [][]byte
+
+	if opts.ParentCert != "" || opts.ParentKey != "" {
+		ca, err := tls.LoadX509KeyPair(opts.ParentCert, opts.ParentKey)
+		if err != nil {
+			return err
+		}
+		if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+			return err
+		}
+		if !ca.Leaf.IsCA {
+			return errors.New("parent certificate is not a CA")
+		}
+		if template.NotAfter.After(ca.Leaf.NotAfter) {
+			template.NotAfter = ca.Leaf.NotAfter
+		}
+		template.AuthorityKeyId = ca.Leaf.SubjectKeyId
+
+		// Inherit the parent's constraints, so this CA refuses to forge
+		// certificates the parent would not allow.
+		if len(template.PermittedDNSDomains) == 0 {
+			template.PermittedDNSDomains = ca.Leaf.PermittedDNSDomains
+		}
+		if len(template.ExcludedDNSDomains) == 0 {
+			template.ExcludedDNSDomains = ca.Leaf.ExcludedDNSDomains
+		}
+		if len(template.PermittedIPRanges) == 0 {
+			template.PermittedIPRanges = ca.Leaf.PermittedIPRanges
+		}
+		if len(template.ExcludedIPRanges) == 0 {
+			template.ExcludedIPRanges = ca.Leaf.ExcludedIPRanges
+		}
+
+		if chain, err = caChain(&ca); err != nil {
+			return err
+		}
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+
+	if len(template.PermittedDNSDomains) > 0 && len(template.PermittedIPRanges) == 0 {
+		// Without permitted ranges any IP address would be allowed.
+		template.ExcludedIPRanges = append(template.ExcludedIPRanges, allIPv4, allIPv6)
+	}
+
+	template.PermittedDNSDomainsCritical = len(template.PermittedDNSDomains) > 0 ||
+		len(template.ExcludedDNSDomains) > 0 ||
+		len(template.PermittedIPRanges) > 0 ||
+		len(template.ExcludedIPRanges) > 0
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &priv.PublicKey, signer)
+	if err != nil {
+		return err
+	}
+
+	if err := writeCertificates(certFile, append([][]byte{der}, chain...)); err != nil {
+		return err
+	}
+
+	return writeKey(keyFile, priv)
+}
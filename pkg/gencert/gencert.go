@@ -23,6 +23,7 @@
 package gencert
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
@@ -30,6 +31,8 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/big"
 	"net"
 	"os"
@@ -53,8 +56,25 @@ var (
 
 var (
 	mu sync.Mutex
+	// loadedCA is the CA that was loaded last, it's loaded again when its
+	// files change.
+	loadedCA *signingCA
 )
 
+// signingCA is a CA loaded from disk, along with what's derived from it.
+type signingCA struct {
+	*tls.Certificate
+	// certs are the parsed certificates of the CA file, the first one signs.
+	certs []*x509.Certificate
+	// chain is sent along with the certificates signed by the CA.
+	chain [][]byte
+	// id tells CAs apart in the certificate directory.
+	id string
+
+	certFile, keyFile string
+	certMod, keyMod   time.Time
+}
+
 // SetRootCACert sets the root CA cert.
 func SetRootCACert(s string) {
 	rootCACert = s
@@ -71,6 +91,139 @@ func bigIntHash(n *big.Int) []byte {
 	return h.Sum(nil)
 }
 
+// loadCA loads the CA certificate and key used for signing, unless they
+// were loaded already and haven't changed since. The CA certificate file may
+// hold a chain, in which case the first certificate is the one used for
+// signing.
+func loadCA() (*signingCA, error) {
+	certInfo, err := os.Stat(rootCACert)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo, err := os.Stat(rootCAKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if ca := loadedCA; ca != nil &&
+		ca.certFile == rootCACert && ca.certMod.Equal(certInfo.ModTime()) &&
+		ca.keyFile == rootCAKey && ca.keyMod.Equal(keyInfo.ModTime()) {
+		return ca, nil
+	}
+
+	pair, err := tls.LoadX509KeyPair(rootCACert, rootCAKey)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := make([]*x509.Certificate, 0, len(pair.Certificate))
+	for _, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	pair.Leaf = certs[0]
+
+	chain, err := caChain(&pair)
+	if err != nil {
+		return nil, err
+	}
+
+	loadedCA = &signingCA{
+		Certificate: &pair,
+		certs:       certs,
+		chain:       chain,
+		id:          fmt.Sprintf("%x", sha1.Sum(pair.Leaf.Raw))[:16],
+		certFile:    rootCACert,
+		keyFile:     rootCAKey,
+		certMod:     certInfo.ModTime(),
+		keyMod:      keyInfo.ModTime(),
+	}
+	return loadedCA, nil
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// caChain returns the certificates that must be sent along with a leaf
+// signed by the given CA. Self-signed roots are left out.
+func caChain(ca *tls.Certificate) ([][]byte, error) {
+	chain := make([][]byte, 0, len(ca.Certificate))
+	for _, der := range ca.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		if isSelfSigned(cert) {
+			continue
+		}
+		chain = append(chain, der)
+	}
+	return chain, nil
+}
+
+func matchDomainConstraint(name, constraint string) bool {
+	constraint = strings.ToLower(constraint)
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(name, constraint)
+	}
+	return name == constraint || strings.HasSuffix(name, "."+constraint)
+}
+
+func matchIPConstraint(ip net.IP, ranges []*net.IPNet) bool {
+	for _, r := range ranges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// permits reports whether the name constraints of the given CA certificate
+// allow issuing a certificate for name.
+func permits(cert *x509.Certificate, name string) bool {
+	if ip := net.ParseIP(name); ip != nil {
+		if matchIPConstraint(ip, cert.ExcludedIPRanges) {
+			return false
+		}
+		if len(cert.PermittedIPRanges) == 0 {
+			// A CA restricted to domains is not meant to sign IP addresses,
+			// even if it doesn't exclude them.
+			return len(cert.PermittedDNSDomains) == 0
+		}
+		return matchIPConstraint(ip, cert.PermittedIPRanges)
+	}
+
+	for _, constraint := range cert.ExcludedDNSDomains {
+		if matchDomainConstraint(name, constraint) {
+			return false
+		}
+	}
+	if len(cert.PermittedDNSDomains) == 0 {
+		return true
+	}
+	for _, constraint := range cert.PermittedDNSDomains {
+		if matchDomainConstraint(name, constraint) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNameConstraints returns an error if any certificate of the CA chain
+// does not allow issuing a certificate for name.
+func checkNameConstraints(certs []*x509.Certificate, name string) error {
+	for _, cert := range certs {
+		if !permits(cert, name) {
+			return fmt.Errorf("%q is not allowed by the name constraints of %q", name, cert.Subject.CommonName)
+		}
+	}
+	return nil
+}
+
 // CreateKeyPair creates a key pair for the given hostname on the fly.
 func CreateKeyPair(commonName string) (certFile string, keyFile string, err error) {
 	mu.Lock()
@@ -81,8 +234,22 @@ func CreateKeyPair(commonName string) (certFile string, keyFile string, err erro
 		return "", "", err
 	}
 	commonName = strings.ToLower(commonName)
+	if commonName == "" {
+		return "", "", errors.New("missing common name")
+	}
+
+	ca, err := loadCA()
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := checkNameConstraints(ca.certs, commonName); err != nil {
+		return "", "", err
+	}
 
-	destDir := certDirectory + pathSeparator + commonName + pathSeparator
+	// Certificates are kept apart by CA, so switching CAs doesn't serve stale
+	// certificates.
+	destDir := certDirectory + pathSeparator + ca.id + pathSeparator + commonName + pathSeparator
 
 	certFile = destDir + "cert.pem"
 	keyFile = destDir + "key.pem"
@@ -96,9 +263,11 @@ func CreateKeyPair(commonName string) (certFile string, keyFile string, err erro
 	lastWeek := time.Now().AddDate(0, 0, -7)
 	notBefore := lastWeek
 	notAfter := lastWeek.AddDate(2, 0, 0)
+	if notAfter.After(ca.Leaf.NotAfter) {
+		notAfter = ca.Leaf.NotAfter
+	}
 
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	serialNumber, err := newSerialNumber()
 	if err != nil {
 		return "", "", err
 	}
@@ -124,16 +293,7 @@ func CreateKeyPair(commonName string) (certFile string, keyFile string, err erro
 		template.DNSNames = append(template.DNSNames, commonName)
 	}
 
-	rootCA, err := tls.LoadX509KeyPair(rootCACert, rootCAKey)
-	if err != nil {
-		return "", "", err
-	}
-
-	if rootCA.Leaf, err = x509.ParseCertificate(rootCA.Certificate[0]); err != nil {
-		return "", "", err
-	}
-
-	template.AuthorityKeyId = rootCA.Leaf.SubjectKeyId
+	template.AuthorityKeyId = ca.Leaf.SubjectKeyId
 
 	var priv *rsa.PrivateKey
 	if priv, err = rsa.GenerateKey(rand.Reader, rsaBits); err != nil {
@@ -142,7 +302,7 @@ func CreateKeyPair(commonName string) (certFile string, keyFile string, err erro
 	template.SubjectKeyId = bigIntHash(priv.N)
 
 	var derBytes []byte
-	if derBytes, err = x509.CreateCertificate(rand.Reader, &template, rootCA.Leaf, &priv.PublicKey, rootCA.PrivateKey); err != nil {
+	if derBytes, err = x509.CreateCertificate(rand.Reader, &template, ca.Leaf, &priv.PublicKey, ca.PrivateKey); err != nil {
 		return "", "", err
 	}
 
@@ -150,25 +310,44 @@ func CreateKeyPair(commonName string) (certFile string, keyFile string, err erro
 		return "", "", err
 	}
 
-	certOut, err := os.Create(certFile)
-	if err != nil {
+	if err := writeCertificates(certFile, append([][]byte{derBytes}, ca.chain...)); err != nil {
 		return "", "", err
 	}
-	defer certOut.Close()
 
-	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
+	if err := writeKey(keyFile, priv); err != nil {
 		return "", "", err
 	}
 
-	keyOut, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	return certFile, keyFile, nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, serialNumberLimit)
+}
+
+func writeCertificates(file string, certs [][]byte) error {
+	certOut, err := os.Create(file)
 	if err != nil {
-		return "", "", err
+		return err
 	}
-	defer keyOut.Close()
+	defer certOut.Close()
 
-	if err := pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}); err != nil {
-		return "", "", err
+	for _, der := range certs {
+		if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return err
+		}
 	}
 
-	return certFile, keyFile, nil
+	return nil
+}
+
+func writeKey(file string, priv *rsa.PrivateKey) error {
+	keyOut, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer keyOut.Close()
+
+	return pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
 }
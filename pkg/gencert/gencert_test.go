@@ -1,8 +1,15 @@
 package gencert
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestCreateKeyPair(t *testing.T) {
@@ -18,3 +25,189 @@ func TestCreateKeyPair(t *testing.T) {
 	}
 	fmt.Printf("crt: %s, key: %s\n", crt, key)
 }
+
+func TestNameConstrainedIntermediate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gencert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootCert, rootKey := filepath.Join(dir, "root.crt"), filepath.Join(dir, "root.key")
+	err = CreateCA(rootCert, rootKey, CAOptions{
+		CommonName:          "Test Root",
+		PermittedDNSDomains: []string{"example.org"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	interCert, interKey := filepath.Join(dir, "inter.crt"), filepath.Join(dir, "inter.key")
+	err = CreateCA(interCert, interKey, CAOptions{
+		CommonName: "Test Intermediate",
+		ParentCert: rootCert,
+		ParentKey:  rootKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer SetRootCACert(rootCACert)
+	defer SetRootCAKey(rootCAKey)
+
+	SetRootCACert(interCert)
+	SetRootCAKey(interKey)
+
+	crt, key, err := CreateKeyPair("www.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair, err := tls.LoadX509KeyPair(crt, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pair.Certificate) != 2 {
+		t.Fatalf("expecting leaf and intermediate, got %d certificates", len(pair.Certificate))
+	}
+
+	roots := x509.NewCertPool()
+	rootPEM, err := ioutil.ReadFile(rootCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots.AppendCertsFromPEM(rootPEM)
+
+	leaf, _ := x509.ParseCertificate(pair.Certificate[0])
+	inter, _ := x509.ParseCertificate(pair.Certificate[1])
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(inter)
+
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       "www.example.org",
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := CreateKeyPair("www.example.com"); err == nil {
+		t.Fatal("expecting name constraints error")
+	}
+	if _, _, err := CreateKeyPair("notexample.org"); err == nil {
+		t.Fatal("expecting name constraints error")
+	}
+}
+
+func TestLoadCACache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gencert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, key := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	if err := CreateCA(cert, key, CAOptions{CommonName: "Test CA"}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer SetRootCACert(rootCACert)
+	defer SetRootCAKey(rootCAKey)
+
+	SetRootCACert(cert)
+	SetRootCAKey(key)
+
+	first, err := loadCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := loadCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatal("expecting the CA to be loaded once")
+	}
+
+	if err := CreateCA(cert, key, CAOptions{CommonName: "Test CA"}); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(cert, later, later)
+	os.Chtimes(key, later, later)
+
+	third, err := loadCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first || third.id == first.id {
+		t.Fatal("expecting the CA to be loaded again after it changed")
+	}
+}
+
+func TestDomainConstrainedCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gencert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	domainsCert, domainsKey := filepath.Join(dir, "domains.crt"), filepath.Join(dir, "domains.key")
+	err = CreateCA(domainsCert, domainsKey, CAOptions{
+		CommonName:          "Test Domains",
+		PermittedDNSDomains: []string{"example.org"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rangesCert, rangesKey := filepath.Join(dir, "ranges.crt"), filepath.Join(dir, "ranges.key")
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	err = CreateCA(rangesCert, rangesKey, CAOptions{
+		CommonName:          "Test Ranges",
+		PermittedDNSDomains: []string{"example.org"},
+		PermittedIPRanges:   []*net.IPNet{private},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer SetRootCACert(rootCACert)
+	defer SetRootCAKey(rootCAKey)
+
+	SetRootCACert(domainsCert)
+	SetRootCAKey(domainsKey)
+
+	if _, _, err := CreateKeyPair("www.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"10.0.0.1", "::1"} {
+		if _, _, err := CreateKeyPair(ip); err == nil {
+			t.Fatalf("expecting a CA restricted to domains to refuse %s", ip)
+		}
+	}
+
+	ca, err := loadCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ca.Leaf.ExcludedIPRanges) != 2 {
+		t.Fatalf("expecting all IP addresses to be excluded, got %v", ca.Leaf.ExcludedIPRanges)
+	}
+
+	// CAs created elsewhere may not exclude IP addresses.
+	if permits(&x509.Certificate{PermittedDNSDomains: []string{"example.org"}}, "10.0.0.1") {
+		t.Fatal("expecting a CA restricted to domains to refuse IP addresses")
+	}
+
+	SetRootCACert(rangesCert)
+	SetRootCAKey(rangesKey)
+
+	if _, _, err := CreateKeyPair("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CreateKeyPair("192.168.0.1"); err == nil {
+		t.Fatal("expecting name constraints error")
+	}
+}
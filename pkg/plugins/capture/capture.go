@@ -4,10 +4,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"io"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/malfunkt/hyperfox/pkg/content"
+	"github.com/malfunkt/hyperfox/pkg/tlsinfo"
 )
 
 type Header struct {
@@ -29,11 +33,76 @@ type RecordMeta struct {
 	DateStart     time.Time `json:"date_start" db:"date_start"`
 	DateEnd       time.Time `json:"date_end" db:"date_end"`
 	TimeTaken     int64     `json:"time_taken" db:"time_taken"`
+	Error         string    `json:"error,omitempty" db:"error"`
+
+	// SniffedContentType is guessed from the decoded body, ContentType is
+	// the one declared by the server.
+	SniffedContentType string `json:"sniffed_content_type,omitempty" db:"sniffed_content_type"`
+
+	// Proto is the version of HTTP spoken by the client and UpstreamProto
+	// the one spoken by the server.
+	Proto         string `json:"proto,omitempty" db:"proto"`
+	UpstreamProto string `json:"upstream_proto,omitempty" db:"upstream_proto"`
+
+	// SHA-256 of the bodies, records with the same hash carry the same
+	// body.
+	RequestBodyHash string `json:"request_body_hash,omitempty" db:"request_body_hash"`
+	BodyHash        string `json:"body_hash,omitempty" db:"body_hash"`
 
 	RequestHeader Header `json:"request_header,omitempty" db:"request_header"`
 	Header        Header `json:"header,omitempty" db:"header"`
+	Trailer       Header `json:"trailer,omitempty" db:"trailer"`
+
+	// Interim holds the informational (1xx) responses that came before the
+	// final one.
+	Interim InterimResponses `json:"interim,omitempty" db:"interim"`
+
+	ConnMeta `json:",inline" db:",inline"`
+	TLSMeta  `json:",inline" db:",inline"`
+}
+
+// ConnMeta identifies the connections used by an exchange, so it can be
+// matched with packet captures and key logs.
+type ConnMeta struct {
+	ClientLocalAddr    string `json:"client_local_addr,omitempty" db:"client_local_addr"`
+	ClientTLSRandom    string `json:"client_tls_random,omitempty" db:"client_tls_random"`
+	UpstreamLocalAddr  string `json:"upstream_local_addr,omitempty" db:"upstream_local_addr"`
+	UpstreamRemoteAddr string `json:"upstream_remote_addr,omitempty" db:"upstream_remote_addr"`
+	UpstreamTLSRandom  string `json:"upstream_tls_random,omitempty" db:"upstream_tls_random"`
+	UpstreamOverride   string `json:"upstream_override,omitempty" db:"upstream_override"`
+}
+
+// TLSMeta holds details on the TLS sessions established with the client and
+// with the upstream server.
+type TLSMeta struct {
+	ClientTLSVersion string `json:"client_tls_version,omitempty" db:"client_tls_version"`
+	ClientTLSCipher  string `json:"client_tls_cipher,omitempty" db:"client_tls_cipher"`
+	ClientTLSALPN    string `json:"client_tls_alpn,omitempty" db:"client_tls_alpn"`
+	ClientTLSSNI     string `json:"client_tls_sni,omitempty" db:"client_tls_sni"`
+	ClientTLSJA3     string `json:"client_tls_ja3,omitempty" db:"client_tls_ja3"`
+	ClientTLSJA3Hash string `json:"client_tls_ja3_hash,omitempty" db:"client_tls_ja3_hash"`
+	ClientTLSJA4     string `json:"client_tls_ja4,omitempty" db:"client_tls_ja4"`
+
+	UpstreamTLSVersion string    `json:"upstream_tls_version,omitempty" db:"upstream_tls_version"`
+	UpstreamTLSCipher  string    `json:"upstream_tls_cipher,omitempty" db:"upstream_tls_cipher"`
+	UpstreamTLSALPN    string    `json:"upstream_tls_alpn,omitempty" db:"upstream_tls_alpn"`
+	UpstreamTLSOCSP    bool      `json:"upstream_tls_ocsp,omitempty" db:"upstream_tls_ocsp"`
+	UpstreamTLSChain   CertChain `json:"upstream_tls_chain,omitempty" db:"upstream_tls_chain"`
 }
 
+// CertChain is a summary of a certificate chain that is stored as JSON.
+type CertChain []tlsinfo.CertSummary
+
+// InterimResponse is an informational (1xx) response, such as 100 Continue
+// or 103 Early Hints.
+type InterimResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+}
+
+// InterimResponses are stored as JSON.
+type InterimResponses []InterimResponse
+
 type Record struct {
 	RecordMeta `json:",inline" db:",inline"`
 
@@ -57,10 +126,125 @@ func (h Header) MarshalJSON() ([]byte, error) {
 	return json.Marshal(h.Header)
 }
 
+func (c CertChain) MarshalDB() (interface{}, error) {
+	if c == nil {
+		return nil, nil
+	}
+	return json.Marshal([]tlsinfo.CertSummary(c))
+}
+
+func (c *CertChain) UnmarshalDB(data interface{}) error {
+	if s, ok := data.([]byte); ok {
+		return json.Unmarshal(s, (*[]tlsinfo.CertSummary)(c))
+	}
+	if s, ok := data.(string); ok {
+		return json.Unmarshal([]byte(s), (*[]tlsinfo.CertSummary)(c))
+	}
+	return nil
+}
+
+func (r InterimResponses) MarshalDB() (interface{}, error) {
+	if r == nil {
+		return nil, nil
+	}
+	return json.Marshal([]InterimResponse(r))
+}
+
+func (r *InterimResponses) UnmarshalDB(data interface{}) error {
+	if s, ok := data.([]byte); ok {
+		return json.Unmarshal(s, (*[]InterimResponse)(r))
+	}
+	if s, ok := data.(string); ok {
+		return json.Unmarshal([]byte(s), (*[]InterimResponse)(r))
+	}
+	return nil
+}
+
+func newConnMeta(res *http.Response) ConnMeta {
+	var meta ConnMeta
+
+	ctx := res.Request.Context()
+	if info := tlsinfo.ClientConnFromContext(ctx); info != nil {
+		meta.ClientLocalAddr = info.LocalAddr
+		meta.ClientTLSRandom = info.Random
+	}
+	if info := tlsinfo.UpstreamConnFromContext(ctx); info != nil {
+		meta.UpstreamLocalAddr = info.LocalAddr
+		meta.UpstreamRemoteAddr = info.RemoteAddr
+		meta.UpstreamTLSRandom = info.Random
+		meta.UpstreamOverride = info.Override
+	}
+
+	return meta
+}
+
+func newTLSMeta(res *http.Response) TLSMeta {
+	var meta TLSMeta
+
+	if cs := res.Request.TLS; cs != nil {
+		meta.ClientTLSVersion = tlsinfo.VersionName(cs.Version)
+		meta.ClientTLSCipher = tlsinfo.CipherSuiteName(cs.CipherSuite)
+		meta.ClientTLSALPN = cs.NegotiatedProtocol
+		meta.ClientTLSSNI = cs.ServerName
+	}
+
+	if hello := tlsinfo.FromContext(res.Request.Context()); hello != nil {
+		meta.ClientTLSJA3, meta.ClientTLSJA3Hash = hello.JA3()
+		meta.ClientTLSJA4 = hello.JA4()
+	}
+
+	if cs := res.TLS; cs != nil {
+		meta.UpstreamTLSVersion = tlsinfo.VersionName(cs.Version)
+		meta.UpstreamTLSCipher = tlsinfo.CipherSuiteName(cs.CipherSuite)
+		meta.UpstreamTLSALPN = cs.NegotiatedProtocol
+		meta.UpstreamTLSOCSP = len(cs.OCSPResponse) > 0
+		meta.UpstreamTLSChain = CertChain(tlsinfo.Chain(cs.PeerCertificates))
+	}
+
+	return meta
+}
+
+// trailer returns the trailers that were received, servers announce them
+// before the body but may not send all of them.
+func trailer(announced http.Header) http.Header {
+	var received http.Header
+	for k, vv := range announced {
+		if len(vv) == 0 {
+			continue
+		}
+		if received == nil {
+			received = http.Header{}
+		}
+		received[k] = vv
+	}
+	return received
+}
+
+// interim summarizes informational responses.
+func interim(responses []*http.Response) InterimResponses {
+	var summary InterimResponses
+	for _, res := range responses {
+		summary = append(summary, InterimResponse{Status: res.StatusCode, Header: res.Header})
+	}
+	return summary
+}
+
+// text returns a decoded body in UTF-8, so its words can be indexed.
+func text(header http.Header, body []byte) []byte {
+	if text, _, err := content.ToUTF8(header.Get("Content-Type"), body); err == nil {
+		return text
+	}
+	return body
+}
+
 type CaptureWriteCloser struct {
 	res  *http.Response
 	resp chan *Record
 	Time time.Time
+	// UUID of the record, a new one is generated if empty.
+	UUID string
+	// Interim holds the informational responses that came before res.
+	Interim []*http.Response
 	bytes.Buffer
 }
 
@@ -75,15 +259,30 @@ func (cwc *CaptureWriteCloser) Close() error {
 		}
 	}
 
+	// Bodies are saved as they were sent, they're only decoded to make
+	// sense of them.
+	body, _ := content.Decode(cwc.res.Header, cwc.Bytes())
+	requestBody, _ := content.Decode(cwc.res.Request.Header, reqbody.Bytes())
+
+	var sniffed string
+	if len(body) > 0 {
+		sniffed = http.DetectContentType(body)
+	}
+
 	now := time.Now()
 
+	id := cwc.UUID
+	if id == "" {
+		id = uuid.New().String()
+	}
+
 	resp := &Record{
 		RecordMeta: RecordMeta{
-			UUID:          uuid.New().String(),
+			UUID:          id,
 			Origin:        cwc.res.Request.RemoteAddr,
 			Method:        cwc.res.Request.Method,
 			Status:        cwc.res.StatusCode,
-			ContentType:   http.DetectContentType(cwc.Bytes()),
+			ContentType:   cwc.res.Header.Get("Content-Type"),
 			ContentLength: uint64(cwc.Len()),
 			Host:          cwc.res.Request.URL.Host,
 			URL:           cwc.res.Request.URL.String(),
@@ -93,12 +292,22 @@ func (cwc *CaptureWriteCloser) Close() error {
 			DateEnd:       now,
 			TimeTaken:     now.UnixNano() - cwc.Time.UnixNano(),
 
+			SniffedContentType: sniffed,
+
+			Proto:         cwc.res.Request.Proto,
+			UpstreamProto: cwc.res.Proto,
+
 			Header:        Header{cwc.res.Header},
 			RequestHeader: Header{cwc.res.Request.Header},
+			Trailer:       Header{trailer(cwc.res.Trailer)},
+			Interim:       interim(cwc.Interim),
+
+			ConnMeta: newConnMeta(cwc.res),
+			TLSMeta:  newTLSMeta(cwc.res),
 		},
 		Body:        cwc.Bytes(),
 		RequestBody: reqbody.Bytes(),
-		Keywords:    extractKeywords(cwc, reqbody), // TODO: move to an async job
+		Keywords:    extractKeywords(text(cwc.res.Header, body), text(cwc.res.Request.Header, requestBody)), // TODO: move to an async job
 	}
 
 	cwc.resp <- resp
@@ -114,6 +323,37 @@ func New(resp chan *Record) *Capture {
 	return &Capture{resp: resp}
 }
 
+// LogHandshakeError records a failed TLS handshake with a client.
+func (c *Capture) LogHandshakeError(conn net.Conn, hello *tlsinfo.ClientHello, err error) error {
+	now := time.Now()
+
+	rec := &Record{
+		RecordMeta: RecordMeta{
+			UUID:      uuid.New().String(),
+			Scheme:    "https",
+			DateStart: now,
+			DateEnd:   now,
+			Error:     err.Error(),
+		},
+	}
+
+	if conn != nil {
+		rec.Origin = conn.RemoteAddr().String()
+		rec.ClientLocalAddr = conn.LocalAddr().String()
+		rec.Host = rec.ClientLocalAddr
+	}
+
+	if hello != nil {
+		rec.ClientTLSSNI = hello.ServerName
+		rec.ClientTLSJA3, rec.ClientTLSJA3Hash = hello.JA3()
+		rec.ClientTLSJA4 = hello.JA4()
+	}
+
+	c.resp <- rec
+
+	return nil
+}
+
 func (c *Capture) NewWriteCloser(res *http.Response) (io.WriteCloser, error) {
 	return &CaptureWriteCloser{
 		res:  res,
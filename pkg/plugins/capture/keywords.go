@@ -2,13 +2,12 @@ package capture
 
 import (
 	"bytes"
-	"compress/gzip"
-	"io"
 	"regexp"
+	"unicode/utf8"
 )
 
 var (
-	reUnsafeChars   = regexp.MustCompile(`[^0-9a-zA-Z\s\.]`)
+	reUnsafeChars   = regexp.MustCompile(`[^\p{L}\p{N}\s\.]`)
 	reRepeatedBlank = regexp.MustCompile(`\s+`)
 )
 
@@ -18,23 +17,15 @@ var (
 	space         = []byte{' '}
 )
 
-func peek(in io.Reader) []byte {
-	out := bytes.NewBuffer(nil)
-	tee := io.TeeReader(in, out)
-
-	gz, err := gzip.NewReader(tee)
-	if err == nil {
-		dst := bytes.NewBuffer(nil)
-		if _, err := io.CopyN(dst, gz, peekLength); err == nil {
-			return bytes.TrimSpace(dst.Bytes())
-		}
+func peek(body []byte) []byte {
+	if int64(len(body)) > peekLength {
+		body = body[:peekLength]
 	}
-
-	io.CopyN(out, in, peekLength)
-	return bytes.TrimSpace(out.Bytes())
+	return bytes.TrimSpace(body)
 }
 
-func extractKeywords(in ...io.Reader) []byte {
+// extractKeywords returns the words found in the given decoded bodies.
+func extractKeywords(in ...[]byte) []byte {
 	keywords := []byte{}
 	for i := range in {
 		keywords = append(keywords, peek(in[i])...)
@@ -46,7 +37,7 @@ func extractKeywords(in ...io.Reader) []byte {
 	words := bytes.Split(keywords, space)
 	keywords = []byte{}
 	for i := range words {
-		if len(words[i]) >= minWordLength {
+		if utf8.RuneCount(words[i]) >= minWordLength {
 			keywords = append(keywords, words[i]...)
 			keywords = append(keywords, ' ')
 		}
@@ -0,0 +1,132 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// Format turns an Entry into a log line, including its line break.
+type Format func(*Entry) ([]byte, error)
+
+func chunk(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func quote(value string) string {
+	if value == "" {
+		return `"-"`
+	}
+	return strconv.Quote(value)
+}
+
+func bytesOut(e *Entry) string {
+	if e.BytesOut == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(e.BytesOut, 10)
+}
+
+func commonLog(e *Entry) []string {
+	return []string{
+		chunk(e.RemoteHost),
+		"-",
+		"-",
+		"[" + e.Time.Format(clfTimeFormat) + "]",
+		quote(fmt.Sprintf("%s %s %s", e.Method, e.URL, e.Proto)),
+		strconv.Itoa(e.Status),
+		bytesOut(e),
+	}
+}
+
+// CommonLog formats entries in Common Log Format.
+func CommonLog(e *Entry) ([]byte, error) {
+	return []byte(strings.Join(commonLog(e), " ") + "\n"), nil
+}
+
+// CombinedLog formats entries in Combined Log Format, that is Common Log
+// Format followed by the referer and user agent.
+func CombinedLog(e *Entry) ([]byte, error) {
+	line := append(commonLog(e), quote(e.Referer), quote(e.UserAgent))
+	return []byte(strings.Join(line, " ") + "\n"), nil
+}
+
+// JSON formats entries as JSON objects, one per line.
+func JSON(e *Entry) ([]byte, error) {
+	line, err := json.Marshal(struct {
+		*Entry
+		DurationMS float64 `json:"duration_ms"`
+	}{
+		Entry:      e,
+		DurationMS: e.Duration.Seconds() * 1000,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// Template formats entries with a text/template that is executed with the
+// Entry, e.g.: `{{.Method}} {{.URL}} {{.Status}} {{.Duration}}`.
+func Template(text string) (Format, error) {
+	tpl, err := template.New("log").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return func(e *Entry) ([]byte, error) {
+		var buf bytes.Buffer
+		if err := tpl.Execute(&buf, e); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes(), nil
+	}, nil
+}
+
+// ParseFormat returns the format with the given name ("common", "combined"
+// or "json"), any other value is parsed as a template.
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "", "common", "clf":
+		return CommonLog, nil
+	case "combined":
+		return CombinedLog, nil
+	case "json":
+		return JSON, nil
+	}
+	if !strings.Contains(name, "{{") {
+		return nil, fmt.Errorf("unknown log format %q", name)
+	}
+	return Template(name)
+}
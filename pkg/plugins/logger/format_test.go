@@ -0,0 +1,245 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package logger
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/proxy"
+	"github.com/malfunkt/hyperfox/pkg/tlsinfo"
+)
+
+func newTestProxiedRequest(t *testing.T) *proxy.ProxiedRequest {
+	req, err := http.NewRequest("POST", "https://example.org/search?q=fox", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.2:41766"
+	req.Proto = "HTTP/1.1"
+	req.Header.Set("User-Agent", "curl/7.68.0")
+	req.Header.Set("Referer", "https://example.org/")
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13}
+
+	start := time.Date(2020, 4, 11, 19, 43, 30, 0, time.FixedZone("", -5*3600))
+
+	return &proxy.ProxiedRequest{
+		Request: req,
+		Response: &http.Response{
+			StatusCode:    http.StatusOK,
+			ContentLength: -1,
+			TLS:           &tls.ConnectionState{Version: tls.VersionTLS12},
+		},
+		ID:       "4f7a5c1e-0000-4000-8000-000000000000",
+		Start:    start,
+		End:      start.Add(time.Millisecond * 1500),
+		BytesIn:  12,
+		BytesOut: 1256,
+		Upstream: &tlsinfo.ConnInfo{RemoteAddr: "93.184.216.34:443"},
+	}
+}
+
+func TestFormats(t *testing.T) {
+	pr := newTestProxiedRequest(t)
+
+	formats := []struct {
+		name     string
+		expected string
+	}{
+		{
+			"common",
+			`10.0.0.2 - - [11/Apr/2020:19:43:30 -0500] "POST https://example.org/search?q=fox HTTP/1.1" 200 1256` + "\n",
+		},
+		{
+			"combined",
+			`10.0.0.2 - - [11/Apr/2020:19:43:30 -0500] "POST https://example.org/search?q=fox HTTP/1.1" 200 1256 "https://example.org/" "curl/7.68.0"` + "\n",
+		},
+		{
+			"{{.UUID}} {{.Duration}} {{.BytesIn}}/{{.BytesOut}} {{.UpstreamAddr}} {{.TLSVersion}} {{.UpstreamTLSVersion}}",
+			"4f7a5c1e-0000-4000-8000-000000000000 1.5s 12/1256 93.184.216.34:443 TLS 1.3 TLS 1.2\n",
+		},
+	}
+
+	for _, f := range formats {
+		format, err := ParseFormat(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if err := New(&buf, format).Log(pr); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != f.expected {
+			t.Fatalf("%s: expecting %q, got %q", f.name, f.expected, buf.String())
+		}
+	}
+
+	if _, err := ParseFormat("apache"); err == nil {
+		t.Fatal("expecting unknown format error")
+	}
+	if _, err := ParseFormat("{{.Method"); err == nil {
+		t.Fatal("expecting template error")
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	if err := New(&buf, JSON).Log(newTestProxiedRequest(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"uuid":                 "4f7a5c1e-0000-4000-8000-000000000000",
+		"time":                 "2020-04-11T19:43:30-05:00",
+		"remote_addr":          "10.0.0.2:41766",
+		"method":               "POST",
+		"status":               float64(200),
+		"bytes_in":             float64(12),
+		"bytes_out":            float64(1256),
+		"duration_ms":          float64(1500),
+		"upstream_addr":        "93.184.216.34:443",
+		"tls_version":          "TLS 1.3",
+		"upstream_tls_version": "TLS 1.2",
+	}
+	for k, v := range expected {
+		if line[k] != v {
+			t.Fatalf("%s: expecting %v, got %v", k, v, line[k])
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hyperfox-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+
+	rf, err := NewRotatingFile(path, 11, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	now := time.Date(2020, 4, 11, 0, 0, 0, 0, time.UTC)
+	rf.now = func() time.Time { return now }
+	rf.opened = now
+
+	write := func(s string) {
+		if _, err := rf.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("12345\n")
+	write("1234\n") // Fits.
+	write("123\n")  // Rotated by size.
+
+	now = now.Add(time.Hour)
+	write("1\n") // Rotated by age.
+
+	files, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("expecting 3 files, got %v", files)
+	}
+
+	expected := map[string]string{
+		path:                        "1\n",
+		path + ".20200411-000000":   "12345\n1234\n",
+		path + ".20200411-000000.1": "123\n",
+	}
+	for name, content := range expected {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != content {
+			t.Fatalf("%s: expecting %q, got %q", name, content, buf)
+		}
+	}
+}
+
+func TestRotatingFileRenameError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hyperfox-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+
+	rf, err := NewRotatingFile(path, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	rf.rename = func(string, string) error {
+		return &os.LinkError{Op: "rename", Err: syscall.EXDEV}
+	}
+
+	if _, err := rf.Write([]byte("123\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rf.Write([]byte("456\n")); err == nil {
+		t.Fatal("expecting rename error")
+	}
+
+	// The file is still open and rotated by the next write.
+	rf.rename = os.Rename
+	if _, err := rf.Write([]byte("789\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil || len(rotated) != 1 {
+		t.Fatalf("expecting a rotated file, got %v (%v)", rotated, err)
+	}
+	for name, content := range map[string]string{path: "789\n", rotated[0]: "123\n"} {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != content {
+			t.Fatalf("%s: expecting %q, got %q", name, content, buf)
+		}
+	}
+}
@@ -19,22 +19,119 @@
 // OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
 // WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 
-// Package logger provides standard logger.
+// Package logger provides access loggers.
 package logger
 
 import (
-	"fmt"
-	"strings"
+	"io"
+	"net"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/malfunkt/hyperfox/pkg/proxy"
+	"github.com/malfunkt/hyperfox/pkg/tlsinfo"
 )
 
-func chunk(value string) string {
-	if value == "" {
-		return "-"
+// Entry holds the fields of an access log line.
+type Entry struct {
+	UUID       string        `json:"uuid"`
+	Time       time.Time     `json:"time"`
+	RemoteAddr string        `json:"remote_addr"`
+	RemoteHost string        `json:"-"`
+	Method     string        `json:"method"`
+	URL        string        `json:"url"`
+	Host       string        `json:"host"`
+	Proto      string        `json:"proto"`
+	Status     int           `json:"status"`
+	BytesIn    int64         `json:"bytes_in"`
+	BytesOut   int64         `json:"bytes_out"`
+	Duration   time.Duration `json:"-"`
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+
+	UpstreamAddr       string `json:"upstream_addr,omitempty"`
+	TLSVersion         string `json:"tls_version,omitempty"`
+	UpstreamTLSVersion string `json:"upstream_tls_version,omitempty"`
+}
+
+// NewEntry extracts the log fields of a proxied request.
+func NewEntry(pr *proxy.ProxiedRequest) *Entry {
+	r := pr.Request
+
+	e := &Entry{
+		UUID:       pr.ID,
+		Time:       pr.Start,
+		RemoteAddr: r.RemoteAddr,
+		RemoteHost: r.RemoteAddr,
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		Host:       r.Host,
+		Proto:      r.Proto,
+		BytesIn:    pr.BytesIn,
+		BytesOut:   pr.BytesOut,
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		e.RemoteHost = host
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if !pr.End.IsZero() {
+		e.Duration = pr.End.Sub(pr.Start)
+	}
+	if r.TLS != nil {
+		e.TLSVersion = tlsinfo.VersionName(r.TLS.Version)
+	}
+	if pr.Upstream != nil {
+		e.UpstreamAddr = pr.Upstream.RemoteAddr
+	}
+	if res := pr.Response; res != nil {
+		e.Status = res.StatusCode
+		if res.TLS != nil {
+			e.UpstreamTLSVersion = tlsinfo.VersionName(res.TLS.Version)
+		}
+	}
+
+	return e
+}
+
+// Logger implements proxy.Logger, it writes a line in the given format for
+// each proxied request.
+type Logger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format Format
+}
+
+// New creates a Logger that writes to w.
+func New(w io.Writer, format Format) *Logger {
+	return &Logger{w: w, format: format}
+}
+
+// Log writes an access log line for the given request.
+func (l *Logger) Log(pr *proxy.ProxiedRequest) error {
+	line, err := l.format(NewEntry(pr))
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err = l.w.Write(line)
+	return err
+}
+
+// Close closes the underlying writer, if it can be closed.
+func (l *Logger) Close() error {
+	if c, ok := l.w.(io.Closer); ok && l.w != os.Stdout && l.w != os.Stderr {
+		return c.Close()
 	}
-	return value
+	return nil
 }
 
 // Stdout struct implements proxy.Logger
@@ -43,18 +140,11 @@ type Stdout struct {
 
 // Log prints a standard log string to the system.
 func (s Stdout) Log(pr *proxy.ProxiedRequest) error {
-
-	line := []string{
-		chunk(pr.Request.RemoteAddr),
-		chunk(""),
-		chunk(""),
-		chunk("[" + time.Now().Format("02/Jan/2006:15:04:05 -0700") + "]"),
-		chunk("\"" + fmt.Sprintf("%s %s %s", pr.Request.Method, pr.Request.URL, pr.Request.Proto) + "\""),
-		chunk(fmt.Sprintf("%d", pr.Response.StatusCode)),
-		chunk(fmt.Sprintf("%d", pr.Response.ContentLength)),
+	line, err := CommonLog(NewEntry(pr))
+	if err != nil {
+		return err
 	}
 
-	fmt.Println(strings.Join(line, " "))
-
-	return nil
+	_, err = os.Stdout.Write(line)
+	return err
 }
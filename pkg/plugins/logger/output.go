@@ -0,0 +1,152 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package logger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rotatedTimeFormat = "20060102-150405"
+
+// RotatingFile is an io.WriteCloser that appends to a file and rotates it
+// when it grows beyond a given size or gets older than a given age. Rotated
+// files are renamed after the time they were opened (e.g.
+// access.log.20200411-193648).
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+
+	now    func() time.Time
+	rename func(oldpath, newpath string) error
+}
+
+// NewRotatingFile opens path for appending. A zero maxSize or maxAge
+// disables rotation by size or by age.
+func NewRotatingFile(path string, maxSize int64, maxAge time.Duration) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		now:     time.Now,
+		rename:  os.Rename,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size, rf.opened = f, stat.Size(), rf.now()
+	return nil
+}
+
+func (rf *RotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+
+	name := rf.path + "." + rf.opened.Format(rotatedTimeFormat)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%s.%s.%d", rf.path, rf.opened.Format(rotatedTimeFormat), i)
+	}
+
+	if err := rf.rename(rf.path, name); err != nil {
+		// Writes go on to the file that could not be rotated.
+		if openErr := rf.open(); openErr != nil {
+			return fmt.Errorf("%v (reopening: %v)", err, openErr)
+		}
+		return err
+	}
+	return rf.open()
+}
+
+// Write appends b to the file, rotating it first if needed.
+func (rf *RotatingFile) Write(b []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.size > 0 {
+		bySize := rf.maxSize > 0 && rf.size+int64(len(b)) > rf.maxSize
+		byAge := rf.maxAge > 0 && rf.now().Sub(rf.opened) >= rf.maxAge
+		if bySize || byAge {
+			if err := rf.rotate(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close closes the file.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	return rf.f.Close()
+}
+
+// OpenOutput opens the given log output: "stdout", "stderr", "syslog" (the
+// local syslog daemon), "syslog://host:port" or "syslog+tcp://host:port" (a
+// remote syslog server) or the path to a file that is rotated according to
+// maxSize and maxAge.
+func OpenOutput(output string, maxSize int64, maxAge time.Duration) (io.Writer, error) {
+	switch {
+	case output == "" || output == "stdout" || output == "-":
+		return os.Stdout, nil
+	case output == "stderr":
+		return os.Stderr, nil
+	case output == "syslog":
+		return newSyslog("", "")
+	case strings.HasPrefix(output, "syslog://"):
+		return newSyslog("udp", strings.TrimPrefix(output, "syslog://"))
+	case strings.HasPrefix(output, "syslog+tcp://"):
+		return newSyslog("tcp", strings.TrimPrefix(output, "syslog+tcp://"))
+	}
+	return NewRotatingFile(output, maxSize, maxAge)
+}
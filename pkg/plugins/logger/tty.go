@@ -0,0 +1,408 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package logger
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/proxy"
+)
+
+// ANSI escape sequences.
+const (
+	colorReset   = "\x1b[0m"
+	colorDim     = "\x1b[2m"
+	colorRed     = "\x1b[31m"
+	colorGreen   = "\x1b[32m"
+	colorYellow  = "\x1b[33m"
+	colorBlue    = "\x1b[34m"
+	colorMagenta = "\x1b[35m"
+	colorCyan    = "\x1b[36m"
+	clearLine    = "\r\x1b[K"
+)
+
+// maxPausedEntries limits how many entries are kept while the log is paused.
+const maxPausedEntries = 1000
+
+// ErrInterrupted is returned by ReadCommands when the user presses Ctrl-C.
+var ErrInterrupted = errors.New("interrupted")
+
+var staticExtensions = map[string]bool{
+	".css": true, ".js": true, ".map": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true,
+	".ico": true, ".webp": true, ".avif": true, ".bmp": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true,
+}
+
+const ttyHelp = "keys: [space] pause/resume  [h] filter by host  [s] filter by status  " +
+	"[a] show/hide static assets  [c] clear filters  [?] help"
+
+// TTY is an interactive proxy.Logger for terminals. It colorizes methods and
+// status classes, prints human readable durations and sizes, collapses
+// requests for static assets and accepts keyboard commands (see
+// ReadCommands) to filter or pause the stream.
+//
+// TTY writes "\r\n" line endings so it can be used on terminals in raw mode.
+type TTY struct {
+	mu  sync.Mutex
+	out io.Writer
+
+	paused      bool
+	pending     []*Entry
+	dropped     int
+	hostFilter  string
+	status      string
+	showStatic  bool
+	collapsed   int
+	prompt      string
+	promptInput []rune
+}
+
+// NewTTY creates a TTY logger that writes to out.
+func NewTTY(out io.Writer) *TTY {
+	return &TTY{out: out}
+}
+
+// Log implements proxy.Logger.
+func (t *TTY) Log(pr *proxy.ProxiedRequest) error {
+	e := NewEntry(pr)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.paused {
+		if len(t.pending) < maxPausedEntries {
+			t.pending = append(t.pending, e)
+		} else {
+			t.dropped++
+		}
+		t.redraw()
+		return nil
+	}
+
+	t.print(e)
+	t.redraw()
+	return nil
+}
+
+func humanDuration(d time.Duration) string {
+	switch {
+	case d <= 0:
+		return "-"
+	case d < time.Millisecond:
+		return strconv.FormatInt(int64(d/time.Microsecond), 10) + "µs"
+	case d < time.Second:
+		return strconv.FormatInt(int64(d/time.Millisecond), 10) + "ms"
+	case d < time.Minute:
+		return strconv.FormatFloat(d.Seconds(), 'f', 1, 64) + "s"
+	}
+	return d.Round(time.Second).String()
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + "B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64) + string("KMGTPE"[exp]) + "B"
+}
+
+func methodColor(method string) string {
+	switch method {
+	case "GET", "HEAD":
+		return colorBlue
+	case "POST":
+		return colorYellow
+	case "PUT", "PATCH":
+		return colorMagenta
+	case "DELETE":
+		return colorRed
+	}
+	return colorCyan
+}
+
+func statusColor(status int) string {
+	switch {
+	case status >= 500:
+		return colorRed
+	case status >= 400:
+		return colorYellow
+	case status >= 300:
+		return colorCyan
+	case status >= 200:
+		return colorGreen
+	}
+	return colorDim
+}
+
+// isStatic tells whether the entry is a successful request for a static
+// asset, like a stylesheet or an image.
+func isStatic(e *Entry) bool {
+	if e.Status >= 400 {
+		return false
+	}
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return false
+	}
+	return staticExtensions[strings.ToLower(path.Ext(u.Path))]
+}
+
+func (t *TTY) matches(e *Entry) bool {
+	if t.hostFilter != "" && !strings.Contains(strings.ToLower(e.Host), t.hostFilter) {
+		return false
+	}
+	if t.status != "" && !strings.HasPrefix(strconv.Itoa(e.Status), t.status) {
+		return false
+	}
+	return true
+}
+
+// formatEntry returns a colorized line for e.
+func formatEntry(e *Entry) string {
+	target := e.URL
+	if u, err := url.Parse(e.URL); err == nil {
+		target = u.Host + u.RequestURI()
+		if u.Host == "" {
+			target = e.Host + u.RequestURI()
+		}
+	}
+	return fmt.Sprintf("%s%s%s %s%-7s%s %s%3d%s %7s %8s  %s",
+		colorDim, e.Time.Format("15:04:05"), colorReset,
+		methodColor(e.Method), e.Method, colorReset,
+		statusColor(e.Status), e.Status, colorReset,
+		humanDuration(e.Duration),
+		humanSize(e.BytesOut),
+		target,
+	)
+}
+
+// writeLine prints a permanent line above the status line.
+func (t *TTY) writeLine(line string) {
+	fmt.Fprint(t.out, clearLine+line+"\r\n")
+}
+
+func (t *TTY) flushCollapsed() {
+	if t.collapsed > 0 {
+		t.writeLine(fmt.Sprintf("%s         + %d static assets%s", colorDim, t.collapsed, colorReset))
+		t.collapsed = 0
+	}
+}
+
+func (t *TTY) print(e *Entry) {
+	if !t.matches(e) {
+		return
+	}
+	if !t.showStatic && isStatic(e) {
+		t.collapsed++
+		return
+	}
+	t.flushCollapsed()
+	t.writeLine(formatEntry(e))
+}
+
+// redraw updates the status line at the bottom of the terminal.
+func (t *TTY) redraw() {
+	var status string
+	switch {
+	case t.prompt != "":
+		status = t.prompt + string(t.promptInput)
+	case t.paused:
+		status = fmt.Sprintf("%s-- paused, %d new --%s", colorYellow, len(t.pending)+t.dropped, colorReset)
+	case t.collapsed > 0:
+		status = fmt.Sprintf("%s         + %d static assets%s", colorDim, t.collapsed, colorReset)
+	}
+	fmt.Fprint(t.out, clearLine+status)
+}
+
+func (t *TTY) info(format string, args ...interface{}) {
+	t.flushCollapsed()
+	t.writeLine(colorDim + fmt.Sprintf(format, args...) + colorReset)
+}
+
+func (t *TTY) filters() string {
+	var filters []string
+	if t.hostFilter != "" {
+		filters = append(filters, "host="+t.hostFilter)
+	}
+	if t.status != "" {
+		filters = append(filters, "status="+t.status+strings.Repeat("x", 3-len(t.status)))
+	}
+	if len(filters) == 0 {
+		return "none"
+	}
+	return strings.Join(filters, " ")
+}
+
+func (t *TTY) resume() {
+	t.paused = false
+	for _, e := range t.pending {
+		t.print(e)
+	}
+	if t.dropped > 0 {
+		t.info("%d entries were dropped while paused", t.dropped)
+	}
+	t.pending, t.dropped = nil, 0
+}
+
+// applyPrompt applies the text typed after a prompt.
+func (t *TTY) applyPrompt(input string) {
+	input = strings.TrimSpace(input)
+
+	switch t.prompt {
+	case hostPrompt:
+		t.hostFilter = strings.ToLower(input)
+	case statusPrompt:
+		input = strings.TrimRight(strings.ToLower(input), "x")
+		if _, err := strconv.Atoi(input); input != "" && (err != nil || len(input) > 3) {
+			t.info("invalid status filter %q", input)
+			return
+		}
+		t.status = input
+	}
+	t.info("filters: %s", t.filters())
+}
+
+const (
+	hostPrompt   = "host: "
+	statusPrompt = "status (e.g. 4, 404): "
+)
+
+// handleKey processes a key press, it returns ErrInterrupted on Ctrl-C.
+func (t *TTY) handleKey(r rune) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.redraw()
+
+	if r == 0x03 { // Ctrl-C
+		t.prompt = ""
+		return ErrInterrupted
+	}
+
+	if t.prompt != "" {
+		switch r {
+		case '\r', '\n':
+			input := string(t.promptInput)
+			t.applyPrompt(input)
+			t.prompt, t.promptInput = "", nil
+		case 0x1b: // Esc
+			t.prompt, t.promptInput = "", nil
+		case 0x7f, 0x08: // Backspace
+			if n := len(t.promptInput); n > 0 {
+				t.promptInput = t.promptInput[:n-1]
+			}
+		default:
+			if r >= ' ' {
+				t.promptInput = append(t.promptInput, r)
+			}
+		}
+		return nil
+	}
+
+	switch r {
+	case ' ', 'p':
+		if t.paused {
+			t.resume()
+		} else {
+			t.paused = true
+		}
+	case 'h':
+		t.prompt = hostPrompt
+		t.promptInput = []rune(t.hostFilter)
+	case 's':
+		t.prompt = statusPrompt
+		t.promptInput = []rune(t.status)
+	case 'a':
+		t.showStatic = !t.showStatic
+		t.flushCollapsed()
+		if t.showStatic {
+			t.info("showing static assets")
+		} else {
+			t.info("hiding static assets")
+		}
+	case 'c':
+		t.hostFilter, t.status = "", ""
+		t.info("filters: %s", t.filters())
+	case '?':
+		t.info(ttyHelp)
+	}
+	return nil
+}
+
+// ReadCommands reads key presses from in (usually a terminal in raw mode)
+// until it's closed or the user presses Ctrl-C, in which case it returns
+// ErrInterrupted.
+func (t *TTY) ReadCommands(in io.Reader) error {
+	t.mu.Lock()
+	t.info(ttyHelp)
+	t.redraw()
+	t.mu.Unlock()
+
+	r := bufio.NewReader(in)
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			return err
+		}
+		if err := t.handleKey(c); err != nil {
+			return err
+		}
+	}
+}
+
+type ttyWriter struct {
+	t *TTY
+}
+
+func (w ttyWriter) Write(b []byte) (int, error) {
+	w.t.mu.Lock()
+	defer w.t.mu.Unlock()
+
+	w.t.flushCollapsed()
+	lines := strings.TrimSuffix(string(b), "\n")
+	for _, line := range strings.Split(lines, "\n") {
+		w.t.writeLine(line)
+	}
+	w.t.redraw()
+	return len(b), nil
+}
+
+// Writer returns an io.Writer that prints above the status line of the
+// logger, use it to send other output to the same terminal (e.g. with
+// log.SetOutput).
+func (t *TTY) Writer() io.Writer {
+	return ttyWriter{t: t}
+}
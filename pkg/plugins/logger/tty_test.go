@@ -0,0 +1,158 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package logger
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/proxy"
+)
+
+func newTTYRequest(t *testing.T, rawurl string, status int) *proxy.ProxiedRequest {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	return &proxy.ProxiedRequest{
+		Request:  req,
+		Response: &http.Response{StatusCode: status},
+		Start:    start,
+		End:      start.Add(time.Millisecond * 25),
+		BytesOut: 2048,
+	}
+}
+
+// lines returns the permanent lines written to the terminal.
+func lines(buf *bytes.Buffer) []string {
+	chunks := strings.Split(buf.String(), "\r\n")
+	return chunks[:len(chunks)-1]
+}
+
+func TestTTY(t *testing.T) {
+	var buf bytes.Buffer
+	tty := NewTTY(&buf)
+
+	keys := func(s string) {
+		if err := tty.ReadCommands(strings.NewReader(s)); err != io.EOF {
+			t.Fatal(err)
+		}
+		buf.Reset()
+	}
+	keys("")
+
+	_ = tty.Log(newTTYRequest(t, "http://example.org/", 200))
+	_ = tty.Log(newTTYRequest(t, "http://example.org/app.js", 200))
+	_ = tty.Log(newTTYRequest(t, "http://example.org/logo.PNG?v=2", 304))
+	_ = tty.Log(newTTYRequest(t, "http://example.org/missing.css", 404))
+
+	out := lines(&buf)
+	if len(out) != 3 {
+		t.Fatalf("expecting 3 lines, got %q", out)
+	}
+	if !strings.Contains(out[0], "GET") || !strings.Contains(out[0], "25ms") || !strings.Contains(out[0], "2.0KB") || !strings.Contains(out[0], "example.org/") {
+		t.Fatalf("unexpected line %q", out[0])
+	}
+	if !strings.Contains(out[0], colorGreen+"200") {
+		t.Fatalf("expecting status to be green, got %q", out[0])
+	}
+	if !strings.Contains(out[1], "+ 2 static assets") {
+		t.Fatalf("expecting collapsed assets, got %q", out[1])
+	}
+	if !strings.Contains(out[2], colorYellow+"404") || !strings.Contains(out[2], "missing.css") {
+		t.Fatalf("unexpected line %q", out[2])
+	}
+
+	// Filter by host and status class.
+	keys("hapi.example\rs5\r")
+	_ = tty.Log(newTTYRequest(t, "http://example.org/", 500))
+	_ = tty.Log(newTTYRequest(t, "http://api.example.org/", 200))
+	_ = tty.Log(newTTYRequest(t, "http://API.example.org/v1", 503))
+	out = lines(&buf)
+	if len(out) != 1 || !strings.Contains(out[0], "API.example.org/v1") {
+		t.Fatalf("expecting one matching line, got %q", out)
+	}
+
+	// Pause, then resume.
+	keys("c ")
+	_ = tty.Log(newTTYRequest(t, "http://example.org/a", 200))
+	_ = tty.Log(newTTYRequest(t, "http://example.org/b", 200))
+	if out := lines(&buf); len(out) != 0 {
+		t.Fatalf("expecting no output while paused, got %q", out)
+	}
+	if !strings.Contains(buf.String(), "paused, 2 new") {
+		t.Fatalf("expecting paused status line, got %q", buf.String())
+	}
+
+	if err := tty.ReadCommands(strings.NewReader("h\x03")); err != ErrInterrupted {
+		t.Fatalf("expecting ErrInterrupted, got %v", err)
+	}
+}
+
+func TestTTYResume(t *testing.T) {
+	var buf bytes.Buffer
+	tty := NewTTY(&buf)
+
+	_ = tty.handleKey(' ')
+	_ = tty.Log(newTTYRequest(t, "http://example.org/a", 200))
+	_ = tty.Log(newTTYRequest(t, "http://example.org/b", 200))
+	buf.Reset()
+
+	_ = tty.handleKey('p')
+	out := lines(&buf)
+	if len(out) != 2 || !strings.Contains(out[0], "example.org/a") || !strings.Contains(out[1], "example.org/b") {
+		t.Fatalf("expecting paused entries, got %q", out)
+	}
+}
+
+func TestHumanUnits(t *testing.T) {
+	sizes := map[int64]string{
+		0:               "0B",
+		1023:            "1023B",
+		1536:            "1.5KB",
+		5 * 1024 * 1024: "5.0MB",
+		3 << 30:         "3.0GB",
+	}
+	for n, expected := range sizes {
+		if s := humanSize(n); s != expected {
+			t.Fatalf("%d: expecting %q, got %q", n, expected, s)
+		}
+	}
+
+	durations := map[time.Duration]string{
+		0:                       "-",
+		time.Microsecond * 850:  "850µs",
+		time.Millisecond * 12:   "12ms",
+		time.Millisecond * 1250: "1.2s",
+		time.Second * 95:        "1m35s",
+	}
+	for d, expected := range durations {
+		if s := humanDuration(d); s != expected {
+			t.Fatalf("%v: expecting %q, got %q", d, expected, s)
+		}
+	}
+}
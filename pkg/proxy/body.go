@@ -0,0 +1,67 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// requestBody keeps a copy of a request body as the transport reads it, so
+// the body isn't read from the client before the server asks for it (e.g.
+// with Expect: 100-continue).
+type requestBody struct {
+	io.ReadCloser
+	buf    bytes.Buffer
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newRequestBody(rc io.ReadCloser) *requestBody {
+	return &requestBody{
+		ReadCloser: rc,
+		closed:     make(chan struct{}),
+	}
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+// Close closes the body of the client, the transport may do it after
+// returning the response.
+func (b *requestBody) Close() error {
+	b.once.Do(func() {
+		close(b.closed)
+	})
+	return b.ReadCloser.Close()
+}
+
+// wait blocks until the transport is done with the body and returns what
+// was sent.
+func (b *requestBody) wait() *bytes.Buffer {
+	<-b.closed
+	return &b.buf
+}
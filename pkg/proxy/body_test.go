@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+const listenExpectAddr = `127.0.0.1:13083`
+
+type interimLogger struct {
+	pr chan *ProxiedRequest
+}
+
+func (l *interimLogger) Log(pr *ProxiedRequest) error {
+	l.pr <- pr
+	return nil
+}
+
+func startInterimProxy(t *testing.T, handler http.Handler) (*Proxy, *httptest.Server, *interimLogger) {
+	upstream := httptest.NewServer(handler)
+
+	p := NewProxy()
+
+	logger := &interimLogger{pr: make(chan *ProxiedRequest, 1)}
+	p.AddLogger(logger)
+
+	go func() {
+		if err := p.Start(listenExpectAddr); err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				t.Errorf("could not start HTTP server: %v", err)
+			}
+		}
+	}()
+	waitForListener(t, listenExpectAddr)
+
+	return p, upstream, logger
+}
+
+func TestExpectContinue(t *testing.T) {
+	p, upstream, logger := startInterimProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > 8 {
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer upstream.Close()
+	defer p.Stop()
+
+	upload := func(body string) (*bufio.Reader, net.Conn) {
+		conn, err := net.Dial("tcp", listenExpectAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "PUT /upload HTTP/1.1\r\nHost: %s\r\nExpect: 100-continue\r\nContent-Length: %d\r\n\r\n", upstream.Listener.Addr(), len(body))
+		return bufio.NewReader(conn), conn
+	}
+
+	// The server refuses the body, so it's never sent.
+	br, conn := upload("too large a body")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusExpectationFailed {
+		t.Fatalf("expecting the server's refusal, got %d", res.StatusCode)
+	}
+	if pr := <-logger.pr; pr.BytesIn != 0 || len(pr.Interim) != 0 {
+		t.Fatalf("expecting no body to be sent, got %d bytes and %d interim responses", pr.BytesIn, len(pr.Interim))
+	}
+	conn.Close()
+
+	// The server agrees, the body is sent after 100 Continue.
+	br, conn = upload("fox")
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if res, err = http.ReadResponse(br, nil); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusContinue {
+		t.Fatalf("expecting 100 Continue, got %d", res.StatusCode)
+	}
+
+	fmt.Fprint(conn, "fox")
+	if res, err = http.ReadResponse(br, nil); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != "fox" {
+		t.Fatalf("unexpected response %d %q", res.StatusCode, body)
+	}
+	if pr := <-logger.pr; pr.BytesIn != 3 || len(pr.Interim) != 1 || pr.Interim[0].StatusCode != http.StatusContinue {
+		t.Fatalf("unexpected exchange, got %d bytes and %v", pr.BytesIn, pr.Interim)
+	}
+}
+
+func TestEarlyHints(t *testing.T) {
+	p, upstream, logger := startInterimProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</fox.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	defer p.Stop()
+
+	var hints []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			hints = append(hints, fmt.Sprintf("%d %s", code, header.Get("Link")))
+			return nil
+		},
+	}
+
+	req, _ := http.NewRequest("GET", "http://"+listenExpectAddr+"/", nil)
+	req.Host = upstream.Listener.Addr().String()
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	res, err := (&http.Client{Transport: &http.Transport{}}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if len(hints) != 1 || hints[0] != "103 </fox.css>; rel=preload" {
+		t.Fatalf("expecting early hints to be relayed, got %q", hints)
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("Link") != "" {
+		t.Fatalf("unexpected response %d %v", res.StatusCode, res.Header)
+	}
+	if pr := <-logger.pr; len(pr.Interim) != 1 || pr.Interim[0].Header.Get("Link") == "" {
+		t.Fatalf("expecting early hints to be recorded, got %v", pr.Interim)
+	}
+}
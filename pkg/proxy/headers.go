@@ -0,0 +1,150 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// hopHeaders are meaningful only for a single connection and are not
+// forwarded (RFC 7230, section 6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // Not standard, but sent by some clients.
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Forwarding selects the headers that tell servers a request went through
+// the proxy, none are added by default.
+type Forwarding struct {
+	// Via is the name of the proxy in Via headers (RFC 7230), which are
+	// added to requests and responses if it's not empty.
+	Via string
+	// Forwarded adds a Forwarded header (RFC 7239) with the address of the
+	// client, the host it asked for and its protocol.
+	Forwarded bool
+	// XForwardedFor appends the address of the client to X-Forwarded-For.
+	XForwardedFor bool
+}
+
+// SetForwarding sets the headers that are added to forwarded messages.
+func (p *Proxy) SetForwarding(f Forwarding) {
+	p.forwarding = f
+}
+
+// removeHopHeaders removes hop-by-hop headers from h, including the ones
+// named by its Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// appendHeader appends value to the comma separated list in h[key].
+func appendHeader(h http.Header, key, value string) {
+	if prior := h.Values(key); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	h.Set(key, value)
+}
+
+// via returns a Via entry for a message of the given version of HTTP.
+func via(major, minor int, name string) string {
+	return fmt.Sprintf("%d.%d %s", major, minor, name)
+}
+
+// forwardedValue quotes v if it's not a token, as required by Forwarded.
+func forwardedValue(v string) string {
+	for _, r := range v {
+		if !httpguts.IsTokenRune(r) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+// outgoingHeader prepares the header of a request from client r that is
+// about to be sent upstream.
+func (p *Proxy) outgoingHeader(h http.Header, r *http.Request) {
+	// Servers need TE: trailers to know trailers are understood end to end
+	// (gRPC requires it).
+	trailers := httpguts.HeaderValuesContainsToken(h["Te"], "trailers")
+
+	removeHopHeaders(h)
+
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+
+	f := p.forwarding
+	if f.Via != "" {
+		appendHeader(h, "Via", via(r.ProtoMajor, r.ProtoMinor, f.Via))
+	}
+
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return
+	}
+
+	if f.XForwardedFor {
+		appendHeader(h, "X-Forwarded-For", client)
+	}
+	if f.Forwarded {
+		if strings.Contains(client, ":") {
+			client = "[" + client + "]"
+		}
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		appendHeader(h, "Forwarded", fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedValue(client), forwardedValue(r.Host), proto))
+	}
+}
+
+// incomingHeader prepares the header of a response from upstream that is
+// about to be sent to the client.
+func (p *Proxy) incomingHeader(h http.Header, res *http.Response) {
+	removeHopHeaders(h)
+
+	if p.forwarding.Via != "" {
+		appendHeader(h, "Via", via(res.ProtoMajor, res.ProtoMinor, p.forwarding.Via))
+	}
+}
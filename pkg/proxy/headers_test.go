@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// echoHeader answers with the header of the request, along with hop-by-hop
+// headers of its own.
+var echoHeader = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Connection", "X-Hop")
+	w.Header().Set("X-Hop", "1")
+	w.Header().Set("Proxy-Authenticate", "Basic")
+	w.Header().Set("X-End", "1")
+	_ = json.NewEncoder(w).Encode(r.Header)
+})
+
+type headerDirector struct {
+	header http.Header
+}
+
+func (d *headerDirector) Direct(req *http.Request) error {
+	d.header = req.Header.Clone()
+	return nil
+}
+
+func proxiedHeader(t *testing.T, p *Proxy, upstream *httptest.Server, header http.Header) (http.Header, *http.Response) {
+
+	req := httptest.NewRequest("GET", upstream.URL, nil)
+	req.Host = upstream.Listener.Addr().String()
+	req.URL.Host = ""
+	req.Header = header
+
+	wri := httptest.NewRecorder()
+	p.ServeHTTP(wri, req)
+
+	res := wri.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+
+	var got http.Header
+	if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	return got, res
+}
+
+func TestHopByHopHeaders(t *testing.T) {
+	p := NewProxy()
+
+	director := &headerDirector{}
+	p.AddDirector(director)
+
+	header := http.Header{
+		"Connection":          {"keep-alive, X-Hop"},
+		"X-Hop":               {"1"},
+		"Keep-Alive":          {"timeout=5"},
+		"Proxy-Connection":    {"keep-alive"},
+		"Proxy-Authorization": {"Basic Zm94Og=="},
+		"Te":                  {"trailers, deflate"},
+		"Upgrade":             {"websocket"},
+		"X-End":               {"1"},
+	}
+
+	upstream := httptest.NewServer(echoHeader)
+	defer upstream.Close()
+
+	got, res := proxiedHeader(t, p, upstream, header)
+
+	for _, name := range []string{"Connection", "X-Hop", "Keep-Alive", "Proxy-Connection", "Proxy-Authorization", "Upgrade", "Via", "Forwarded", "X-Forwarded-For"} {
+		if v, ok := got[name]; ok {
+			t.Fatalf("expecting %s not to be forwarded, got %q", name, v)
+		}
+	}
+	if got.Get("X-End") != "1" || got.Get("Te") != "trailers" {
+		t.Fatalf("unexpected header %v", got)
+	}
+	if _, ok := director.header["Host"]; ok {
+		t.Fatalf("expecting Host to be sent from the request, got %v", director.header)
+	}
+	if header.Get("Proxy-Authorization") == "" {
+		t.Fatal("expecting the header of the client to be left as sent")
+	}
+
+	for _, name := range []string{"Connection", "X-Hop", "Proxy-Authenticate", "Via"} {
+		if v, ok := res.Header[name]; ok {
+			t.Fatalf("expecting %s not to be sent to the client, got %q", name, v)
+		}
+	}
+	if res.Header.Get("X-End") != "1" {
+		t.Fatalf("unexpected response header %v", res.Header)
+	}
+}
+
+func TestForwardingHeaders(t *testing.T) {
+	p := NewProxy()
+	p.SetForwarding(Forwarding{
+		Via:           "hyperfox",
+		Forwarded:     true,
+		XForwardedFor: true,
+	})
+
+	header := http.Header{
+		"Via":             {"1.1 gateway"},
+		"X-Forwarded-For": {"10.0.0.1"},
+	}
+
+	upstream := httptest.NewServer(echoHeader)
+	defer upstream.Close()
+
+	got, res := proxiedHeader(t, p, upstream, header)
+
+	if v := got.Get("Via"); v != "1.1 gateway, 1.1 hyperfox" {
+		t.Fatalf("unexpected Via %q", v)
+	}
+	// Requests made by httptest.NewRequest come from 192.0.2.1.
+	if v := got.Get("X-Forwarded-For"); v != "10.0.0.1, 192.0.2.1" {
+		t.Fatalf("unexpected X-Forwarded-For %q", v)
+	}
+	if v := got.Get("Forwarded"); v != `for=192.0.2.1;host="`+upstream.Listener.Addr().String()+`";proto=http` {
+		t.Fatalf("unexpected Forwarded %q", v)
+	}
+	if v := res.Header.Get("Via"); v != "1.1 hyperfox" {
+		t.Fatalf("unexpected Via in response %q", v)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package proxy
+
+import (
+	"io"
+	"net"
+)
+
+// SetHostOverride sends connections for hosts matching pattern to target
+// instead of the address DNS would return. The pattern may be an exact
+// hostname or a wildcard like "*.example.org", the target may be an IP
+// address or another hostname. Overrides are checked before any DNS lookup.
+func (p *Proxy) SetHostOverride(pattern, target string) error {
+	if err := p.hosts.Set(pattern, target); err != nil {
+		return err
+	}
+	p.closeIdleConnections()
+	return nil
+}
+
+// RemoveHostOverride removes the override for the given pattern.
+func (p *Proxy) RemoveHostOverride(pattern string) {
+	p.hosts.Remove(pattern)
+	p.closeIdleConnections()
+}
+
+// HostOverrides returns the current host overrides.
+func (p *Proxy) HostOverrides() map[string]string {
+	return p.hosts.All()
+}
+
+// LoadHostOverrides reads host overrides in hosts file format (a target
+// followed by one or more patterns on each line).
+func (p *Proxy) LoadHostOverrides(r io.Reader) error {
+	if err := p.hosts.Load(r); err != nil {
+		return err
+	}
+	p.closeIdleConnections()
+	return nil
+}
+
+// hostOverride returns a description of the override that applies to host,
+// if any.
+func (p *Proxy) hostOverride(host string) string {
+	target, pattern, ok := p.hosts.Lookup(host)
+	if !ok {
+		return ""
+	}
+	return pattern + " -> " + target
+}
+
+// overrideAddr applies host overrides to addr (host:port).
+func (p *Proxy) overrideAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if target, _, ok := p.hosts.Lookup(host); ok {
+		return net.JoinHostPort(target, port)
+	}
+	return addr
+}
+
+// closeIdleConnections drops pooled upstream connections, so new settings
+// apply to the next request.
+func (p *Proxy) closeIdleConnections() {
+	if t, ok := p.rt.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
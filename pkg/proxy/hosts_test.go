@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHostOverride(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Host))
+	}))
+	defer srv.Close()
+
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	p := NewProxy()
+
+	logger := &upstreamConnLogger{}
+	p.AddLogger(logger)
+
+	if err := p.SetHostOverride("*.example.test", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://api.example.test:"+port+"/", nil)
+	wri := httptest.NewRecorder()
+	p.ServeHTTP(wri, req)
+
+	if wri.Body.String() != "api.example.test:"+port {
+		t.Fatalf("unexpected response %q", wri.Body.String())
+	}
+	if logger.info == nil || logger.info.Override != "*.example.test -> 127.0.0.1" {
+		t.Fatalf("expecting override to be recorded, got %v", logger.info)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+)
+
+// SetKeyLogWriter sets a writer where TLS master secrets of both client and
+// upstream connections are written in NSS key log format. Tools like
+// Wireshark can use it to decrypt packet captures of the proxied traffic.
+func (p *Proxy) SetKeyLogWriter(w io.Writer) {
+	p.keyLogMu.Lock()
+	defer p.keyLogMu.Unlock()
+
+	p.keyLog = w
+}
+
+func (p *Proxy) keyLogEnabled() bool {
+	p.keyLogMu.Lock()
+	defer p.keyLogMu.Unlock()
+
+	return p.keyLog != nil
+}
+
+// keyLogWriter forwards key log lines to the proxy's key log and remembers
+// the client random of the session they belong to.
+type keyLogWriter struct {
+	p      *Proxy
+	random *string
+}
+
+func (w *keyLogWriter) Write(line []byte) (int, error) {
+	if *w.random == "" {
+		// <label> <client random> <secret>
+		if fields := bytes.Fields(line); len(fields) == 3 {
+			*w.random = string(fields[1])
+		}
+	}
+
+	w.p.keyLogMu.Lock()
+	defer w.p.keyLogMu.Unlock()
+
+	if w.p.keyLog == nil {
+		return len(line), nil
+	}
+	return w.p.keyLog.Write(line)
+}
+
+// onCloseConn calls a function after the connection is closed.
+type onCloseConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func (c *onCloseConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.onClose)
+	return err
+}
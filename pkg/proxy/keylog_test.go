@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/malfunkt/hyperfox/pkg/tlsinfo"
+)
+
+type upstreamConnLogger struct {
+	info *tlsinfo.ConnInfo
+}
+
+func (l *upstreamConnLogger) Log(pr *ProxiedRequest) error {
+	l.info = tlsinfo.UpstreamConnFromContext(pr.Response.Request.Context())
+	return nil
+}
+
+func TestKeyLog(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	keyLog := bytes.NewBuffer(nil)
+
+	p := NewProxy()
+	p.SetKeyLogWriter(keyLog)
+	if err := p.SetUpstreamTLS("*", &UpstreamTLS{RootCAs: []*x509.Certificate{srv.Certificate()}}); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := &upstreamConnLogger{}
+	p.AddLogger(logger)
+
+	req := httptest.NewRequest("GET", srv.URL, nil)
+	req.Host = srv.Listener.Addr().String()
+	req.URL.Host = ""
+
+	wri := httptest.NewRecorder()
+	p.ServeHTTP(wri, req)
+
+	if wri.Body.String() != "hello" {
+		t.Fatalf("unexpected response %q", wri.Body.String())
+	}
+
+	info := logger.info
+	if info == nil {
+		t.Fatal("expecting upstream connection info")
+	}
+	if info.RemoteAddr != srv.Listener.Addr().String() {
+		t.Fatalf("unexpected remote address %q", info.RemoteAddr)
+	}
+	if info.Random == "" {
+		t.Fatal("expecting client random")
+	}
+	if !bytes.Contains(keyLog.Bytes(), []byte(" "+info.Random+" ")) {
+		t.Fatalf("client random %q not found in key log:\n%s", info.Random, keyLog.String())
+	}
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOriginalDstWithoutRedirect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Without conntrack there's no original destination, with it the
+	// original destination is the address the client connected to.
+	if addr, err := originalDst(conn); err == nil && addr.String() != ln.Addr().String() {
+		t.Fatalf("expecting %v, got %v", ln.Addr(), addr)
+	}
+
+	if _, err := originalDst(pipeConn{}); err == nil {
+		t.Fatal("expecting an error for a connection without a file descriptor")
+	}
+}
@@ -23,7 +23,6 @@
 package proxy
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
@@ -33,13 +32,19 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/miekg/dns"
-
+	"github.com/google/uuid"
 	"github.com/malfunkt/hyperfox/pkg/gencert"
 	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+	"github.com/malfunkt/hyperfox/pkg/resolver"
+	"github.com/malfunkt/hyperfox/pkg/tlsinfo"
 )
 
 const (
@@ -88,12 +93,21 @@ type Logger interface {
 	Log(*ProxiedRequest) error
 }
 
+// HandshakeLogger interface gets notified when the proxy can't complete a
+// TLS handshake with a client.
+//
+// client -> (handshake error) -> HandshakeLogger
+type HandshakeLogger interface {
+	LogHandshakeError(net.Conn, *tlsinfo.ClientHello, error) error
+}
+
 // Proxy struct provides methods and properties for creating a proxy
 // programatically.
 type Proxy struct {
-	ln net.Listener
-	// Standard HTTP server
-	srv http.Server
+	// Standard HTTP servers and their listeners.
+	servers   []*http.Server
+	listeners []net.Listener
+	serversMu sync.Mutex
 	// RoundTrip to proxied service
 	rt http.RoundTripper
 	// Writer functions.
@@ -104,8 +118,26 @@ type Proxy struct {
 	interceptors []Interceptor
 	// Logger functions.
 	loggers []Logger
-	// Custom DNS server
-	dnsServer string
+	// HandshakeLogger functions.
+	handshakeLoggers []HandshakeLogger
+	// Certificate name for clients that don't send SNI.
+	defaultServerName string
+	// Custom DNS resolver
+	resolver *resolver.Resolver
+	// Static host overrides
+	hosts *resolver.Hosts
+	// Upstream TLS settings by host pattern.
+	upstreamTLS map[string]*upstreamSettings
+	upstreamMu  sync.RWMutex
+	// TLS client connections, by underlying net.Conn.
+	clientConns sync.Map
+	// TLS upstream connections, by *tls.Conn.
+	upstreamConns sync.Map
+	// Key log for TLS secrets.
+	keyLog   io.Writer
+	keyLogMu sync.Mutex
+	// Headers added to forwarded messages.
+	forwarding Forwarding
 }
 
 // ProxiedRequest struct provides properties for executing a *http.Request and
@@ -114,11 +146,33 @@ type ProxiedRequest struct {
 	ResponseWriter http.ResponseWriter
 	Request        *http.Request
 	Response       *http.Response
+
+	// ID identifies the exchange, it's also the UUID of its capture record.
+	ID string
+	// Start is when the request was received and End is when the response
+	// was sent to the client.
+	Start time.Time
+	End   time.Time
+	// BytesIn is the size of the request body and BytesOut is the size of
+	// the response body sent to the client.
+	BytesIn  int64
+	BytesOut int64
+	// Upstream describes the connection to the destination.
+	Upstream *tlsinfo.ConnInfo
+	// Interim holds the informational (1xx) responses that were received
+	// before Response.
+	Interim []*http.Response
 }
 
 // NewProxy creates and returns a Proxy reference.
 func NewProxy() *Proxy {
-	return &Proxy{}
+	p := &Proxy{
+		hosts: resolver.NewHosts(),
+	}
+	// The transport is shared by all listeners, it reads the proxy settings
+	// when dialing.
+	p.rt = p.newTransport()
+	return p
 }
 
 // Reset clears the list of interfaces.
@@ -127,14 +181,60 @@ func (p *Proxy) Reset() {
 	p.directors = []Director{}
 	p.interceptors = []Interceptor{}
 	p.loggers = []Logger{}
+	p.handshakeLoggers = []HandshakeLogger{}
 }
 
-// Stop terminates a running proxy
+// Stop terminates a running proxy by closing its listeners, requests in
+// flight are not waited for.
 func (p *Proxy) Stop() {
-	if p.ln == nil {
-		return
+	p.serversMu.Lock()
+	defer p.serversMu.Unlock()
+
+	for _, ln := range p.listeners {
+		_ = ln.Close()
+	}
+}
+
+// Shutdown stops accepting connections and waits for in-flight exchanges to
+// finish. If ctx expires first, the remaining connections are closed and the
+// context's error is returned.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.serversMu.Lock()
+	servers := append([]*http.Server(nil), p.servers...)
+	p.serversMu.Unlock()
+
+	var err error
+	for _, srv := range servers {
+		if serr := srv.Shutdown(ctx); serr != nil && err == nil {
+			err = serr
+		}
+	}
+
+	if err != nil {
+		for _, srv := range servers {
+			_ = srv.Close()
+		}
+	}
+
+	if t, ok := p.rt.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+
+	return err
+}
+
+// serve accepts connections on ln until the proxy is stopped or shut down.
+func (p *Proxy) serve(srv *http.Server, ln net.Listener) error {
+	p.serversMu.Lock()
+	p.servers = append(p.servers, srv)
+	p.listeners = append(p.listeners, ln)
+	p.serversMu.Unlock()
+
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return err
 	}
-	_ = p.ln.Close()
+
+	return nil
 }
 
 // NewProxiedRequest creates and returns a ProxiedRequest reference.
@@ -142,6 +242,8 @@ func (p *Proxy) newProxiedRequest(w http.ResponseWriter, r *http.Request) *Proxi
 	return &ProxiedRequest{
 		ResponseWriter: w,
 		Request:        r,
+		ID:             uuid.New().String(),
+		Start:          time.Now(),
 	}
 }
 
@@ -169,6 +271,19 @@ func (p *Proxy) AddLogger(dir Logger) {
 	p.loggers = append(p.loggers, dir)
 }
 
+// AddHandshakeLogger appends a struct that satisfies the HandshakeLogger
+// interface to the list of handshake loggers.
+func (p *Proxy) AddHandshakeLogger(l HandshakeLogger) {
+	p.handshakeLoggers = append(p.handshakeLoggers, l)
+}
+
+// SetDefaultServerName sets the name used to forge certificates for TLS
+// clients that don't send SNI (e.g.: clients that connect by IP address).
+// When empty, the IP address the client connected to is used instead.
+func (p *Proxy) SetDefaultServerName(name string) {
+	p.defaultServerName = name
+}
+
 // copyHeader copies headers from one http.Header to another.
 // http://golang.org/src/pkg/net/http/httputil/reverseproxy.go#L72
 func copyHeader(dst http.Header, src http.Header) {
@@ -190,8 +305,9 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	pr := p.newProxiedRequest(w, r)
 
 	out := new(http.Request)
-	// Copy request.
+	// Copy request, the header is copied so the client's is left as sent.
 	*out = *r
+	out.Header = r.Header.Clone()
 
 	if r.TLS == nil {
 		out.URL.Scheme = "http"
@@ -199,13 +315,13 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		out.URL.Scheme = "https"
 	}
 
-	// Making sure the Host header is present.
+	// The transport sends out.Host as the Host header.
 	out.URL.Host = out.Host
-	out.Header.Add("Host", out.Host)
 
-	out.Proto = "HTTP/1.1"
-	out.ProtoMajor = 1
-	out.ProtoMinor = 1
+	p.outgoingHeader(out.Header, r)
+
+	// The version of HTTP is kept, the transport speaks the client's version
+	// to the server.
 	out.Close = false
 
 	// Walking over directors.
@@ -215,18 +331,45 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Intercepting request body.
-	body := bytes.NewBuffer(nil)
-	bodyCopy := bytes.NewBuffer(nil)
-
-	if out.Body != nil {
-		if _, err := io.Copy(io.MultiWriter(body, bodyCopy), out.Body); err != nil {
-			log.Printf("io.Copy: %q", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		out.Body.Close()
-		out.Body = ioutil.NopCloser(body)
+	// Tracing the upstream connection.
+	upstream := &tlsinfo.ConnInfo{
+		Override: p.hostOverride(out.URL.Hostname()),
+	}
+	pr.Upstream = upstream
+	trace := &httptrace.ClientTrace{
+		GotConn: func(conn httptrace.GotConnInfo) {
+			upstream.LocalAddr = conn.Conn.LocalAddr().String()
+			upstream.RemoteAddr = conn.Conn.RemoteAddr().String()
+			if v, ok := p.upstreamConns.Load(conn.Conn); ok {
+				upstream.Random = v.(*tlsinfo.ConnInfo).Random
+			}
+		},
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			pr.Interim = append(pr.Interim, &http.Response{
+				Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+				StatusCode: code,
+				Header:     http.Header(header).Clone(),
+			})
+
+			// Relaying the response to the client, its header is not cleared
+			// by WriteHeader.
+			h := w.Header()
+			copyHeader(h, http.Header(header))
+			removeHopHeaders(h)
+			w.WriteHeader(code)
+			clear(h)
+			return nil
+		},
+	}
+	ctx := tlsinfo.NewUpstreamConnContext(r.Context(), upstream)
+	out = out.WithContext(httptrace.WithClientTrace(ctx, trace))
+
+	// Intercepting request body, it's read from the client as the transport
+	// sends it, so servers that expect 100-continue get to answer first.
+	var body *requestBody
+	if out.Body != nil && out.Body != http.NoBody {
+		body = newRequestBody(out.Body)
+		out.Body = body
 	}
 
 	startTime := time.Now()
@@ -246,11 +389,6 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// (Response received).
 
-	// Resetting body (so it can be read later)
-	if out.Body != nil {
-		out.Body = ioutil.NopCloser(bodyCopy)
-	}
-
 	// Walking over interceptors.
 	for i := range p.interceptors {
 		if err := p.interceptors[i].Intercept(pr.Response); err != nil {
@@ -260,6 +398,18 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Copying response headers to the writer we are going to send to the client.
 	copyHeader(pr.ResponseWriter.Header(), pr.Response.Header)
+	p.incomingHeader(pr.ResponseWriter.Header(), pr.Response)
+
+	// Announcing trailers, the transport takes the Trailer header out of the
+	// response.
+	if len(pr.Response.Trailer) > 0 {
+		announced := make([]string, 0, len(pr.Response.Trailer))
+		for k := range pr.Response.Trailer {
+			announced = append(announced, k)
+		}
+		sort.Strings(announced)
+		pr.ResponseWriter.Header().Set("Trailer", strings.Join(announced, ", "))
+	}
 
 	// Copying response status.
 	pr.ResponseWriter.WriteHeader(pr.Response.StatusCode)
@@ -276,6 +426,8 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		if cwc, ok := w.(*capture.CaptureWriteCloser); ok {
 			cwc.Time = startTime
+			cwc.UUID = pr.ID
+			cwc.Interim = pr.Interim
 		}
 		ws = append(ws, w)
 	}
@@ -288,10 +440,26 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		writers = append(writers, ws[i])
 	}
 
-	if _, err := io.Copy(io.MultiWriter(writers...), pr.Response.Body); err != nil {
+	if pr.BytesOut, err = io.Copy(io.MultiWriter(writers...), pr.Response.Body); err != nil {
 		log.Printf("io.Copy: %q", err)
 	}
 
+	// Forwarding trailers, they're known once the body has been read.
+	for k, vv := range pr.Response.Trailer {
+		for _, v := range vv {
+			pr.ResponseWriter.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
+	pr.End = time.Now()
+
+	// Resetting body (so it can be read later), the transport may still be
+	// sending it if the server answered early.
+	if body != nil {
+		sent := body.wait()
+		pr.BytesIn = int64(sent.Len())
+		out.Body = ioutil.NopCloser(sent)
+	}
+
 	// Closing write closers.
 	for i := range ws {
 		if err := ws[i].Close(); err != nil {
@@ -308,75 +476,94 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (p *Proxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	if p.dnsServer != "" {
-		host, port, err := net.SplitHostPort(addr)
-		if err != nil {
-			return nil, err
-		}
-
-		msg := &dns.Msg{}
-		msg.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	addr = p.overrideAddr(addr)
 
-		client := dns.Client{}
-		resp, _, err := client.Exchange(msg, p.dnsServer)
-		if err != nil {
-			return nil, err
-		}
-
-		for _, ra := range resp.Answer {
-			if a, ok := ra.(*dns.A); ok {
-				addr = fmt.Sprintf("%s:%s", a.A.String(), port)
-				break
-			}
-		}
+	if p.resolver != nil {
+		return p.resolver.DialContext(ctx, network, addr)
 	}
 
 	d := &net.Dialer{}
-	return d.DialContext(ctx, "tcp", addr)
+	return d.DialContext(ctx, network, addr)
 }
 
-// SetCustomDNS sets a DNS server that bypasses the OS settings
-func (p *Proxy) SetCustomDNS(server string) error {
-	if server == "" {
-		return errors.New("server is empty")
-	}
-	host, port, err := net.SplitHostPort(server)
+// SetCustomDNS sets a DNS server that bypasses the OS settings. The server
+// may be a plain DNS server (host:port), a DNS-over-HTTPS URL
+// ("https://host/dns-query") or a DNS-over-TLS URL ("tls://host"), bootstrap
+// holds the addresses of encrypted servers given by hostname.
+func (p *Proxy) SetCustomDNS(server string, bootstrap ...net.IP) error {
+	r, err := resolver.NewWithOptions(server, resolver.Options{Bootstrap: bootstrap})
 	if err != nil {
-		server = fmt.Sprintf("%s:%d", server, 53)
-	} else {
-		server = fmt.Sprintf("%s:%s", host, port)
+		return err
 	}
-	p.dnsServer = server
+	p.resolver = r
 	return nil
 }
 
-// Start creates an HTTP proxy server that listens on the given address.
+// Start creates an HTTP proxy server that listens on the given address, it
+// returns nil after Shutdown.
 func (p *Proxy) Start(addr string) error {
-	p.srv = http.Server{
-		Addr:    addr,
-		Handler: p,
-	}
-	p.rt = &http.Transport{
-		DialContext: p.dialContext,
+	// Clients may speak cleartext HTTP/2 with prior knowledge.
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	srv := &http.Server{
+		Addr:        addr,
+		Handler:     p,
+		ConnContext: p.connContext,
+		Protocols:   protocols,
 	}
 
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
-	p.ln = ln
 
 	log.Printf("Listening for HTTP requests at %s\n", addr)
-	if err := p.srv.Serve(ln); err != nil {
-		return err
+	return p.serve(srv, ln)
+}
+
+// serverName returns the name of the certificate to forge for a client.
+func (p *Proxy) serverName(hello *tls.ClientHelloInfo) string {
+	if hello.ServerName != "" {
+		return hello.ServerName
+	}
+	if p.defaultServerName != "" {
+		return p.defaultServerName
 	}
+	if hello.Conn != nil {
+		// Connections redirected by iptables arrive at the proxy's own
+		// address, the client meant the original destination.
+		addr, err := originalDst(hello.Conn)
+		if err != nil {
+			addr, _ = hello.Conn.LocalAddr().(*net.TCPAddr)
+		}
+		if addr != nil && !addr.IP.IsUnspecified() {
+			return addr.IP.String()
+		}
+	}
+	return ""
+}
 
-	return nil
+func (p *Proxy) logHandshakeError(hello *tls.ClientHelloInfo, err error) {
+	for i := range p.handshakeLoggers {
+		if lerr := p.handshakeLoggers[i].LogHandshakeError(hello.Conn, tlsinfo.NewClientHello(hello), err); lerr != nil {
+			log.Printf("HandshakeLogger: %q", lerr)
+		}
+	}
 }
 
-func certificateLookup(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	cert, key, err := gencert.CreateKeyPair(clientHello.ServerName)
+func (p *Proxy) certificateLookup(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := p.serverName(hello)
+	if name == "" {
+		err := errors.New("client sent no SNI and no fallback name is available")
+		p.logHandshakeError(hello, err)
+		return nil, err
+	}
+
+	cert, key, err := gencert.CreateKeyPair(name)
 	if err != nil {
+		p.logHandshakeError(hello, err)
 		return nil, err
 	}
 
@@ -388,19 +575,87 @@ func certificateLookup(clientHello *tls.ClientHelloInfo) (*tls.Certificate, erro
 	return &tlsCert, nil
 }
 
-// StartTLS creates an HTTPs proxy server that listens on the given address.
+// clientConn holds information on a client connection that is filled in
+// during the TLS handshake.
+type clientConn struct {
+	hello *tlsinfo.ClientHello
+	info  *tlsinfo.ConnInfo
+}
+
+// connContext attaches information on a new client connection to its
+// context. TLS details are filled in during the handshake.
+func (p *Proxy) connContext(ctx context.Context, c net.Conn) context.Context {
+	info := &tlsinfo.ConnInfo{
+		LocalAddr:  c.LocalAddr().String(),
+		RemoteAddr: c.RemoteAddr().String(),
+	}
+	ctx = tlsinfo.NewClientConnContext(ctx, info)
+
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok {
+		return ctx
+	}
+	hello := &tlsinfo.ClientHello{}
+	p.clientConns.Store(tlsConn.NetConn(), &clientConn{hello: hello, info: info})
+	return tlsinfo.NewContext(ctx, hello)
+}
+
+func (p *Proxy) connState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		p.clientConns.Delete(tlsConn.NetConn())
+	}
+}
+
+// configForClient saves the client's ClientHello and, if key logging is
+// enabled, returns a copy of config that logs the session's secrets.
+func (p *Proxy) configForClient(config *tls.Config, hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	v, ok := p.clientConns.Load(hello.Conn)
+	if !ok {
+		// Use the default configuration.
+		return nil, nil
+	}
+
+	cc := v.(*clientConn)
+	*cc.hello = *tlsinfo.NewClientHello(hello)
+
+	if !p.keyLogEnabled() {
+		return nil, nil
+	}
+
+	config = config.Clone()
+	config.GetConfigForClient = nil
+	config.KeyLogWriter = &keyLogWriter{p: p, random: &cc.info.Random}
+	return config, nil
+}
+
+// StartTLS creates an HTTPs proxy server that listens on the given address,
+// it returns nil after Shutdown.
 func (p *Proxy) StartTLS(addr string) error {
 	cert, key := os.Getenv(EnvTLSCert), os.Getenv(EnvTLSKey)
 	gencert.SetRootCACert(cert)
 	gencert.SetRootCAKey(key)
 
-	srv := http.Server{
-		Addr:    addr,
-		Handler: p,
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+
+	srv := &http.Server{
+		Addr:        addr,
+		Handler:     p,
+		ConnContext: p.connContext,
+		ConnState:   p.connState,
+		Protocols:   protocols,
 	}
 
 	tlsConfig := &tls.Config{
-		GetCertificate: certificateLookup,
+		GetCertificate: p.certificateLookup,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		return p.configForClient(tlsConfig, hello)
 	}
 
 	ln, err := net.Listen("tcp", addr)
@@ -410,14 +665,6 @@ func (p *Proxy) StartTLS(addr string) error {
 
 	tlsListener := tls.NewListener(ln, tlsConfig)
 
-	p.srv = srv
-	p.ln = ln
-	p.rt = &http.Transport{}
-
 	log.Printf("Listening for HTTP requests at %s (SSL/TLS mode)\n", addr)
-	if err := p.srv.Serve(tlsListener); err != nil {
-		return err
-	}
-
-	return nil
+	return p.serve(srv, tlsListener)
 }
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const listenShutdownAddr = `127.0.0.1:13081`
+
+// startSlowUpstream starts a server that holds requests until release is
+// closed.
+func startSlowUpstream() (srv *httptest.Server, entered chan struct{}, release chan struct{}) {
+	entered = make(chan struct{}, 1)
+	release = make(chan struct{})
+
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		_, _ = w.Write([]byte("done"))
+	}))
+
+	return srv, entered, release
+}
+
+func startShutdownProxy(t *testing.T) (*Proxy, chan error) {
+	p := NewProxy()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- p.Start(listenShutdownAddr)
+	}()
+
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", listenShutdownAddr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	return p, stopped
+}
+
+type result struct {
+	body string
+	err  error
+}
+
+func proxiedGet(upstream string) chan result {
+	res := make(chan result, 1)
+
+	go func() {
+		req, _ := http.NewRequest("GET", "http://"+listenShutdownAddr+"/", nil)
+		req.Host = upstream
+
+		client := &http.Client{Transport: &http.Transport{}}
+		resp, err := client.Do(req)
+		if err != nil {
+			res <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		res <- result{body: string(body), err: err}
+	}()
+
+	return res
+}
+
+func TestShutdownWaitsForRequests(t *testing.T) {
+	upstream, entered, release := startSlowUpstream()
+	defer upstream.Close()
+
+	p, stopped := startShutdownProxy(t)
+
+	res := proxiedGet(upstream.Listener.Addr().String())
+	<-entered
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- p.Shutdown(ctx)
+	}()
+
+	// New connections are refused while the request is in flight.
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", listenShutdownAddr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if i == 50 {
+			t.Fatal("expecting the listener to be closed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	close(release)
+
+	if r := <-res; r.err != nil || r.body != "done" {
+		t.Fatalf("expecting the request to finish, got %q (%v)", r.body, r.err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("expecting Start to return nil, got %v", err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	upstream, entered, release := startSlowUpstream()
+	defer upstream.Close()
+	defer close(release)
+
+	p, stopped := startShutdownProxy(t)
+
+	res := proxiedGet(upstream.Listener.Addr().String())
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := p.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expecting deadline to be exceeded, got %v", err)
+	}
+	if r := <-res; r.err == nil {
+		t.Fatalf("expecting the request to be cut, got %q", r.body)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("expecting Start to return nil, got %v", err)
+	}
+}
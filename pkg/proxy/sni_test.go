@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/tlsinfo"
+)
+
+const listenNoSNIAddr = `127.0.0.1:13444`
+
+type testHandshakeLogger struct {
+	err error
+}
+
+func (l *testHandshakeLogger) LogHandshakeError(conn net.Conn, hello *tlsinfo.ClientHello, err error) error {
+	l.err = err
+	return nil
+}
+
+type pipeConn struct {
+	net.Conn
+}
+
+func (pipeConn) LocalAddr() net.Addr {
+	return &net.UnixAddr{Name: "@", Net: "unix"}
+}
+
+func peerCertificate(t *testing.T) *tls.ConnectionState {
+	conn, err := tls.Dial("tcp", listenNoSNIAddr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cs := conn.ConnectionState()
+	return &cs
+}
+
+func TestNoSNIFallback(t *testing.T) {
+	os.Setenv(EnvTLSCert, "../../ca/rootCA.crt")
+	os.Setenv(EnvTLSKey, "../../ca/rootCA.key")
+
+	p := NewProxy()
+	defer p.Stop()
+
+	go func() {
+		if err := p.StartTLS(listenNoSNIAddr); err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				t.Errorf("could not start TLS server: %v", err)
+			}
+		}
+	}()
+	time.Sleep(time.Millisecond * 200)
+
+	cs := peerCertificate(t)
+	if ips := cs.PeerCertificates[0].IPAddresses; len(ips) != 1 || ips[0].String() != "127.0.0.1" {
+		t.Fatalf("expecting IP certificate, got %v", ips)
+	}
+
+	p.SetDefaultServerName("fallback.example.org")
+
+	cs = peerCertificate(t)
+	if names := cs.PeerCertificates[0].DNSNames; len(names) != 1 || names[0] != "fallback.example.org" {
+		t.Fatalf("expecting certificate for default name, got %v", names)
+	}
+}
+
+func TestNoSNIHandshakeError(t *testing.T) {
+	p := NewProxy()
+
+	logger := &testHandshakeLogger{}
+	p.AddHandshakeLogger(logger)
+
+	if _, err := p.certificateLookup(&tls.ClientHelloInfo{Conn: pipeConn{}}); err == nil {
+		t.Fatal("expecting an error")
+	}
+	if logger.err == nil {
+		t.Fatal("expecting handshake error to be logged")
+	}
+}
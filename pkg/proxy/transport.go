@@ -0,0 +1,163 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// h2cProbeTimeout is how long a server has to answer the HTTP/2 connection
+// preface before it's taken for an HTTP/1.1 server.
+const h2cProbeTimeout = 5 * time.Second
+
+// transport sends requests upstream with the version of HTTP the client
+// used, so servers see traffic as the client sends it.
+type transport struct {
+	// http1 speaks HTTP/1.1, http2 negotiates HTTP/2 with TLS servers and
+	// falls back to HTTP/1.1, and h2c speaks cleartext HTTP/2 with prior
+	// knowledge.
+	http1 *http.Transport
+	http2 *http.Transport
+	h2c   *http.Transport
+
+	// dial connects to servers the way the transports do, it's used to find
+	// out whether cleartext servers speak HTTP/2.
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// h2cAddrs remembers whether the server at host:port speaks cleartext
+	// HTTP/2.
+	h2cAddrs sync.Map
+}
+
+// newTransport creates the http.RoundTripper used to reach upstream servers.
+func (p *Proxy) newTransport() *transport {
+	var http1, http2, h2c http.Protocols
+
+	http1.SetHTTP1(true)
+	http2.SetHTTP1(true)
+	http2.SetHTTP2(true)
+	h2c.SetUnencryptedHTTP2(true)
+
+	return &transport{
+		http1: p.newHTTPTransport(&http1, "http/1.1"),
+		http2: p.newHTTPTransport(&http2, "h2", "http/1.1"),
+		h2c:   p.newHTTPTransport(&h2c),
+		dial:  p.dialContext,
+	}
+}
+
+// newHTTPTransport creates an http.Transport that speaks the given
+// protocols, nextProtos are offered to TLS servers via ALPN.
+func (p *Proxy) newHTTPTransport(protocols *http.Protocols, nextProtos ...string) *http.Transport {
+	return &http.Transport{
+		DialContext: p.dialContext,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p.dialTLSContext(ctx, network, addr, nextProtos)
+		},
+		Protocols: protocols,
+		// Request bodies wait for the server to agree to receive them when
+		// the client sent Expect: 100-continue.
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+func (t *transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.ProtoMajor != 2 {
+		return t.http1.RoundTrip(r)
+	}
+	if r.URL.Scheme == "http" {
+		ok, err := t.speaksH2C(r.Context(), r.URL)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// The client's HTTP/2 request is sent to the server as HTTP/1.1.
+			return t.http1.RoundTrip(r)
+		}
+		return t.h2c.RoundTrip(r)
+	}
+	return t.http2.RoundTrip(r)
+}
+
+// speaksH2C tells whether the cleartext server of u accepts HTTP/2 with
+// prior knowledge, definite answers are remembered until the next call to
+// CloseIdleConnections.
+func (t *transport) speaksH2C(ctx context.Context, u *url.URL) (bool, error) {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+
+	if v, ok := t.h2cAddrs.Load(addr); ok {
+		return v.(bool), nil
+	}
+
+	conn, err := t.dial(ctx, "tcp", addr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(h2cProbeTimeout))
+
+	// HTTP/2 servers answer the connection preface with a SETTINGS frame,
+	// HTTP/1.1 servers reject it as a malformed request or hang up.
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		return false, nil
+	}
+	if err := http2.NewFramer(conn, nil).WriteSettings(); err != nil {
+		return false, nil
+	}
+
+	var hdr [9]byte
+	n, err := io.ReadFull(conn, hdr[:])
+	switch {
+	case n == len(hdr) && http2.FrameType(hdr[3]) == http2.FrameSettings:
+		t.h2cAddrs.Store(addr, true)
+		return true, nil
+	case bytes.HasPrefix(hdr[:n], []byte("HTTP/")), n == 0 && err == io.EOF:
+		t.h2cAddrs.Store(addr, false)
+	}
+	// Timeouts and other errors say nothing about the server, it's asked
+	// again by the next request.
+	return false, nil
+}
+
+// CloseIdleConnections closes the idle connections of all transports and
+// forgets which servers speak cleartext HTTP/2, as they may now be reached at
+// other addresses.
+func (t *transport) CloseIdleConnections() {
+	t.h2cAddrs.Clear()
+	t.http1.CloseIdleConnections()
+	t.http2.CloseIdleConnections()
+	t.h2c.CloseIdleConnections()
+}
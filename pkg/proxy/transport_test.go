@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	listenH2Addr  = `127.0.0.1:13445`
+	listenH2CAddr = `127.0.0.1:13082`
+	listenH1Addr  = `127.0.0.1:13084`
+)
+
+type protoLogger struct {
+	proto string
+}
+
+func (l *protoLogger) Log(pr *ProxiedRequest) error {
+	l.proto = pr.Response.Proto
+	return nil
+}
+
+// protoHandler answers with the version of HTTP of the request and a
+// trailer.
+var protoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Trailer", "Grpc-Status")
+	_, _ = w.Write([]byte(r.Proto))
+	w.Header().Set("Grpc-Status", "0")
+})
+
+func waitForListener(t *testing.T, addr string) {
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func proxiedProto(t *testing.T, client *http.Client, url, host string) (string, http.Header) {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Host = host
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Proto != string(body) {
+		t.Fatalf("client spoke %s but server got %s", res.Proto, body)
+	}
+	return string(body), res.Trailer
+}
+
+func TestHTTP2(t *testing.T) {
+	os.Setenv(EnvTLSCert, "../../ca/rootCA.crt")
+	os.Setenv(EnvTLSKey, "../../ca/rootCA.key")
+
+	upstream := httptest.NewUnstartedServer(protoHandler)
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	p := NewProxy()
+	defer p.Stop()
+
+	logger := &protoLogger{}
+	p.AddLogger(logger)
+
+	if err := p.SetUpstreamTLS("127.0.0.1", &UpstreamTLS{RootCAs: []*x509.Certificate{upstream.Certificate()}}); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		if err := p.StartTLS(listenH2Addr); err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				t.Errorf("could not start TLS server: %v", err)
+			}
+		}
+	}()
+	waitForListener(t, listenH2Addr)
+
+	for _, proto := range []string{"HTTP/2.0", "HTTP/1.1"} {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: proto == "HTTP/2.0",
+		}}
+
+		got, trailer := proxiedProto(t, client, "https://"+listenH2Addr+"/", upstream.Listener.Addr().String())
+		if got != proto || logger.proto != proto {
+			t.Fatalf("expecting %s, got %s from the client and %s from the server", proto, got, logger.proto)
+		}
+		if trailer.Get("Grpc-Status") != "0" {
+			t.Fatalf("expecting trailer, got %v", trailer)
+		}
+	}
+}
+
+func TestH2C(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(protoHandler)
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetHTTP1(true)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+
+	p := NewProxy()
+	defer p.Stop()
+
+	go func() {
+		if err := p.Start(listenH2CAddr); err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				t.Errorf("could not start HTTP server: %v", err)
+			}
+		}
+	}()
+	waitForListener(t, listenH2CAddr)
+
+	h2c := new(http.Protocols)
+	h2c.SetUnencryptedHTTP2(true)
+
+	for proto, client := range map[string]*http.Client{
+		"HTTP/2.0": {Transport: &http.Transport{Protocols: h2c}},
+		"HTTP/1.1": {Transport: &http.Transport{}},
+	} {
+		got, trailer := proxiedProto(t, client, "http://"+listenH2CAddr+"/", upstream.Listener.Addr().String())
+		if got != proto {
+			t.Fatalf("expecting %s, got %s", proto, got)
+		}
+		if trailer.Get("Grpc-Status") != "0" {
+			t.Fatalf("expecting trailer, got %v", trailer)
+		}
+	}
+}
+
+func TestH2CFallback(t *testing.T) {
+	upstream := httptest.NewServer(protoHandler)
+	defer upstream.Close()
+
+	p := NewProxy()
+	defer p.Stop()
+
+	logger := &protoLogger{}
+	p.AddLogger(logger)
+
+	go func() {
+		if err := p.Start(listenH1Addr); err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				t.Errorf("could not start HTTP server: %v", err)
+			}
+		}
+	}()
+	waitForListener(t, listenH1Addr)
+
+	h2c := new(http.Protocols)
+	h2c.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: h2c}}
+
+	// The client speaks HTTP/2 to the proxy and the proxy HTTP/1.1 to the
+	// server.
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "http://"+listenH1Addr+"/", nil)
+		req.Host = upstream.Listener.Addr().String()
+
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != http.StatusOK || res.Proto != "HTTP/2.0" {
+			t.Fatalf("expecting 200 over HTTP/2.0, got %d over %s", res.StatusCode, res.Proto)
+		}
+		if string(body) != "HTTP/1.1" || logger.proto != "HTTP/1.1" {
+			t.Fatalf("expecting HTTP/1.1 upstream, got %s from the client and %s from the server", body, logger.proto)
+		}
+	}
+}
+
+func TestH2CProbe(t *testing.T) {
+	tr := NewProxy().newTransport()
+	ctx := context.Background()
+
+	h1 := httptest.NewServer(protoHandler)
+	defer h1.Close()
+
+	h2c := httptest.NewUnstartedServer(protoHandler)
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+
+	// A server that resets connections gives no answer.
+	reset, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reset.Close()
+	go func() {
+		for {
+			conn, err := reset.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	}()
+
+	for _, c := range []struct {
+		addr   string
+		h2c    bool
+		cached bool
+	}{
+		{h1.Listener.Addr().String(), false, true},
+		{h2c.Listener.Addr().String(), true, true},
+		{reset.Addr().String(), false, false},
+	} {
+		ok, err := tr.speaksH2C(ctx, &url.URL{Scheme: "http", Host: c.addr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != c.h2c {
+			t.Fatalf("%s: expecting %v, got %v", c.addr, c.h2c, ok)
+		}
+		if _, cached := tr.h2cAddrs.Load(c.addr); cached != c.cached {
+			t.Fatalf("%s: expecting cached to be %v", c.addr, c.cached)
+		}
+	}
+
+	tr.CloseIdleConnections()
+	if _, cached := tr.h2cAddrs.Load(h2c.Listener.Addr().String()); cached {
+		t.Fatal("expecting answers to be forgotten")
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/malfunkt/hyperfox/pkg/tlsinfo"
+)
+
+// UpstreamTLS defines how the proxy establishes TLS sessions with an upstream
+// server.
+type UpstreamTLS struct {
+	// RootCAs are trusted in addition to the system roots.
+	RootCAs []*x509.Certificate
+	// InsecureSkipVerify disables verification of the upstream certificate.
+	InsecureSkipVerify bool
+	// MinVersion and MaxVersion limit the negotiated TLS version, zero means
+	// Go's default.
+	MinVersion uint16
+	MaxVersion uint16
+	// Certificates are presented to servers that request a client
+	// certificate.
+	Certificates []tls.Certificate
+	// ServerName overrides the SNI sent to the server, the certificate is
+	// still verified against the original hostname.
+	ServerName string
+}
+
+// upstreamSettings holds the settings given to SetUpstreamTLS along with the
+// roots they trust, so the pool is built once.
+type upstreamSettings struct {
+	*UpstreamTLS
+	roots *x509.CertPool
+}
+
+func validHostPattern(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		pattern = pattern[2:]
+	}
+	return pattern != "" && !strings.ContainsAny(pattern, "*:/ ")
+}
+
+// SetUpstreamTLS sets the TLS settings for upstream servers matching the
+// given pattern. A pattern may be an exact hostname, a wildcard like
+// "*.example.org" (matching any subdomain) or "*" (matching all hosts).
+// Exact matches take precedence over wildcards. RootCAs are read once, when
+// the settings are set.
+func (p *Proxy) SetUpstreamTLS(pattern string, settings *UpstreamTLS) error {
+	pattern = strings.ToLower(pattern)
+	if !validHostPattern(pattern) {
+		return errors.New("invalid host pattern")
+	}
+	if settings == nil {
+		return errors.New("missing settings")
+	}
+
+	s := &upstreamSettings{UpstreamTLS: settings}
+	if len(settings.RootCAs) > 0 {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		for _, cert := range settings.RootCAs {
+			roots.AddCert(cert)
+		}
+		s.roots = roots
+	}
+
+	p.upstreamMu.Lock()
+	defer p.upstreamMu.Unlock()
+
+	if p.upstreamTLS == nil {
+		p.upstreamTLS = map[string]*upstreamSettings{}
+	}
+	p.upstreamTLS[pattern] = s
+	return nil
+}
+
+// RemoveUpstreamTLS removes the TLS settings for the given pattern.
+func (p *Proxy) RemoveUpstreamTLS(pattern string) {
+	p.upstreamMu.Lock()
+	defer p.upstreamMu.Unlock()
+
+	delete(p.upstreamTLS, strings.ToLower(pattern))
+}
+
+// lookupUpstreamTLS returns the settings that apply to the given host, or
+// nil.
+func (p *Proxy) lookupUpstreamTLS(host string) *upstreamSettings {
+	p.upstreamMu.RLock()
+	defer p.upstreamMu.RUnlock()
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if settings, ok := p.upstreamTLS[host]; ok {
+		return settings
+	}
+	for name := host; ; {
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+		if settings, ok := p.upstreamTLS["*."+name]; ok {
+			return settings
+		}
+	}
+	return p.upstreamTLS["*"]
+}
+
+// upstreamTLSConfig builds a *tls.Config for connecting to the given host.
+func (p *Proxy) upstreamTLSConfig(host string) *tls.Config {
+	config := &tls.Config{
+		ServerName: host,
+	}
+
+	settings := p.lookupUpstreamTLS(host)
+	if settings == nil {
+		return config
+	}
+
+	config.MinVersion = settings.MinVersion
+	config.MaxVersion = settings.MaxVersion
+	config.Certificates = settings.Certificates
+	config.InsecureSkipVerify = settings.InsecureSkipVerify
+	config.RootCAs = settings.roots
+
+	if settings.ServerName != "" && settings.ServerName != host {
+		config.ServerName = settings.ServerName
+		if !settings.InsecureSkipVerify {
+			// Verify against the original hostname instead of the overridden
+			// SNI.
+			roots := config.RootCAs
+			config.InsecureSkipVerify = true
+			config.VerifyConnection = func(cs tls.ConnectionState) error {
+				if len(cs.PeerCertificates) == 0 {
+					return errors.New("missing server certificate")
+				}
+				opts := x509.VerifyOptions{
+					DNSName:       host,
+					Roots:         roots,
+					Intermediates: x509.NewCertPool(),
+				}
+				for _, cert := range cs.PeerCertificates[1:] {
+					opts.Intermediates.AddCert(cert)
+				}
+				_, err := cs.PeerCertificates[0].Verify(opts)
+				return err
+			}
+		}
+	}
+
+	return config
+}
+
+// dialTLSContext establishes a TLS session with an upstream server, offering
+// nextProtos via ALPN.
+func (p *Proxy) dialTLSContext(ctx context.Context, network, addr string, nextProtos []string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := p.upstreamTLSConfig(host)
+	config.NextProtos = nextProtos
+
+	conn, err := p.dialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.keyLogEnabled() {
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+
+	info := &tlsinfo.ConnInfo{}
+	config.KeyLogWriter = &keyLogWriter{p: p, random: &info.Random}
+
+	occ := &onCloseConn{Conn: conn}
+	tlsConn := tls.Client(occ, config)
+	occ.onClose = func() {
+		p.upstreamConns.Delete(tlsConn)
+	}
+
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.upstreamConns.Store(tlsConn, info)
+
+	return tlsConn, nil
+}
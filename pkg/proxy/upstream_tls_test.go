@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpstreamTLSLookup(t *testing.T) {
+	p := NewProxy()
+
+	exact := &UpstreamTLS{ServerName: "exact"}
+	wildcard := &UpstreamTLS{ServerName: "wildcard"}
+	fallback := &UpstreamTLS{ServerName: "fallback"}
+
+	if err := p.SetUpstreamTLS("api.example.org", exact); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetUpstreamTLS("*.Example.org", wildcard); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetUpstreamTLS("*", fallback); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetUpstreamTLS("api.*.org", fallback); err == nil {
+		t.Fatal("expecting invalid pattern error")
+	}
+
+	cases := map[string]*UpstreamTLS{
+		"api.example.org":    exact,
+		"API.example.org.":   exact,
+		"www.example.org":    wildcard,
+		"a.b.example.org":    wildcard,
+		"example.org":        fallback,
+		"golang.org":         fallback,
+		"api.example.org.uk": fallback,
+	}
+	for host, expected := range cases {
+		if got := p.lookupUpstreamTLS(host); got == nil || got.UpstreamTLS != expected {
+			t.Errorf("%s: unexpected settings %v", host, got)
+		}
+	}
+
+	p.RemoveUpstreamTLS("*")
+	if got := p.lookupUpstreamTLS("golang.org"); got != nil {
+		t.Errorf("expecting no settings, got %v", got)
+	}
+}
+
+func TestUpstreamTLSTrust(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	p := NewProxy()
+	rt := p.newTransport()
+
+	get := func() error {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		res, err := rt.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		rt.CloseIdleConnections()
+		return nil
+	}
+
+	if err := get(); err == nil {
+		t.Fatal("expecting an unknown authority error")
+	}
+
+	settings := &UpstreamTLS{
+		RootCAs:      []*x509.Certificate{srv.Certificate()},
+		Certificates: srv.TLS.Certificates,
+	}
+	if err := p.SetUpstreamTLS("127.0.0.1", settings); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The roots are shared by all connections to the host.
+	if roots := p.upstreamTLSConfig("127.0.0.1").RootCAs; roots == nil || roots != p.upstreamTLSConfig("127.0.0.1").RootCAs {
+		t.Fatal("expecting the same pool of roots for every connection")
+	}
+
+	// SNI override must still verify the certificate against the real host.
+	settings.ServerName = "sni.example.org"
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+
+	// No client certificate.
+	settings.Certificates = nil
+	if err := get(); err == nil {
+		t.Fatal("expecting handshake error")
+	}
+
+	if err := p.SetUpstreamTLS("127.0.0.1", &UpstreamTLS{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(); err == nil {
+		t.Fatal("expecting handshake error")
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsMessageType = "application/dns-message"
+	// maxDoHResponseSize is the largest answer accepted from a DoH server.
+	maxDoHResponseSize = 65535
+	// encryptedTimeout limits queries when the context has no deadline.
+	encryptedTimeout = time.Second * 10
+	// maxIdleDoTConns is how many connections to a DoT server are kept open
+	// for later queries.
+	maxIdleDoTConns = 4
+)
+
+// Options configures the transport used to reach a DNS server.
+type Options struct {
+	// Bootstrap holds the addresses of the DNS server, they're used instead
+	// of resolving the hostname of a DoH or DoT server with the OS resolver.
+	Bootstrap []net.IP
+	// RootCAs verifies the certificate of a DoH or DoT server, the system
+	// roots are used if nil.
+	RootCAs *x509.CertPool
+}
+
+// NewExchangerWithOptions creates an Exchanger for server, which may be a
+// plain DNS server (host:port), a DNS-over-HTTPS URL
+// ("https://dns.example/dns-query", RFC 8484) or a DNS-over-TLS URL
+// ("tls://dns.example", RFC 7858).
+func NewExchangerWithOptions(server string, opts Options) (Exchanger, error) {
+	u, err := url.Parse(server)
+	if err != nil || u.Host == "" {
+		return newUDPExchanger(server)
+	}
+
+	switch u.Scheme {
+	case "udp", "dns":
+		return newUDPExchanger(u.Host)
+	case "https":
+		return newDoHExchanger(u, opts), nil
+	case "tls":
+		return newDoTExchanger(u, opts)
+	}
+	return nil, fmt.Errorf("unsupported DNS server scheme %q", u.Scheme)
+}
+
+// NewWithOptions creates a Resolver that queries the given DNS server, see
+// NewExchangerWithOptions.
+func NewWithOptions(server string, opts Options) (*Resolver, error) {
+	exchanger, err := NewExchangerWithOptions(server, opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithExchanger(exchanger), nil
+}
+
+// bootstrapDialer connects to a DNS server using its bootstrap addresses, if
+// any.
+type bootstrapDialer struct {
+	bootstrap []net.IP
+}
+
+func (b bootstrapDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	if len(b.bootstrap) == 0 {
+		return d.DialContext(ctx, network, addr)
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	return dialSerial(ctx, network, port, b.bootstrap)
+}
+
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, encryptedTimeout)
+}
+
+// dohExchanger sends queries to a DNS-over-HTTPS server.
+type dohExchanger struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHExchanger(u *url.URL, opts Options) *dohExchanger {
+	if u.Path == "" {
+		u.Path = "/dns-query"
+	}
+	return &dohExchanger{
+		url: u.String(),
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:         bootstrapDialer{bootstrap: opts.Bootstrap}.DialContext,
+				TLSClientConfig:     &tls.Config{RootCAs: opts.RootCAs},
+				TLSHandshakeTimeout: encryptedTimeout,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: 4,
+			},
+		},
+	}
+}
+
+func (e *dohExchanger) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// The ID is always zero so answers can be cached by HTTP caches.
+	query := msg.Copy()
+	query.Id = 0
+
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: unexpected status %q", res.Status)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != dnsMessageType {
+		return nil, fmt.Errorf("doh: unexpected content type %q", ct)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxDoHResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxDoHResponseSize {
+		return nil, errors.New("doh: answer is too large")
+	}
+
+	answer := &dns.Msg{}
+	if err := answer.Unpack(body); err != nil {
+		return nil, err
+	}
+	answer.Id = msg.Id
+
+	return answer, nil
+}
+
+// dotExchanger sends queries to a DNS-over-TLS server, connections are
+// reused as recommended by RFC 7858.
+type dotExchanger struct {
+	addr   string
+	dialer bootstrapDialer
+	config *tls.Config
+
+	mu   sync.Mutex
+	idle []*dns.Conn
+}
+
+func newDoTExchanger(u *url.URL, opts Options) (*dotExchanger, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "853")
+	}
+	if u.Path != "" && u.Path != "/" {
+		return nil, errors.New("dot: unexpected path")
+	}
+	return &dotExchanger{
+		addr:   addr,
+		dialer: bootstrapDialer{bootstrap: opts.Bootstrap},
+		config: &tls.Config{
+			ServerName: u.Hostname(),
+			RootCAs:    opts.RootCAs,
+		},
+	}, nil
+}
+
+func (e *dotExchanger) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// The server may have closed an idle connection, the query is sent again
+	// over a new one.
+	if conn := e.idleConn(); conn != nil {
+		if res, err := e.exchange(ctx, conn, msg); err == nil {
+			return res, nil
+		}
+	}
+
+	conn, err := e.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return e.exchange(ctx, conn, msg)
+}
+
+func (e *dotExchanger) dial(ctx context.Context) (*dns.Conn, error) {
+	rawConn, err := e.dialer.DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = rawConn.SetDeadline(deadline)
+	}
+
+	tlsConn := tls.Client(rawConn, e.config)
+	if err := tlsConn.Handshake(); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return &dns.Conn{Conn: tlsConn}, nil
+}
+
+// exchange sends msg over conn and keeps conn for later queries if it got an
+// answer, conn is closed otherwise.
+func (e *dotExchanger) exchange(ctx context.Context, conn *dns.Conn, msg *dns.Msg) (*dns.Msg, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if err := conn.WriteMsg(msg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res, err := conn.ReadMsg()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	e.putIdleConn(conn)
+	return res, nil
+}
+
+func (e *dotExchanger) idleConn() *dns.Conn {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	n := len(e.idle)
+	if n == 0 {
+		return nil
+	}
+	conn := e.idle[n-1]
+	e.idle = e.idle[:n-1]
+	return conn
+}
+
+func (e *dotExchanger) putIdleConn(conn *dns.Conn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.idle) >= maxIdleDoTConns {
+		conn.Close()
+		return
+	}
+	e.idle = append(e.idle, conn)
+}
@@ -0,0 +1,262 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// msgWriter is a dns.ResponseWriter that keeps the message written to it.
+type msgWriter struct {
+	msg *dns.Msg
+}
+
+func (w *msgWriter) LocalAddr() net.Addr         { return &net.TCPAddr{} }
+func (w *msgWriter) RemoteAddr() net.Addr        { return &net.TCPAddr{} }
+func (w *msgWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *msgWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *msgWriter) Close() error                { return nil }
+func (w *msgWriter) TsigStatus() error           { return nil }
+func (w *msgWriter) TsigTimersOnly(bool)         {}
+func (w *msgWriter) Hijack()                     {}
+
+// startDoHServer starts a DoH stand-in that answers with srv, its
+// certificate is valid for example.com and 127.0.0.1.
+func startDoHServer(t *testing.T, srv *testServer) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dnsMessageType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+
+		req := &dns.Msg{}
+		if err := req.Unpack(body); err != nil || req.Id != 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		mw := &msgWriter{}
+		srv.ServeDNS(mw, req)
+
+		buf, err := mw.msg.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dnsMessageType)
+		_, _ = w.Write(buf)
+	}))
+}
+
+// startDoTServer starts a DoT stand-in that answers with srv, using the same
+// certificate as doh.
+func startDoTServer(t *testing.T, srv *testServer, doh *httptest.Server) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	s := &dns.Server{
+		Listener:          tls.NewListener(ln, doh.TLS),
+		Handler:           srv,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go func() { _ = s.ActivateAndServe() }()
+	<-started
+
+	return ln.Addr().String(), func() { _ = s.Shutdown() }
+}
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func TestDoTConnReuse(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	doh := startDoHServer(t, srv)
+	defer doh.Close()
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := &countingListener{Listener: tcp}
+
+	started := make(chan struct{})
+	s := &dns.Server{
+		Listener:          tls.NewListener(ln, doh.TLS),
+		Handler:           srv,
+		NotifyStartedFunc: func() { close(started) },
+		IdleTimeout:       func() time.Duration { return time.Millisecond * 200 },
+	}
+	go func() { _ = s.ActivateAndServe() }()
+	<-started
+	defer func() { _ = s.Shutdown() }()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(doh.Certificate())
+
+	e, err := NewExchangerWithOptions("tls://"+tcp.Addr().String(), Options{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	exchange := func() {
+		msg := &dns.Msg{}
+		msg.SetQuestion("a.test.", dns.TypeA)
+		res, err := e.Exchange(ctx, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Answer) != 1 {
+			t.Fatalf("unexpected answer %v", res)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		exchange()
+	}
+	if n := atomic.LoadInt32(&ln.accepted); n != 1 {
+		t.Fatalf("expecting queries to share one connection, got %d", n)
+	}
+
+	// Connections closed by the server are replaced.
+	time.Sleep(time.Millisecond * 400)
+	exchange()
+	if n := atomic.LoadInt32(&ln.accepted); n != 2 {
+		t.Fatalf("expecting a new connection, got %d", n)
+	}
+}
+
+func TestEncryptedLookup(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	doh := startDoHServer(t, srv)
+	defer doh.Close()
+
+	dotAddr, stopDoT := startDoTServer(t, srv, doh)
+	defer stopDoT()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(doh.Certificate())
+
+	_, dohPort, _ := net.SplitHostPort(doh.Listener.Addr().String())
+	_, dotPort, _ := net.SplitHostPort(dotAddr)
+
+	bootstrap := []net.IP{net.IPv4(127, 0, 0, 1)}
+
+	servers := []struct {
+		url  string
+		opts Options
+	}{
+		{"https://127.0.0.1:" + dohPort + "/dns-query", Options{RootCAs: roots}},
+		{"https://example.com:" + dohPort, Options{RootCAs: roots, Bootstrap: bootstrap}},
+		{"tls://127.0.0.1:" + dotPort, Options{RootCAs: roots}},
+		{"tls://example.com:" + dotPort, Options{RootCAs: roots, Bootstrap: bootstrap}},
+	}
+
+	ctx := context.Background()
+
+	for _, s := range servers {
+		r, err := NewWithOptions(s.url, s.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", s.url, err)
+		}
+
+		for _, host := range []string{"a.test", "chain.test"} {
+			_, ipv4, err := r.LookupIP(ctx, host)
+			if err != nil {
+				t.Fatalf("%s: %s: %v", s.url, host, err)
+			}
+			if len(ipv4) != 1 || !ipv4[0].Equal(net.IPv4(127, 0, 0, 1)) {
+				t.Fatalf("%s: %s: unexpected addresses %v", s.url, host, ipv4)
+			}
+		}
+
+		// Not truncated, as it would be over UDP.
+		_, ipv4, err := r.LookupIP(ctx, "big.test")
+		if err != nil || len(ipv4) != 40 {
+			t.Fatalf("%s: expecting 40 addresses, got %v (%v)", s.url, ipv4, err)
+		}
+
+		if _, _, err := r.LookupIP(ctx, "nx.test"); err != ErrNoSuchHost {
+			t.Fatalf("%s: expecting ErrNoSuchHost, got %v", s.url, err)
+		}
+
+		// Answers are cached.
+		queries := atomic.LoadInt32(&srv.queries)
+		if _, _, err := r.LookupIP(ctx, "chain.test"); err != nil {
+			t.Fatal(err)
+		}
+		if atomic.LoadInt32(&srv.queries) != queries {
+			t.Fatalf("%s: expecting cached answer", s.url)
+		}
+
+		e, err := NewExchangerWithOptions(s.url, s.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := &dns.Msg{}
+		msg.SetQuestion("a.test.", dns.TypeA)
+		msg.Id = 1234
+		res, err := e.Exchange(ctx, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Id != 1234 {
+			t.Fatalf("%s: expecting ID to be preserved, got %d", s.url, res.Id)
+		}
+	}
+
+	// The stand-ins are not trusted by the system roots.
+	for _, url := range []string{
+		"https://127.0.0.1:" + dohPort,
+		"tls://127.0.0.1:" + dotPort,
+	} {
+		r, err := New(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := r.LookupIP(ctx, "a.test"); err == nil {
+			t.Fatalf("%s: expecting certificate error", url)
+		}
+	}
+
+	// The certificate is not valid for other names.
+	r, err := NewWithOptions("tls://dns.test:"+dotPort, Options{RootCAs: roots, Bootstrap: bootstrap})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.LookupIP(ctx, "a.test"); err == nil {
+		t.Fatal("expecting certificate error")
+	}
+
+	if _, err := New("ftp://127.0.0.1"); err == nil {
+		t.Fatal("expecting unsupported scheme error")
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package resolver
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Hosts is a table of static host overrides, it maps hostnames to IP
+// addresses or to other hostnames.
+type Hosts struct {
+	mu      sync.RWMutex
+	entries map[string]string
+}
+
+// NewHosts creates an empty Hosts table.
+func NewHosts() *Hosts {
+	return &Hosts{entries: map[string]string{}}
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+func validPattern(pattern string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		pattern = pattern[2:]
+	}
+	return pattern != "" && !strings.ContainsAny(pattern, "*:/ ")
+}
+
+// Set maps hosts matching pattern to target. A pattern may be an exact
+// hostname or a wildcard like "*.example.org" (matching any subdomain). The
+// target may be an IP address or another hostname.
+func (h *Hosts) Set(pattern, target string) error {
+	pattern, target = normalizeName(pattern), normalizeName(target)
+	if !validPattern(pattern) {
+		return errors.New("invalid host pattern")
+	}
+	if target == "" || strings.ContainsAny(target, "*/ ") {
+		return errors.New("invalid target")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries[pattern] = target
+	return nil
+}
+
+// Remove deletes the override for the given pattern.
+func (h *Hosts) Remove(pattern string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.entries, normalizeName(pattern))
+}
+
+// All returns a copy of the table.
+func (h *Hosts) All() map[string]string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	entries := make(map[string]string, len(h.entries))
+	for k, v := range h.entries {
+		entries[k] = v
+	}
+	return entries
+}
+
+// Lookup returns the target for host and the pattern that matched it. Exact
+// matches take precedence over wildcards, and more specific wildcards over
+// less specific ones.
+func (h *Hosts) Lookup(host string) (target string, pattern string, ok bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	host = normalizeName(host)
+
+	if target, ok := h.entries[host]; ok {
+		return target, host, true
+	}
+	for name := host; ; {
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+		if target, ok := h.entries["*."+name]; ok {
+			return target, "*." + name, true
+		}
+	}
+	return "", "", false
+}
+
+// Load reads overrides in hosts file format: a target followed by one or
+// more patterns on each line. Lines starting with "#" are ignored.
+func (h *Hosts) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, pattern := range fields[1:] {
+			if err := h.Set(pattern, fields[0]); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,47 @@
+package resolver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHosts(t *testing.T) {
+	h := NewHosts()
+
+	err := h.Load(strings.NewReader(`
+# comment
+10.0.3.7 api.example.com
+127.0.0.1 *.staging.test *.example.com # trailing comment
+staging.example.net *.b.staging.test
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Set("*.*.test", "127.0.0.1"); err == nil {
+		t.Fatal("expecting invalid pattern error")
+	}
+
+	cases := []struct {
+		host, target, pattern string
+	}{
+		{"api.example.com", "10.0.3.7", "api.example.com"},
+		{"API.Example.com.", "10.0.3.7", "api.example.com"},
+		{"www.example.com", "127.0.0.1", "*.example.com"},
+		{"a.staging.test", "127.0.0.1", "*.staging.test"},
+		{"a.b.staging.test", "staging.example.net", "*.b.staging.test"},
+		{"staging.test", "", ""},
+		{"example.org", "", ""},
+	}
+	for _, c := range cases {
+		target, pattern, ok := h.Lookup(c.host)
+		if ok != (c.target != "") || target != c.target || pattern != c.pattern {
+			t.Errorf("%s: got %q %q %v", c.host, target, pattern, ok)
+		}
+	}
+
+	h.Remove("*.example.com")
+	if _, _, ok := h.Lookup("www.example.com"); ok {
+		t.Fatal("expecting removed override")
+	}
+}
@@ -0,0 +1,520 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Package resolver provides a DNS resolver that bypasses the OS settings.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxCNAMEDepth limits how many CNAME records are followed.
+	maxCNAMEDepth = 8
+	// negativeTTL is how long names without addresses are cached when the
+	// server doesn't give the SOA record of their zone.
+	negativeTTL = time.Second * 30
+	// resolutionDelay is how long to wait for IPv6 addresses once the IPv4
+	// ones are known (RFC 8305).
+	resolutionDelay = time.Millisecond * 50
+	// fallbackDelay is how long to wait for the preferred address family
+	// before trying the other one (RFC 8305).
+	fallbackDelay = time.Millisecond * 300
+)
+
+// ErrNoSuchHost is returned when a name has no addresses.
+var ErrNoSuchHost = errors.New("no such host")
+
+// rcodeError is an unsuccessful answer from a DNS server.
+type rcodeError int
+
+func (e rcodeError) Error() string {
+	return "dns: " + dns.RcodeToString[int(e)]
+}
+
+// Exchanger sends a DNS query to a server and returns its answer.
+type Exchanger interface {
+	Exchange(context.Context, *dns.Msg) (*dns.Msg, error)
+}
+
+// udpExchanger queries a plain DNS server over UDP and retries over TCP when
+// the answer is truncated.
+type udpExchanger struct {
+	server string
+}
+
+func (e *udpExchanger) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// dns.Client is not safe for concurrent use.
+	udp, tcp := &dns.Client{Net: "udp"}, &dns.Client{Net: "tcp"}
+
+	// Truncated answers may come with an error from unpacking them.
+	res, _, err := udp.ExchangeContext(ctx, msg, e.server)
+	if res == nil || !res.Truncated {
+		return res, err
+	}
+	res, _, err = tcp.ExchangeContext(ctx, msg, e.server)
+	return res, err
+}
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// Resolver resolves hostnames against a specific DNS server and caches the
+// answers for as long as their TTL allows.
+type Resolver struct {
+	exchanger Exchanger
+
+	mu    sync.Mutex
+	cache map[cacheKey]*cacheEntry
+
+	now func() time.Time
+}
+
+// NormalizeServer adds the default DNS port to server if it has none.
+func NormalizeServer(server string) (string, error) {
+	if server == "" {
+		return "", errors.New("server is empty")
+	}
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return net.JoinHostPort(strings.Trim(server, "[]"), "53"), nil
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func newUDPExchanger(server string) (Exchanger, error) {
+	server, err := NormalizeServer(server)
+	if err != nil {
+		return nil, err
+	}
+	return &udpExchanger{server: server}, nil
+}
+
+// NewExchanger creates an Exchanger that queries the given DNS server. Plain
+// DNS servers (host:port) are queried over UDP, falling back to TCP for
+// truncated answers, see NewExchangerWithOptions for encrypted transports.
+func NewExchanger(server string) (Exchanger, error) {
+	return NewExchangerWithOptions(server, Options{})
+}
+
+// New creates a Resolver that queries the given DNS server, see NewExchanger.
+func New(server string) (*Resolver, error) {
+	return NewWithOptions(server, Options{})
+}
+
+// NewWithExchanger creates a Resolver that sends its queries to the given
+// Exchanger.
+func NewWithExchanger(exchanger Exchanger) *Resolver {
+	return &Resolver{
+		exchanger: exchanger,
+		cache:     map[cacheKey]*cacheEntry{},
+		now:       time.Now,
+	}
+}
+
+// Flush clears the cache.
+func (r *Resolver) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cache = map[cacheKey]*cacheEntry{}
+}
+
+func (r *Resolver) cached(key cacheKey) (*cacheEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if r.now().After(entry.expires) {
+		delete(r.cache, key)
+		return nil, false
+	}
+	return entry, true
+}
+
+func (r *Resolver) store(key cacheKey, entry *cacheEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cache[key] = entry
+}
+
+// lookup returns the addresses of the given type for name, following CNAME
+// records.
+func (r *Resolver) lookup(ctx context.Context, name string, qtype uint16) ([]net.IP, error) {
+	key := cacheKey{name: name, qtype: qtype}
+	if entry, ok := r.cached(key); ok {
+		return entry.ips, entry.err
+	}
+
+	ips, ttl, err := r.query(ctx, name, qtype)
+	if err != nil {
+		if err != ErrNoSuchHost {
+			// Only NXDOMAIN and NODATA are cached, server failures and
+			// refusals are as transient as network errors.
+			return nil, err
+		}
+	}
+	if ttl == 0 {
+		return ips, err
+	}
+
+	r.store(key, &cacheEntry{
+		ips:     ips,
+		err:     err,
+		expires: r.now().Add(ttl),
+	})
+	return ips, err
+}
+
+func (r *Resolver) query(ctx context.Context, name string, qtype uint16) ([]net.IP, time.Duration, error) {
+	minTTL := uint32(math.MaxUint32)
+	updateTTL := func(ttl uint32) {
+		if ttl < minTTL {
+			minTTL = ttl
+		}
+	}
+
+	target := name
+	for depth := 0; depth <= maxCNAMEDepth; {
+		queried := target
+
+		msg := &dns.Msg{}
+		msg.SetQuestion(queried, qtype)
+		msg.RecursionDesired = true
+
+		res, err := r.exchanger.Exchange(ctx, msg)
+		if err != nil {
+			return nil, 0, err
+		}
+		if res.Rcode == dns.RcodeNameError {
+			updateTTL(negativeAnswerTTL(res))
+			return nil, time.Duration(minTTL) * time.Second, ErrNoSuchHost
+		}
+		if res.Rcode != dns.RcodeSuccess {
+			return nil, 0, rcodeError(res.Rcode)
+		}
+
+		// The answer may hold a CNAME chain followed by the addresses of its
+		// final target.
+		for {
+			var ips []net.IP
+			next := ""
+			for _, rr := range res.Answer {
+				if !strings.EqualFold(rr.Header().Name, target) {
+					continue
+				}
+				switch v := rr.(type) {
+				case *dns.CNAME:
+					next = v.Target
+					updateTTL(v.Hdr.Ttl)
+				case *dns.A:
+					if qtype == dns.TypeA {
+						ips = append(ips, v.A)
+						updateTTL(v.Hdr.Ttl)
+					}
+				case *dns.AAAA:
+					if qtype == dns.TypeAAAA {
+						ips = append(ips, v.AAAA)
+						updateTTL(v.Hdr.Ttl)
+					}
+				}
+			}
+			if len(ips) > 0 {
+				return ips, time.Duration(minTTL) * time.Second, nil
+			}
+			if next == "" {
+				break
+			}
+			target = next
+			if depth++; depth > maxCNAMEDepth {
+				return nil, 0, errors.New("dns: too many CNAME records")
+			}
+		}
+
+		if target == queried {
+			// No records of the requested type.
+			updateTTL(negativeAnswerTTL(res))
+			return nil, time.Duration(minTTL) * time.Second, ErrNoSuchHost
+		}
+		// The chain ended with a CNAME the server did not resolve, ask for
+		// its target.
+	}
+
+	return nil, 0, errors.New("dns: too many CNAME records")
+}
+
+// negativeAnswerTTL returns how long an NXDOMAIN or NODATA answer may be
+// cached, that's the lowest of the TTL and the MINIMUM field of the SOA
+// record in the authority section (RFC 2308).
+func negativeAnswerTTL(res *dns.Msg) uint32 {
+	for _, rr := range res.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl
+			}
+			return soa.Hdr.Ttl
+		}
+	}
+	return uint32(negativeTTL / time.Second)
+}
+
+// LookupIP returns the IPv6 and IPv4 addresses of the given host.
+func (r *Resolver) LookupIP(ctx context.Context, host string) (ipv6 []net.IP, ipv4 []net.IP, err error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return nil, []net.IP{ip}, nil
+		}
+		return []net.IP{ip}, nil, nil
+	}
+
+	name := dns.Fqdn(strings.ToLower(host))
+
+	var wg sync.WaitGroup
+	var err6, err4 error
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ipv6, err6 = r.lookup(ctx, name, dns.TypeAAAA)
+	}()
+	go func() {
+		defer wg.Done()
+		ipv4, err4 = r.lookup(ctx, name, dns.TypeA)
+	}()
+	wg.Wait()
+
+	if len(ipv6) == 0 && len(ipv4) == 0 {
+		if err4 != nil {
+			return nil, nil, err4
+		}
+		if err6 != nil {
+			return nil, nil, err6
+		}
+		return nil, nil, ErrNoSuchHost
+	}
+
+	return ipv6, ipv4, nil
+}
+
+// answer holds the addresses of one family.
+type answer struct {
+	qtype uint16
+	ips   []net.IP
+	err   error
+}
+
+// DialContext resolves the host in addr and connects to its addresses,
+// racing IPv6 and IPv4 as described by RFC 8305 (Happy Eyeballs). Dialing
+// starts as soon as the addresses of one family are known, a slow answer
+// for the other family doesn't hold it back.
+func (r *Resolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return dialSerial(ctx, network, port, []net.IP{ip})
+	}
+
+	qtypes := []uint16{dns.TypeAAAA, dns.TypeA}
+	switch network {
+	case "tcp4", "udp4":
+		qtypes = []uint16{dns.TypeA}
+	case "tcp6", "udp6":
+		qtypes = []uint16{dns.TypeAAAA}
+	}
+
+	name := dns.Fqdn(strings.ToLower(host))
+	answers := make(chan answer, len(qtypes))
+	for _, qtype := range qtypes {
+		go func(qtype uint16) {
+			ips, err := r.lookup(ctx, name, qtype)
+			answers <- answer{qtype: qtype, ips: ips, err: err}
+		}(qtype)
+	}
+
+	// Wait for the first family with addresses.
+	var (
+		primary   *answer
+		lookupErr error
+	)
+	pending := len(qtypes)
+	for primary == nil && pending > 0 {
+		select {
+		case a := <-answers:
+			pending--
+			if len(a.ips) > 0 {
+				primary = &a
+			} else if a.err != nil && (lookupErr == nil || a.qtype == dns.TypeA) {
+				lookupErr = a.err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if primary == nil {
+		if lookupErr == nil {
+			lookupErr = ErrNoSuchHost
+		}
+		return nil, &net.DNSError{Err: lookupErr.Error(), Name: host, IsNotFound: lookupErr == ErrNoSuchHost}
+	}
+
+	if primary.qtype == dns.TypeA && pending > 0 {
+		// IPv6 is still preferred if its addresses follow shortly.
+		timer := time.NewTimer(resolutionDelay)
+		select {
+		case a := <-answers:
+			pending--
+			if len(a.ips) > 0 {
+				timer.Stop()
+				known := make(chan []net.IP, 1)
+				known <- primary.ips
+				return dialParallel(ctx, network, port, a.ips, known)
+			}
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		timer.Stop()
+	}
+
+	var fallbacks chan []net.IP
+	if pending > 0 {
+		fallbacks = make(chan []net.IP, 1)
+		go func() {
+			fallbacks <- (<-answers).ips
+		}()
+	}
+
+	return dialParallel(ctx, network, port, primary.ips, fallbacks)
+}
+
+type dialResult struct {
+	conn    net.Conn
+	err     error
+	primary bool
+}
+
+// dialSerial tries each address in order until one succeeds.
+func dialSerial(ctx context.Context, network, port string, ips []net.IP) (net.Conn, error) {
+	var d net.Dialer
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// dialParallel races the primary addresses against the fallback addresses,
+// giving the primaries a head start. The fallback addresses may still be
+// resolving, they're received from fallbacks once known.
+func dialParallel(ctx context.Context, network, port string, primaries []net.IP, fallbacks <-chan []net.IP) (net.Conn, error) {
+	if fallbacks == nil {
+		return dialSerial(ctx, network, port, primaries)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult)
+	race := func(primary bool, ips []net.IP) {
+		conn, err := dialSerial(ctx, network, port, ips)
+		select {
+		case results <- dialResult{conn: conn, err: err, primary: primary}:
+		case <-ctx.Done():
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	go race(true, primaries)
+
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+
+	var (
+		primaryErr, fallbackErr      error
+		fallbackIPs                  []net.IP
+		fallbackDue, fallbackStarted bool
+	)
+	for {
+		select {
+		case <-timer.C:
+			fallbackDue = true
+		case fallbackIPs = <-fallbacks:
+			fallbacks = nil
+		case res := <-results:
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryErr = res.err
+				fallbackDue = true
+			} else {
+				fallbackErr = res.err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if fallbackDue && !fallbackStarted && fallbacks == nil && len(fallbackIPs) > 0 {
+			fallbackStarted = true
+			go race(false, fallbackIPs)
+		}
+		// There's nothing left to try once the primaries failed and the
+		// fallbacks either failed or turned out to be empty.
+		if primaryErr != nil && (fallbackErr != nil || (fallbacks == nil && len(fallbackIPs) == 0)) {
+			return nil, primaryErr
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type testServer struct {
+	addr    string
+	queries int32
+	udp     *dns.Server
+	tcp     *dns.Server
+}
+
+func (s *testServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	atomic.AddInt32(&s.queries, 1)
+
+	res := &dns.Msg{}
+	res.SetReply(req)
+
+	q := req.Question[0]
+	rr := func(s string) dns.RR {
+		r, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+		return r
+	}
+
+	switch q.Name {
+	case "a.test.":
+		if q.Qtype == dns.TypeA {
+			res.Answer = append(res.Answer, rr("a.test. 60 IN A 127.0.0.1"))
+		}
+	case "alias.test.":
+		// CNAME without the addresses of its target.
+		res.Answer = append(res.Answer, rr("alias.test. 120 IN CNAME a.test."))
+	case "chain.test.":
+		res.Answer = append(res.Answer,
+			rr("chain.test. 300 IN CNAME alias.test."),
+			rr("alias.test. 30 IN CNAME a.test."),
+		)
+		if q.Qtype == dns.TypeA {
+			res.Answer = append(res.Answer, rr("a.test. 60 IN A 127.0.0.1"))
+		}
+	case "big.test.":
+		if q.Qtype == dns.TypeA {
+			for i := 1; i <= 40; i++ {
+				res.Answer = append(res.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IPv4(10, 0, 0, byte(i)),
+				})
+			}
+		}
+	case "slow6.test.":
+		if q.Qtype == dns.TypeAAAA {
+			time.Sleep(time.Second)
+		} else {
+			res.Answer = append(res.Answer, rr("slow6.test. 60 IN A 127.0.0.1"))
+		}
+	case "zero.test.":
+		if q.Qtype == dns.TypeA {
+			res.Answer = append(res.Answer, rr("zero.test. 0 IN A 127.0.0.1"))
+		}
+	case "fail.test.":
+		res.Rcode = dns.RcodeServerFailure
+	case "refused.test.":
+		res.Rcode = dns.RcodeRefused
+	case "soa.test.":
+		res.Rcode = dns.RcodeNameError
+		res.Ns = append(res.Ns, rr("test. 3600 IN SOA ns.test. admin.test. 1 7200 900 1209600 10"))
+	case "nodata.test.":
+		if q.Qtype == dns.TypeA {
+			res.Answer = append(res.Answer, rr("nodata.test. 60 IN A 127.0.0.1"))
+		} else {
+			res.Ns = append(res.Ns, rr("test. 5 IN SOA ns.test. admin.test. 1 7200 900 1209600 600"))
+		}
+	case "loop.test.":
+		res.Answer = append(res.Answer, rr("loop.test. 60 IN CNAME loop.test."))
+	default:
+		res.Rcode = dns.RcodeNameError
+	}
+
+	if _, ok := w.LocalAddr().(*net.UDPAddr); ok {
+		res.Truncate(512)
+	}
+
+	_ = w.WriteMsg(res)
+}
+
+func startTestServer(t *testing.T) *testServer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{addr: pc.LocalAddr().String()}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	s.udp = &dns.Server{PacketConn: pc, Handler: s, NotifyStartedFunc: wg.Done}
+	s.tcp = &dns.Server{Listener: ln, Handler: s, NotifyStartedFunc: wg.Done}
+	go func() { _ = s.udp.ActivateAndServe() }()
+	go func() { _ = s.tcp.ActivateAndServe() }()
+	wg.Wait()
+
+	return s
+}
+
+func (s *testServer) Close() {
+	_ = s.udp.Shutdown()
+	_ = s.tcp.Shutdown()
+}
+
+func TestLookup(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	r, err := New(srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, host := range []string{"a.test", "alias.test", "chain.test", "A.TEST"} {
+		_, ipv4, err := r.LookupIP(ctx, host)
+		if err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+		if len(ipv4) != 1 || !ipv4[0].Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Fatalf("%s: unexpected addresses %v", host, ipv4)
+		}
+	}
+
+	if _, _, err := r.LookupIP(ctx, "nx.test"); err != ErrNoSuchHost {
+		t.Fatalf("expecting ErrNoSuchHost, got %v", err)
+	}
+	if _, _, err := r.LookupIP(ctx, "loop.test"); err == nil {
+		t.Fatal("expecting CNAME loop error")
+	}
+
+	// Truncated over UDP, complete over TCP.
+	_, ipv4, err := r.LookupIP(ctx, "big.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ipv4) != 40 {
+		t.Fatalf("expecting 40 addresses, got %d", len(ipv4))
+	}
+}
+
+func TestUDPUnreachable(t *testing.T) {
+	// Nothing answers over UDP, but a TCP listener shares the port.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var accepted int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+
+	e, err := NewExchanger(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &dns.Msg{}
+	msg.SetQuestion("a.test.", dns.TypeA)
+	if _, err := e.Exchange(context.Background(), msg); err == nil {
+		t.Fatal("expecting an error")
+	}
+	if n := atomic.LoadInt32(&accepted); n != 0 {
+		t.Fatalf("expecting no retry over TCP, got %d connections", n)
+	}
+}
+
+func TestCache(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	r, err := New(srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	if _, _, err := r.LookupIP(ctx, "chain.test"); err != nil {
+		t.Fatal(err)
+	}
+	queries := atomic.LoadInt32(&srv.queries)
+
+	if _, _, err := r.LookupIP(ctx, "chain.test"); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&srv.queries) != queries {
+		t.Fatal("expecting cached answer")
+	}
+
+	// The lowest TTL of the chain is 30 seconds.
+	now = now.Add(time.Second * 31)
+	if _, _, err := r.LookupIP(ctx, "chain.test"); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&srv.queries) == queries {
+		t.Fatal("expecting expired answer")
+	}
+}
+
+func TestCacheUncached(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	r, err := New(srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	for _, host := range []string{"zero.test", "fail.test", "refused.test"} {
+		_, _, err := r.LookupIP(ctx, host)
+		queries := atomic.LoadInt32(&srv.queries)
+
+		_, _, err2 := r.LookupIP(ctx, host)
+		if (err == nil) != (err2 == nil) {
+			t.Fatalf("%s: expecting %v, got %v", host, err, err2)
+		}
+		if atomic.LoadInt32(&srv.queries) == queries {
+			t.Fatalf("%s: expecting answer not to be cached", host)
+		}
+	}
+
+	if _, _, err := r.LookupIP(ctx, "nx.test"); err != ErrNoSuchHost {
+		t.Fatalf("expecting ErrNoSuchHost, got %v", err)
+	}
+	queries := atomic.LoadInt32(&srv.queries)
+	if _, _, err := r.LookupIP(ctx, "nx.test"); err != ErrNoSuchHost {
+		t.Fatalf("expecting ErrNoSuchHost, got %v", err)
+	}
+	if atomic.LoadInt32(&srv.queries) != queries {
+		t.Fatal("expecting cached NXDOMAIN")
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	r, err := New(srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	lookup := func(host string, qtype uint16) {
+		if _, err := r.lookup(ctx, dns.Fqdn(host), qtype); err != ErrNoSuchHost {
+			t.Fatalf("%s: expecting ErrNoSuchHost, got %v", host, err)
+		}
+	}
+
+	// Negative answers are cached as long as their SOA record allows, that's
+	// 10 seconds (MINIMUM) for soa.test and 5 seconds (TTL) for nodata.test.
+	start := now
+	for _, q := range []struct {
+		host  string
+		qtype uint16
+	}{{"soa.test", dns.TypeA}, {"nodata.test", dns.TypeAAAA}} {
+		now = start
+		lookup(q.host, q.qtype)
+		queries := atomic.LoadInt32(&srv.queries)
+
+		now = start.Add(time.Second * 4)
+		lookup(q.host, q.qtype)
+		if atomic.LoadInt32(&srv.queries) != queries {
+			t.Fatalf("%s: expecting cached answer", q.host)
+		}
+
+		now = start.Add(time.Second * 11)
+		lookup(q.host, q.qtype)
+		if atomic.LoadInt32(&srv.queries) == queries {
+			t.Fatalf("%s: expecting expired answer", q.host)
+		}
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	srv := startTestServer(t)
+	defer srv.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	r, err := New(srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	conn, err := r.DialContext(context.Background(), "tcp", net.JoinHostPort("alias.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if _, err := r.DialContext(context.Background(), "tcp", net.JoinHostPort("nx.test", port)); err == nil {
+		t.Fatal("expecting lookup error")
+	}
+
+	// A slow AAAA answer doesn't hold back IPv4.
+	start := time.Now()
+	conn, err = r.DialContext(context.Background(), "tcp", net.JoinHostPort("slow6.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Fatalf("expecting IPv4 not to wait for the AAAA answer, took %v", elapsed)
+	}
+}
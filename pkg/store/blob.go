@@ -0,0 +1,235 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+// BlobTable holds the bodies of captured records, keyed by their SHA-256
+// hash so identical bodies are only saved once.
+const BlobTable = `blob`
+
+const encodingZstd = "zstd"
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func initZstd() {
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+}
+
+// blobHash returns the hexadecimal SHA-256 of data, or an empty string for
+// empty bodies, which are not saved.
+func blobHash(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeBlob compresses data when asked to and it's worth it, and returns
+// the encoding used.
+func encodeBlob(data []byte, compress bool) (string, []byte) {
+	if !compress {
+		return "", data
+	}
+	zstdOnce.Do(initZstd)
+	compressed := zstdEncoder.EncodeAll(data, nil)
+	if len(compressed) >= len(data) {
+		// Images and compressed responses hardly shrink.
+		return "", data
+	}
+	return encodingZstd, compressed
+}
+
+func decodeBlob(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case "":
+		return data, nil
+	case encodingZstd:
+		zstdOnce.Do(initZstd)
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unknown blob encoding %q", encoding)
+}
+
+// querier is implemented by database sessions and transactions.
+type querier interface {
+	QueryRow(query interface{}, args ...interface{}) (*sql.Row, error)
+}
+
+// touchBlob locks the blob with the given hash until the transaction ends,
+// so gcBlobs can't remove it meanwhile, and tells whether it exists.
+func touchBlob(tx sqlbuilder.Tx, hash string) (bool, error) {
+	res, err := tx.Exec(`UPDATE "`+BlobTable+`" SET "hash" = "hash" WHERE "hash" = ?`, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// putBlob saves data unless there's a blob with the same hash already, and
+// returns its hash. Either way the blob is locked until the transaction ends.
+func putBlob(tx sqlbuilder.Tx, data []byte, compress bool) (string, error) {
+	hash := blobHash(data)
+	if hash == "" {
+		return "", nil
+	}
+
+	exists, err := touchBlob(tx, hash)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return hash, nil
+	}
+
+	// Updating on conflict locks a blob that was saved concurrently.
+	encoding, stored := encodeBlob(data, compress)
+	_, err = tx.Exec(
+		`INSERT INTO "`+BlobTable+`" ("hash", "encoding", "size", "data") VALUES (?, ?, ?, ?) ON CONFLICT ("hash") DO UPDATE SET "hash" = excluded."hash"`,
+		hash, encoding, len(data), stored,
+	)
+	if err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// getBlob returns the data of the blob with the given hash.
+func getBlob(q querier, hash string) ([]byte, error) {
+	if hash == "" {
+		return nil, nil
+	}
+
+	var (
+		encoding string
+		data     []byte
+	)
+	row, err := q.QueryRow(`SELECT "encoding", "data" FROM "`+BlobTable+`" WHERE "hash" = ?`, hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := row.Scan(&encoding, &data); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("missing blob %s", hash)
+		}
+		return nil, err
+	}
+	return decodeBlob(encoding, data)
+}
+
+// gcBlobs removes the blobs with the given hashes that are no longer
+// referenced by any record.
+func gcBlobs(tx sqlbuilder.Tx, hashes []string) error {
+	for _, hash := range hashes {
+		// Waits for transactions that are saving the blob, so references they
+		// add are seen by the next statement.
+		if _, err := touchBlob(tx, hash); err != nil {
+			return err
+		}
+		_, err := tx.Exec(
+			`DELETE FROM "`+BlobTable+`" WHERE "hash" = ? AND NOT EXISTS (
+				SELECT 1 FROM "`+CaptureTable+`" WHERE "body_hash" = ? OR "request_body_hash" = ?
+			)`,
+			hash, hash, hash,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveBodiesToBlobs is a migration step that moves the bodies saved inline
+// by older versions to the blob table.
+func moveBodiesToBlobs(tx sqlbuilder.Tx) error {
+	type inline struct {
+		id                uint64
+		body, requestBody []byte
+	}
+
+	var lastID uint64
+	for {
+		// Rows are read in chunks, some drivers can't run other statements
+		// while a query is open.
+		rows, err := tx.Query(`SELECT "id", "body", "request_body" FROM "`+CaptureTable+`" WHERE "id" > ? ORDER BY "id" LIMIT 100`, lastID)
+		if err != nil {
+			return err
+		}
+
+		var chunk []inline
+		for rows.Next() {
+			var r inline
+			if err := rows.Scan(&r.id, &r.body, &r.requestBody); err != nil {
+				rows.Close()
+				return err
+			}
+			chunk = append(chunk, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if len(chunk) == 0 {
+			return nil
+		}
+
+		for _, r := range chunk {
+			lastID = r.id
+
+			bodyHash, err := putBlob(tx, r.body, false)
+			if err != nil {
+				return err
+			}
+			requestBodyHash, err := putBlob(tx, r.requestBody, false)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(
+				`UPDATE "`+CaptureTable+`" SET "body" = NULL, "request_body" = NULL, "body_hash" = ?, "request_body_hash" = ? WHERE "id" = ?`,
+				bodyHash, requestBodyHash, r.id,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
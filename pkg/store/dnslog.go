@@ -0,0 +1,210 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"context"
+	"strings"
+
+	"github.com/malfunkt/hyperfox/pkg/dnsserver"
+	"upper.io/db.v3"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+// DNSLog is implemented by stores that keep the queries answered by the DNS
+// server next to the captures.
+type DNSLog interface {
+	// InsertDNSQueries saves queries in a single transaction and sets their
+	// IDs.
+	InsertDNSQueries(queries ...*dnsserver.Query) error
+
+	// DNSQueries returns the queries that match q ordered by ID, and the
+	// number of queries that match q regardless of its Offset and Limit. The
+	// search terms are matched against the name, client, answer, type and
+	// rcode of the queries.
+	DNSQueries(q Query) ([]dnsserver.Query, uint64, error)
+
+	// DeleteDNSQueries removes the queries with the given IDs and returns
+	// how many were removed.
+	DeleteDNSQueries(ids ...int64) (int, error)
+}
+
+var (
+	_ DNSLog = (*SQL)(nil)
+	_ DNSLog = (*Memory)(nil)
+)
+
+// InsertDNSQueries implements DNSLog.
+func (s *SQL) InsertDNSQueries(queries ...*dnsserver.Query) error {
+	return s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		col := tx.Collection(DNSQueryTable)
+		for _, q := range queries {
+			id, err := col.Insert(q)
+			if err != nil {
+				return err
+			}
+			if id, ok := id.(int64); ok {
+				q.ID = id
+			}
+		}
+		return nil
+	})
+}
+
+// DNSQueries implements DNSLog.
+func (s *SQL) DNSQueries(q Query) ([]dnsserver.Query, uint64, error) {
+	res := s.sess.Collection(DNSQueryTable).Find()
+	if q.AfterID > 0 {
+		res = res.And(db.Cond{"id >": q.AfterID})
+	}
+	if !q.Before.IsZero() {
+		res = res.And(db.Cond{"time <": q.Before})
+	}
+	if terms := searchTerms(q.Search); len(terms) > 0 {
+		conds := db.And()
+		for _, term := range terms {
+			conds = conds.And(db.Or(
+				db.Cond{"name LIKE": "%" + term + "%"},
+				db.Cond{"client LIKE": "%" + term + "%"},
+				db.Cond{"answer LIKE": "%" + term + "%"},
+				db.Cond{"type": term},
+				db.Cond{"rcode": term},
+			))
+		}
+		res = res.And(conds)
+	}
+	res = res.OrderBy("id")
+
+	total, err := res.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res = res.Offset(q.Offset)
+	if q.Limit > 0 {
+		res = res.Limit(q.Limit)
+	}
+
+	queries := []dnsserver.Query{}
+	if err := res.All(&queries); err != nil {
+		return nil, 0, err
+	}
+	return queries, total, nil
+}
+
+// DeleteDNSQueries implements DNSLog.
+func (s *SQL) DeleteDNSQueries(ids ...int64) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	var n uint64
+	err := s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		res := tx.Collection(DNSQueryTable).Find(db.Cond{"id IN": ids})
+
+		var err error
+		if n, err = res.Count(); err != nil {
+			return err
+		}
+		return res.Delete()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// InsertDNSQueries implements DNSLog.
+func (m *Memory) InsertDNSQueries(queries ...*dnsserver.Query) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, q := range queries {
+		m.lastDNSID++
+		q.ID = m.lastDNSID
+		m.dnsQueries = append(m.dnsQueries, *q)
+	}
+	return nil
+}
+
+// matchesDNSQuery tells whether q matches all the terms of a search.
+func matchesDNSQuery(q *dnsserver.Query, terms []string) bool {
+	for _, term := range terms {
+		like := func(s string) bool {
+			return strings.Contains(strings.ToLower(s), strings.ToLower(term))
+		}
+		if !like(q.Name) && !like(q.Client) && !like(q.Answer) &&
+			q.Type != term && q.Rcode != term {
+			return false
+		}
+	}
+	return true
+}
+
+// DNSQueries implements DNSLog.
+func (m *Memory) DNSQueries(q Query) ([]dnsserver.Query, uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	terms := searchTerms(q.Search)
+
+	var found []dnsserver.Query
+	for i := range m.dnsQueries {
+		dq := &m.dnsQueries[i]
+		if uint64(dq.ID) <= q.AfterID || (!q.Before.IsZero() && !dq.Time.Before(q.Before)) {
+			continue
+		}
+		if matchesDNSQuery(dq, terms) {
+			found = append(found, *dq)
+		}
+	}
+
+	queries := []dnsserver.Query{}
+	if q.Offset < len(found) {
+		queries = append(queries, found[q.Offset:]...)
+		if q.Limit > 0 && q.Limit < len(queries) {
+			queries = queries[:q.Limit]
+		}
+	}
+	return queries, uint64(len(found)), nil
+}
+
+// DeleteDNSQueries implements DNSLog.
+func (m *Memory) DeleteDNSQueries(ids ...int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	remove := map[int64]bool{}
+	for _, id := range ids {
+		remove[id] = true
+	}
+
+	kept := m.dnsQueries[:0]
+	for _, q := range m.dnsQueries {
+		if !remove[q.ID] {
+			kept = append(kept, q)
+		}
+	}
+	n := len(m.dnsQueries) - len(kept)
+	m.dnsQueries = kept
+	return n, nil
+}
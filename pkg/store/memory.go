@@ -0,0 +1,225 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/malfunkt/hyperfox/pkg/dnsserver"
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+)
+
+// Memory is a Store that keeps records in memory, it's meant for tests.
+type Memory struct {
+	mu      sync.Mutex
+	records []*capture.Record
+	blobs   map[string][]byte
+	lastID  uint64
+
+	dnsQueries []dnsserver.Query
+	lastDNSID  int64
+}
+
+var _ Store = (*Memory)(nil)
+
+// NewMemory creates an empty in-memory store.
+func NewMemory() *Memory {
+	return &Memory{blobs: map[string][]byte{}}
+}
+
+// Insert implements Store.
+func (m *Memory) Insert(records ...*capture.Record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lastID := m.lastID
+	for _, r := range records {
+		if r.ID == 0 {
+			continue
+		}
+		if r.ID <= lastID {
+			return fmt.Errorf("record ID %d is taken", r.ID)
+		}
+		lastID = r.ID
+	}
+
+	// All or nothing, like a transaction.
+	for _, r := range records {
+		if r.ID == 0 {
+			m.lastID++
+			r.ID = m.lastID
+		} else {
+			m.lastID = r.ID
+		}
+		r.RequestBodyHash = m.putBlob(r.RequestBody)
+		r.BodyHash = m.putBlob(r.Body)
+
+		copied := *r
+		copied.RequestBody, copied.Body = nil, nil
+		m.records = append(m.records, &copied)
+	}
+	return nil
+}
+
+func (m *Memory) putBlob(data []byte) string {
+	hash := blobHash(data)
+	if hash != "" && m.blobs[hash] == nil {
+		m.blobs[hash] = append([]byte(nil), data...)
+	}
+	return hash
+}
+
+// withBodies returns a copy of r with its bodies.
+func (m *Memory) withBodies(r *capture.Record) *capture.Record {
+	copied := *r
+	copied.RequestBody = m.blobs[r.RequestBodyHash]
+	copied.Body = m.blobs[r.BodyHash]
+	return &copied
+}
+
+// Get implements Store.
+func (m *Memory) Get(uuid string) (*capture.Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, r := range m.records {
+		if r.UUID == uuid {
+			return m.withBodies(r), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// matches tells whether r matches all the terms of a search.
+func matches(r *capture.Record, terms []string) bool {
+	for _, term := range terms {
+		like := func(s string) bool {
+			return strings.Contains(strings.ToLower(s), strings.ToLower(term))
+		}
+		if !like(string(r.Keywords)) && !like(r.Host) && !like(r.Origin) &&
+			!like(r.Path) && !like(r.ContentType) && !like(r.SniffedContentType) &&
+			r.Method != term && r.Scheme != term && strconv.Itoa(r.Status) != term &&
+			r.RequestBodyHash != term && r.BodyHash != term {
+			return false
+		}
+	}
+	return true
+}
+
+// find returns the records that match q, ignoring its Offset and Limit.
+func (m *Memory) find(q Query) []*capture.Record {
+	terms := searchTerms(q.Search)
+
+	var records []*capture.Record
+	for _, r := range m.records {
+		if r.ID <= q.AfterID || (!q.Before.IsZero() && !r.DateStart.Before(q.Before)) {
+			continue
+		}
+		if matches(r, terms) {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+func window(records []*capture.Record, q Query) []*capture.Record {
+	if q.Offset >= len(records) {
+		return nil
+	}
+	records = records[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(records) {
+		records = records[:q.Limit]
+	}
+	return records
+}
+
+// Query implements Store.
+func (m *Memory) Query(q Query) ([]capture.RecordMeta, uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	found := m.find(q)
+
+	records := []capture.RecordMeta{}
+	for _, r := range window(found, q) {
+		records = append(records, r.RecordMeta)
+	}
+	return records, uint64(len(found)), nil
+}
+
+// Delete implements Store.
+func (m *Memory) Delete(uuids ...string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	remove := map[string]bool{}
+	for _, uuid := range uuids {
+		remove[uuid] = true
+	}
+
+	kept := m.records[:0]
+	for _, r := range m.records {
+		if !remove[r.UUID] {
+			kept = append(kept, r)
+		}
+	}
+	n := len(m.records) - len(kept)
+	m.records = kept
+
+	referenced := map[string]bool{}
+	for _, r := range m.records {
+		referenced[r.RequestBodyHash] = true
+		referenced[r.BodyHash] = true
+	}
+	for hash := range m.blobs {
+		if !referenced[hash] {
+			delete(m.blobs, hash)
+		}
+	}
+
+	return n, nil
+}
+
+// Stream implements Store.
+func (m *Memory) Stream(q Query, fn func(*capture.Record) error) error {
+	m.mu.Lock()
+	var records []*capture.Record
+	for _, r := range window(m.find(q), q) {
+		records = append(records, m.withBodies(r))
+	}
+	m.mu.Unlock()
+
+	for _, r := range records {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close implements Store.
+func (m *Memory) Close() error {
+	return nil
+}
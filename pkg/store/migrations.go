@@ -0,0 +1,264 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+const schemaTable = `schema_migrations`
+
+const schemaCreateSQL = `CREATE TABLE IF NOT EXISTS "` + schemaTable + `" (
+	"version" INTEGER PRIMARY KEY,
+	"name" VARCHAR(255),
+	"applied_at" TIMESTAMP
+)`
+
+// migration upgrades the schema by one version, migrations must work on
+// databases created by versions of Hyperfox that predate the schema table.
+type migration struct {
+	name string
+	up   func(tx sqlbuilder.Tx) error
+}
+
+// execSQL returns a migration step that runs the given statements.
+func execSQL(statements ...string) func(tx sqlbuilder.Tx) error {
+	return func(tx sqlbuilder.Tx) error {
+		for _, stmt := range statements {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// steps returns a migration step that runs the given steps in order.
+func steps(fns ...func(tx sqlbuilder.Tx) error) func(tx sqlbuilder.Tx) error {
+	return func(tx sqlbuilder.Tx) error {
+		for _, fn := range fns {
+			if err := fn(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// schemaVersion returns the version of the schema, that is, the number of
+// migrations that were applied.
+func schemaVersion(sess sqlbuilder.Database) (int, error) {
+	if _, err := sess.Exec(schemaCreateSQL); err != nil {
+		return 0, err
+	}
+	return appliedVersion(sess)
+}
+
+// appliedVersion is like schemaVersion but fails instead of creating the
+// schema table when it's missing.
+func appliedVersion(q querier) (int, error) {
+	var version sql.NullInt64
+	row, err := q.QueryRow(`SELECT MAX("version") FROM "` + schemaTable + `"`)
+	if err != nil {
+		return 0, err
+	}
+	if err := row.Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// migrationLock is called at the start of every migration transaction and
+// blocks until no other process is changing the schema of the same database,
+// it's nil when transactions already lock the database (SQLite).
+type migrationLock func(tx sqlbuilder.Tx) error
+
+// lockedVersion is like schemaVersion but reads the version in a
+// transaction that holds lock.
+func lockedVersion(sess sqlbuilder.Database, lock migrationLock) (int, error) {
+	var version int
+	err := sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		if lock != nil {
+			if err := lock(tx); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(schemaCreateSQL); err != nil {
+			return err
+		}
+		var err error
+		version, err = appliedVersion(tx)
+		return err
+	})
+	return version, err
+}
+
+// migrate brings the schema up to date. If backup is not nil it's called
+// before changing the schema and returns where the database was copied to,
+// or an empty string if there's nothing worth a backup. Every migration reads
+// the version again under lock, so processes that share a database can start
+// at the same time and each migration is applied once.
+func migrate(sess sqlbuilder.Database, migrations []migration, lock migrationLock, backup func(version int) (string, error)) error {
+	version, err := lockedVersion(sess, lock)
+	if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return errNewerSchema(version, len(migrations))
+	}
+	if version == len(migrations) {
+		return nil
+	}
+
+	if backup != nil {
+		path, err := backup(version)
+		if err != nil {
+			return fmt.Errorf("failed to back up database: %v", err)
+		}
+		if path != "" {
+			log.Printf("Upgrading database schema from version %d to %d, backup saved to %s", version, len(migrations), path)
+		}
+	}
+
+	for version < len(migrations) {
+		err := sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+			if lock != nil {
+				if err := lock(tx); err != nil {
+					return err
+				}
+			}
+
+			// Another process may have applied it in the meantime.
+			var err error
+			if version, err = appliedVersion(tx); err != nil {
+				return err
+			}
+			if version >= len(migrations) {
+				return nil
+			}
+
+			m := migrations[version]
+			if err := m.up(tx); err != nil {
+				return fmt.Errorf("migration %d (%s): %v", version+1, m.name, err)
+			}
+			if _, err := tx.Exec(
+				`INSERT INTO "`+schemaTable+`" ("version", "name", "applied_at") VALUES (?, ?, ?)`,
+				version+1, m.name, time.Now().UTC(),
+			); err != nil {
+				return fmt.Errorf("migration %d (%s): %v", version+1, m.name, err)
+			}
+			version++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkSchema returns an error unless the schema is up to date, unlike
+// migrate it never changes the database.
+func checkSchema(sess sqlbuilder.Database, migrations []migration) error {
+	version, err := appliedVersion(sess)
+	if err != nil {
+		// Databases that predate the schema table don't have one.
+		return fmt.Errorf("failed to read the database schema version, run hyperfox with this database once to upgrade it: %v", err)
+	}
+	if version > len(migrations) {
+		return errNewerSchema(version, len(migrations))
+	}
+	if version < len(migrations) {
+		return fmt.Errorf("database schema version %d is out of date, run hyperfox with this database once to upgrade it to version %d", version, len(migrations))
+	}
+	return nil
+}
+
+func errNewerSchema(version, supported int) error {
+	return fmt.Errorf("database schema version %d is newer than the supported version %d, please upgrade Hyperfox", version, supported)
+}
+
+// splitContentTypes moves the content types that older versions sniffed
+// from the raw body to "sniffed_content_type" and puts the one declared by
+// the saved response headers in "content_type".
+func splitContentTypes(tx sqlbuilder.Tx) error {
+	type contentType struct {
+		id       uint64
+		sniffed  sql.NullString
+		declared string
+	}
+
+	var lastID uint64
+	for {
+		rows, err := tx.Query(`SELECT "id", "content_type", "header" FROM "`+CaptureTable+`" WHERE "id" > ? ORDER BY "id" LIMIT 100`, lastID)
+		if err != nil {
+			return err
+		}
+
+		var chunk []contentType
+		for rows.Next() {
+			var (
+				r   contentType
+				raw []byte
+			)
+			if err := rows.Scan(&r.id, &r.sniffed, &raw); err != nil {
+				rows.Close()
+				return err
+			}
+			var header http.Header
+			if json.Unmarshal(raw, &header) == nil {
+				r.declared = header.Get("Content-Type")
+			}
+			chunk = append(chunk, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if len(chunk) == 0 {
+			return nil
+		}
+
+		for _, r := range chunk {
+			lastID = r.id
+
+			_, err := tx.Exec(
+				`UPDATE "`+CaptureTable+`" SET "sniffed_content_type" = ?, "content_type" = ? WHERE "id" = ?`,
+				r.sniffed, r.declared, r.id,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,523 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+
+	"upper.io/db.v3/lib/sqlbuilder"
+	"upper.io/db.v3/sqlite"
+)
+
+// legacyCaptureSQL is the capture table as created by Hyperfox 1.x.
+const legacyCaptureSQL = `CREATE TABLE "capture" (
+	"id" INTEGER PRIMARY KEY,
+	"uuid" VARCHAR(36) NOT NULL,
+	"origin" VARCHAR(255),
+	"method" VARCHAR(10),
+	"status" INTEGER,
+	"content_type" VARCHAR(255),
+	"content_length" INTEGER,
+	"host" VARCHAR(255),
+	"url" TEXT,
+	"scheme" VARCHAR(10),
+	"path" TEXT,
+	"header" TEXT,
+	"body" BLOB,
+	"keywords" BLOB,
+	"request_header" TEXT,
+	"request_body" BLOB,
+	"date_start" DATETIME,
+	"date_end" DATETIME,
+	"time_taken" INTEGER
+)`
+
+func openTestDB(t *testing.T, name string) sqlbuilder.Database {
+	sess, err := sqlite.Open(sqlite.ConnectionURL{Database: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+func migrateSQLite(sess sqlbuilder.Database, name string) error {
+	return migrate(sess, sqliteMigrations, nil, func(version int) (string, error) {
+		return backupDB(sess, name, version)
+	})
+}
+
+func backups(t *testing.T, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.bak"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func expectSchema(t *testing.T, sess sqlbuilder.Database) {
+	version, err := schemaVersion(sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(sqliteMigrations) {
+		t.Fatalf("expecting schema version %d, got %d", len(sqliteMigrations), version)
+	}
+
+	tx, err := sess.NewTx(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	columns, err := tableColumns(tx, CaptureTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"uuid", "error", "client_tls_ja4", "upstream_tls_random", "upstream_override", "body_hash", "request_body_hash", "sniffed_content_type", "trailer", "interim", "proto", "upstream_proto"} {
+		if !columns[name] {
+			t.Fatalf("missing column %q", name)
+		}
+	}
+
+	for _, index := range []string{"capture_uuid", "capture_host", "capture_status", "capture_date_start", "capture_body_hash"} {
+		var n int
+		row, err := tx.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?`, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := row.Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Fatalf("missing index %q", index)
+		}
+	}
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hyperfox-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "new.db")
+	sess := openTestDB(t, name)
+	defer sess.Close()
+
+	if err := migrateSQLite(sess, name); err != nil {
+		t.Fatal(err)
+	}
+	expectSchema(t, sess)
+
+	if b := backups(t, dir); len(b) != 0 {
+		t.Fatalf("expecting no backups of a new database, got %v", b)
+	}
+}
+
+// countMigrations returns the number of applied migrations.
+func countMigrations(t *testing.T, sess sqlbuilder.Database) int {
+	var n int
+	row, err := sess.QueryRow(`SELECT COUNT(*) FROM "` + schemaTable + `"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := row.Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestMigrateConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hyperfox-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Proxies that share a database may start at the same time.
+	name := filepath.Join(dir, "shared.db")
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			st, err := OpenSQLite(name, Options{})
+			if err == nil {
+				err = st.Close()
+			}
+			errs <- err
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sess := openTestDB(t, name)
+	defer sess.Close()
+
+	expectSchema(t, sess)
+	if n := countMigrations(t, sess); n != len(sqliteMigrations) {
+		t.Fatalf("expecting %d migrations to be applied once, got %d", len(sqliteMigrations), n)
+	}
+}
+
+// TestPostgreSQLMigrateConcurrently upgrades a new schema of the database
+// given by HYPERFOX_TEST_POSTGRES from several connections at once.
+func TestPostgreSQLMigrateConcurrently(t *testing.T) {
+	dsn := os.Getenv("HYPERFOX_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("HYPERFOX_TEST_POSTGRES is not set")
+	}
+
+	admin, err := OpenPostgreSQL(dsn, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	schema := fmt.Sprintf("hyperfox_test_%d", time.Now().UnixNano())
+	if _, err := admin.Session().Exec(`CREATE SCHEMA "` + schema + `"`); err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Session().Exec(`DROP SCHEMA "` + schema + `" CASCADE`)
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := u.Query()
+	params.Set("search_path", schema)
+	u.RawQuery = params.Encode()
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			st, err := OpenPostgreSQL(u.String(), Options{})
+			if err == nil {
+				err = st.Close()
+			}
+			errs <- err
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var n int
+	row, err := admin.Session().QueryRow(`SELECT COUNT(*) FROM "` + schema + `"."` + schemaTable + `"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := row.Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(postgresMigrations) {
+		t.Fatalf("expecting %d migrations to be applied once, got %d", len(postgresMigrations), n)
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hyperfox-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "legacy.db")
+	sess := openTestDB(t, name)
+	defer sess.Close()
+
+	if _, err := sess.Exec(legacyCaptureSQL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.Exec(`INSERT INTO "capture" ("uuid", "host", "body", "content_type", "header") VALUES ('4d5b', 'example.com', X'68656c6c6f', 'text/plain; charset=utf-8', '{"Content-Type":["text/html"]}')`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateSQLite(sess, name); err != nil {
+		t.Fatal(err)
+	}
+	expectSchema(t, sess)
+
+	var host string
+	row, err := sess.QueryRow(`SELECT "host" FROM "capture" WHERE "uuid" = '4d5b'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := row.Scan(&host); err != nil {
+		t.Fatal(err)
+	}
+	if host != "example.com" {
+		t.Fatalf("expecting existing records to be kept, got host %q", host)
+	}
+
+	var (
+		body     []byte
+		bodyHash string
+	)
+	row, err = sess.QueryRow(`SELECT "body", "body_hash" FROM "capture" WHERE "uuid" = '4d5b'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := row.Scan(&body, &bodyHash); err != nil {
+		t.Fatal(err)
+	}
+	if body != nil || bodyHash != blobHash([]byte("hello")) {
+		t.Fatalf("expecting the body to be moved to a blob, got %q and hash %q", body, bodyHash)
+	}
+	if data, err := getBlob(sess, bodyHash); err != nil || string(data) != "hello" {
+		t.Fatalf("expecting the blob to hold the body, got %q (%v)", data, err)
+	}
+
+	var contentType, sniffed string
+	row, err = sess.QueryRow(`SELECT "content_type", "sniffed_content_type" FROM "capture" WHERE "uuid" = '4d5b'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := row.Scan(&contentType, &sniffed); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "text/html" || sniffed != "text/plain; charset=utf-8" {
+		t.Fatalf("expecting declared and sniffed content types to be split, got %q and %q", contentType, sniffed)
+	}
+
+	b := backups(t, dir)
+	if len(b) != 1 {
+		t.Fatalf("expecting a backup, got %v", b)
+	}
+
+	backup := openTestDB(t, b[0])
+	defer backup.Close()
+
+	var count int
+	row, err = backup.QueryRow(`SELECT COUNT(*) FROM "capture"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := row.Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expecting the backup to hold 1 record, got %d", count)
+	}
+
+	// Up to date databases are left alone.
+	if err := migrateSQLite(sess, name); err != nil {
+		t.Fatal(err)
+	}
+	if b := backups(t, dir); len(b) != 1 {
+		t.Fatalf("expecting no new backups, got %v", b)
+	}
+}
+
+func TestMigrateNewerDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hyperfox-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "newer.db")
+	sess := openTestDB(t, name)
+	defer sess.Close()
+
+	if err := migrateSQLite(sess, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.Exec(`INSERT INTO "`+schemaTable+`" ("version", "name") VALUES (?, 'from the future')`, len(sqliteMigrations)+1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateSQLite(sess, name); err == nil {
+		t.Fatal("expecting an error for a schema newer than supported")
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hyperfox-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := OpenSQLite(filepath.Join(dir, "missing.db"), Options{ReadOnly: true}); err == nil {
+		t.Fatal("expecting an error for a missing database")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.db")); !os.IsNotExist(err) {
+		t.Fatal("expecting the missing database not to be created")
+	}
+
+	name := filepath.Join(dir, "legacy.db")
+	sess := openTestDB(t, name)
+	if _, err := sess.Exec(legacyCaptureSQL); err != nil {
+		t.Fatal(err)
+	}
+	sess.Close()
+
+	if _, err := OpenSQLite(name, Options{ReadOnly: true}); err == nil {
+		t.Fatal("expecting an error for a database that predates the schema table")
+	}
+
+	st, err := OpenSQLite(name, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Session().Exec(`DELETE FROM "`+schemaTable+`" WHERE "version" = ?`, len(sqliteMigrations)); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+
+	if _, err := OpenSQLite(name, Options{ReadOnly: true}); err == nil {
+		t.Fatal("expecting an error for an outdated schema")
+	}
+
+	sess = openTestDB(t, name)
+	version, err := appliedVersion(sess)
+	sess.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(sqliteMigrations)-1 {
+		t.Fatalf("expecting the schema to be left alone, got version %d", version)
+	}
+	if b := backups(t, dir); len(b) != 1 {
+		t.Fatalf("expecting only the backup of the first upgrade, got %v", b)
+	}
+
+	if st, err = OpenSQLite(name, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+
+	if st, err = OpenSQLite(name, Options{ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	if _, _, err := st.Query(Query{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Insert(&capture.Record{}); err == nil {
+		t.Fatal("expecting writes to fail")
+	}
+}
+
+func TestIncrementalVacuumBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hyperfox-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An up to date database created before incremental vacuum.
+	name := filepath.Join(dir, "current.db")
+	sess := openTestDB(t, name)
+	if err := migrateSQLite(sess, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.Exec(`INSERT INTO "` + CaptureTable + `" ("uuid") VALUES ('4d5b')`); err != nil {
+		t.Fatal(err)
+	}
+	sess.Close()
+
+	autoVacuum := func(name string) int {
+		sess := openTestDB(t, name)
+		defer sess.Close()
+
+		var mode int
+		row, err := sess.QueryRow(`PRAGMA auto_vacuum`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := row.Scan(&mode); err != nil {
+			t.Fatal(err)
+		}
+		return mode
+	}
+
+	st, err := OpenSQLite(name, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+
+	if mode := autoVacuum(name); mode != sqliteIncrementalVacuum {
+		t.Fatalf("expecting incremental vacuum, got auto_vacuum = %d", mode)
+	}
+
+	b := backups(t, dir)
+	if len(b) != 1 {
+		t.Fatalf("expecting a backup before the vacuum, got %v", b)
+	}
+	if mode := autoVacuum(b[0]); mode == sqliteIncrementalVacuum {
+		t.Fatal("expecting the backup to be taken before the vacuum")
+	}
+
+	// Legacy databases are backed up once for both the migrations and the
+	// vacuum.
+	legacy := filepath.Join(dir, "legacy.db")
+	sess = openTestDB(t, legacy)
+	if _, err := sess.Exec(legacyCaptureSQL); err != nil {
+		t.Fatal(err)
+	}
+	sess.Close()
+
+	if st, err = OpenSQLite(legacy, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+
+	if b := backups(t, dir); len(b) != 2 {
+		t.Fatalf("expecting a single backup of the legacy database, got %v", b)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/dnsserver"
+)
+
+// deleteChunkSize is the number of records DeleteMatching removes at once.
+const deleteChunkSize = 500
+
+// ErrSizeUnsupported is returned by Prune when a size limit is given for a
+// store that is not a Compactor.
+var ErrSizeUnsupported = errors.New("store does not support size limits")
+
+// Compactor is implemented by stores that know how much space their records
+// take and can give the space of deleted records back to the system.
+type Compactor interface {
+	// Size returns the number of bytes in use.
+	Size() (int64, error)
+
+	// Compact releases the space freed by deleted records.
+	Compact() error
+}
+
+// Retention limits what is kept in a store, zero values mean no limit.
+type Retention struct {
+	// MaxAge is how long records are kept.
+	MaxAge time.Duration
+	// MaxCount is the number of records kept, the oldest go first.
+	MaxCount int
+	// MaxSize is the number of bytes records may take, the oldest go first.
+	MaxSize int64
+}
+
+// DeleteMatching removes the records that match q and returns how many were
+// removed.
+func DeleteMatching(s Store, q Query) (int, error) {
+	var deleted int
+
+	for q.Limit == 0 || deleted < q.Limit {
+		chunk := q
+		chunk.Limit = deleteChunkSize
+		if q.Limit > 0 && q.Limit-deleted < chunk.Limit {
+			chunk.Limit = q.Limit - deleted
+		}
+
+		records, _, err := s.Query(chunk)
+		if err != nil {
+			return deleted, err
+		}
+		if len(records) == 0 {
+			break
+		}
+
+		uuids := make([]string, 0, len(records))
+		for _, r := range records {
+			uuids = append(uuids, r.UUID)
+		}
+
+		n, err := s.Delete(uuids...)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+
+		if n == 0 || len(records) < chunk.Limit {
+			break
+		}
+	}
+
+	return deleted, nil
+}
+
+// deleteDNSMatching removes the DNS queries that match q and returns how
+// many were removed.
+func deleteDNSMatching(l DNSLog, q Query) (int, error) {
+	var deleted int
+
+	for q.Limit == 0 || deleted < q.Limit {
+		chunk := q
+		chunk.Limit = deleteChunkSize
+		if q.Limit > 0 && q.Limit-deleted < chunk.Limit {
+			chunk.Limit = q.Limit - deleted
+		}
+
+		queries, _, err := l.DNSQueries(chunk)
+		if err != nil {
+			return deleted, err
+		}
+		if len(queries) == 0 {
+			break
+		}
+
+		ids := make([]int64, 0, len(queries))
+		for _, dq := range queries {
+			ids = append(ids, dq.ID)
+		}
+
+		n, err := l.DeleteDNSQueries(ids...)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+
+		if n == 0 || len(queries) < chunk.Limit {
+			break
+		}
+	}
+
+	return deleted, nil
+}
+
+// Prune removes the captures and the DNS queries that fall outside of r and
+// returns how many of each were removed, now is used to tell their age. DNS
+// queries are only pruned in stores that implement DNSLog.
+func Prune(s Store, r Retention, now time.Time) (captures int, queries int, err error) {
+	if r.MaxSize > 0 {
+		if _, ok := s.(Compactor); !ok {
+			return 0, 0, ErrSizeUnsupported
+		}
+	}
+
+	l, _ := s.(DNSLog)
+
+	if r.MaxAge > 0 {
+		before := now.Add(-r.MaxAge)
+
+		n, err := DeleteMatching(s, Query{Before: before})
+		captures += n
+		if err != nil {
+			return captures, queries, err
+		}
+
+		if l != nil {
+			n, err := deleteDNSMatching(l, Query{Before: before})
+			queries += n
+			if err != nil {
+				return captures, queries, err
+			}
+		}
+	}
+
+	if r.MaxCount > 0 {
+		_, total, err := s.Query(Query{Limit: 1})
+		if err != nil {
+			return captures, queries, err
+		}
+		if excess := int(total) - r.MaxCount; excess > 0 {
+			n, err := DeleteMatching(s, Query{Limit: excess})
+			captures += n
+			if err != nil {
+				return captures, queries, err
+			}
+		}
+
+		if l != nil {
+			_, total, err := l.DNSQueries(Query{Limit: 1})
+			if err != nil {
+				return captures, queries, err
+			}
+			if excess := int(total) - r.MaxCount; excess > 0 {
+				n, err := deleteDNSMatching(l, Query{Limit: excess})
+				queries += n
+				if err != nil {
+					return captures, queries, err
+				}
+			}
+		}
+	}
+
+	if c, ok := s.(Compactor); ok {
+		if r.MaxSize > 0 {
+			nc, nq, err := pruneSize(s, l, c, r.MaxSize)
+			captures += nc
+			queries += nq
+			if err != nil {
+				return captures, queries, err
+			}
+		}
+		if captures+queries > 0 {
+			if err := c.Compact(); err != nil {
+				return captures, queries, err
+			}
+		}
+	}
+
+	return captures, queries, nil
+}
+
+// pruneSize removes the oldest captures or DNS queries, about 1% of either at
+// a time, until the store takes no more than maxSize bytes. l may be nil.
+func pruneSize(s Store, l DNSLog, c Compactor, maxSize int64) (captures int, queries int, err error) {
+	for {
+		size, err := c.Size()
+		if err != nil {
+			return captures, queries, err
+		}
+		if size <= maxSize {
+			return captures, queries, nil
+		}
+
+		records, total, err := s.Query(Query{Limit: 1})
+		if err != nil {
+			return captures, queries, err
+		}
+
+		var oldest []dnsserver.Query
+		var dnsTotal uint64
+		if l != nil {
+			if oldest, dnsTotal, err = l.DNSQueries(Query{Limit: 1}); err != nil {
+				return captures, queries, err
+			}
+		}
+
+		if total == 0 && dnsTotal == 0 {
+			return captures, queries, nil
+		}
+
+		// Whichever table holds the oldest entry is pruned first.
+		var n int
+		if dnsTotal > 0 && (total == 0 || oldest[0].Time.Before(records[0].DateStart)) {
+			n, err = deleteDNSMatching(l, Query{Limit: int(dnsTotal/100) + 1})
+			queries += n
+		} else {
+			n, err = DeleteMatching(s, Query{Limit: int(total/100) + 1})
+			captures += n
+		}
+		if err != nil {
+			return captures, queries, err
+		}
+		if n == 0 {
+			return captures, queries, nil
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/dnsserver"
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+)
+
+func TestDeleteMatching(t *testing.T) {
+	s := NewMemory()
+	for i := 0; i < 1200; i++ {
+		if err := s.Insert(newTestRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := DeleteMatching(s, Query{Search: "POST"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 600 {
+		t.Fatalf("expecting 600 records to be deleted, got %d", n)
+	}
+
+	n, err = DeleteMatching(s, Query{Limit: 550})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 550 {
+		t.Fatalf("expecting 550 records to be deleted, got %d", n)
+	}
+
+	found, total, _ := s.Query(Query{Limit: 1})
+	if total != 50 || found[0].UUID != "uuid-1100" {
+		t.Fatalf("expecting the newest records to be kept, got %d starting at %v", total, uuids(found))
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+
+	s := NewMemory()
+	for i := 0; i < 10; i++ {
+		r := newTestRecord(i)
+		r.DateStart = now.Add(-time.Duration(10-i) * time.Hour)
+		if err := s.Insert(r); err != nil {
+			t.Fatal(err)
+		}
+		q := &dnsserver.Query{Time: r.DateStart, Name: r.Host}
+		if err := s.InsertDNSQueries(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Records 0 to 4 started more than 5 hours ago.
+	captures, queries, err := Prune(s, Retention{MaxAge: 5*time.Hour + time.Minute}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if captures != 5 || queries != 5 {
+		t.Fatalf("expecting 5 captures and 5 DNS queries to be pruned by age, got %d and %d", captures, queries)
+	}
+
+	captures, queries, err = Prune(s, Retention{MaxCount: 3}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, _, _ := s.Query(Query{})
+	if captures != 2 || uuids(found) != "[uuid-0007 uuid-0008 uuid-0009]" {
+		t.Fatalf("expecting the newest 3 records to be kept, pruned %d and got %s", captures, uuids(found))
+	}
+	if kept, _, _ := s.DNSQueries(Query{}); queries != 2 || len(kept) != 3 || !kept[0].Time.Equal(found[0].DateStart) {
+		t.Fatalf("expecting the newest 3 DNS queries to be kept, pruned %d and got %v", queries, kept)
+	}
+
+	if _, _, err := Prune(s, Retention{MaxSize: 1 << 20}, now); err != ErrSizeUnsupported {
+		t.Fatalf("expecting ErrSizeUnsupported, got %v", err)
+	}
+}
+
+func TestPruneSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hyperfox-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "size.db")
+	s, err := OpenSQLite(name, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var mode int
+	if err := s.driver.QueryRow(`PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != sqliteIncrementalVacuum {
+		t.Fatalf("expecting incremental vacuum, got auto_vacuum = %d", mode)
+	}
+
+	var records []*capture.Record
+	for i := 0; i < 40; i++ {
+		r := newTestRecord(i)
+		r.Body = make([]byte, 32<<10)
+		if _, err := rand.Read(r.Body); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if err := s.Insert(records...); err != nil {
+		t.Fatal(err)
+	}
+
+	// DNS queries older than the records take space as well.
+	var dnsQueries []*dnsserver.Query
+	for i := 0; i < 20; i++ {
+		dnsQueries = append(dnsQueries, &dnsserver.Query{
+			Time:   records[0].DateStart.Add(-time.Hour),
+			Name:   "example.com.",
+			Answer: strings.Repeat("127.0.0.1 ", 1<<10),
+		})
+	}
+	if err := s.InsertDNSQueries(dnsQueries...); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const maxSize = 512 << 10
+	n, queries, err := Prune(s, Retention{MaxSize: maxSize}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || n == len(records) {
+		t.Fatalf("expecting some records to be pruned, got %d", n)
+	}
+	if queries != len(dnsQueries) {
+		t.Fatalf("expecting the older DNS queries to be pruned first, got %d", queries)
+	}
+
+	size, err := s.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size > maxSize {
+		t.Fatalf("expecting at most %d bytes in use, got %d", maxSize, size)
+	}
+
+	after, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Fatalf("expecting the database file to shrink, got %d bytes (was %d)", after.Size(), before.Size())
+	}
+
+	if _, err := s.Get("uuid-0039"); err != nil {
+		t.Fatalf("expecting the newest record to be kept, got %v", err)
+	}
+}
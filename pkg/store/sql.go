@@ -0,0 +1,316 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+	"upper.io/db.v3"
+	"upper.io/db.v3/lib/sqlbuilder"
+)
+
+// streamChunkSize is the number of records Stream reads at once.
+const streamChunkSize = 100
+
+// listColumns are the columns of the capture table that are used to list
+// records.
+var listColumns = []interface{}{
+	"id",
+	"uuid",
+	"origin",
+	"method",
+	"status",
+	"content_type",
+	"sniffed_content_type",
+	"content_length",
+	"host",
+	"url",
+	"path",
+	"scheme",
+	"date_start",
+	"date_end",
+	"time_taken",
+	"error",
+	"request_body_hash",
+	"body_hash",
+}
+
+// recordColumns are the columns of the capture table that make a full
+// record, along with the bodies in BlobTable.
+var recordColumns = append(listColumns[:len(listColumns):len(listColumns)],
+	"header",
+	"request_header",
+	"trailer",
+	"interim",
+	"proto",
+	"upstream_proto",
+	"client_local_addr",
+	"client_tls_random",
+	"upstream_local_addr",
+	"upstream_remote_addr",
+	"upstream_tls_random",
+	"upstream_override",
+	"client_tls_version",
+	"client_tls_cipher",
+	"client_tls_alpn",
+	"client_tls_sni",
+	"client_tls_ja3",
+	"client_tls_ja3_hash",
+	"client_tls_ja4",
+	"upstream_tls_version",
+	"upstream_tls_cipher",
+	"upstream_tls_alpn",
+	"upstream_tls_ocsp",
+	"upstream_tls_chain",
+)
+
+// SQL is a Store backed by a SQL database.
+type SQL struct {
+	sess sqlbuilder.Database
+
+	// compress enables zstd compression of new blobs.
+	compress bool
+}
+
+var _ Store = (*SQL)(nil)
+
+// Session returns the underlying database session.
+func (s *SQL) Session() sqlbuilder.Database {
+	return s.sess
+}
+
+func (s *SQL) captures() db.Collection {
+	return s.sess.Collection(CaptureTable)
+}
+
+// Insert implements Store.
+func (s *SQL) Insert(records ...*capture.Record) error {
+	return s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		col := tx.Collection(CaptureTable)
+		for _, r := range records {
+			var err error
+			if r.RequestBodyHash, err = putBlob(tx, r.RequestBody, s.compress); err != nil {
+				return err
+			}
+			if r.BodyHash, err = putBlob(tx, r.Body, s.compress); err != nil {
+				return err
+			}
+
+			// Bodies are referenced by hash.
+			row := *r
+			row.RequestBody, row.Body = nil, nil
+
+			id, err := col.Insert(&row)
+			if err != nil {
+				return err
+			}
+			if id, ok := id.(int64); ok {
+				r.ID = uint64(id)
+			}
+		}
+		return nil
+	})
+}
+
+// filter narrows res down to the records that match all the terms of the
+// search query q.
+func filter(res db.Result, q string) db.Result {
+	terms := searchTerms(q)
+	if len(terms) == 0 {
+		return res
+	}
+
+	conds := db.And()
+	for _, term := range terms {
+		cond := db.Or(
+			// Keywords are lowercase, LIKE only ignores the case of ASCII
+			// letters.
+			db.Cond{"keywords LIKE": "%" + strings.ToLower(term) + "%"},
+			db.Cond{"host LIKE": "%" + term + "%"},
+			db.Cond{"origin LIKE": "%" + term + "%"},
+			db.Cond{"path LIKE": "%" + term + "%"},
+			db.Cond{"content_type LIKE": "%" + term + "%"},
+			db.Cond{"sniffed_content_type LIKE": "%" + term + "%"},
+			db.Cond{"method": term},
+			db.Cond{"scheme": term},
+			db.Cond{"request_body_hash": term},
+			db.Cond{"body_hash": term},
+		)
+		// PostgreSQL refuses to compare an integer column with text.
+		if status, err := strconv.Atoi(term); err == nil {
+			cond = cond.Or(db.Cond{"status": status})
+		}
+		conds = conds.And(cond)
+	}
+
+	return res.And(conds)
+}
+
+func (s *SQL) find(q Query) db.Result {
+	res := s.captures().Find()
+	if q.AfterID > 0 {
+		res = res.And(db.Cond{"id >": q.AfterID})
+	}
+	if !q.Before.IsZero() {
+		res = res.And(db.Cond{"date_start <": q.Before})
+	}
+	return filter(res, q.Search).OrderBy("id")
+}
+
+// loadBodies reads the bodies of record from BlobTable.
+func loadBodies(q querier, record *capture.Record) error {
+	var err error
+	if record.RequestBody, err = getBlob(q, record.RequestBodyHash); err != nil {
+		return err
+	}
+	if record.Body, err = getBlob(q, record.BodyHash); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get implements Store.
+func (s *SQL) Get(uuid string) (*capture.Record, error) {
+	var record capture.Record
+
+	res := s.captures().Find(db.Cond{"uuid": uuid}).Select(recordColumns...)
+	if err := res.One(&record); err != nil {
+		if err == db.ErrNoMoreRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	if err := loadBodies(s.sess, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Query implements Store.
+func (s *SQL) Query(q Query) ([]capture.RecordMeta, uint64, error) {
+	res := s.find(q)
+
+	total, err := res.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res = res.Select(listColumns...).Offset(q.Offset)
+	if q.Limit > 0 {
+		res = res.Limit(q.Limit)
+	}
+
+	records := []capture.RecordMeta{}
+	if err := res.All(&records); err != nil {
+		return nil, 0, err
+	}
+	return records, total, nil
+}
+
+// Delete implements Store, blobs that are no longer referenced are removed
+// along with the records.
+func (s *SQL) Delete(uuids ...string) (int, error) {
+	if len(uuids) == 0 {
+		return 0, nil
+	}
+
+	var n int
+	err := s.sess.Tx(context.Background(), func(tx sqlbuilder.Tx) error {
+		col := tx.Collection(CaptureTable)
+
+		var deleted []capture.RecordMeta
+		err := col.Find(db.Cond{"uuid IN": uuids}).
+			Select("request_body_hash", "body_hash").
+			All(&deleted)
+		if err != nil {
+			return err
+		}
+		n = len(deleted)
+
+		if err := col.Find(db.Cond{"uuid IN": uuids}).Delete(); err != nil {
+			return err
+		}
+
+		seen := map[string]bool{}
+		var hashes []string
+		for _, r := range deleted {
+			for _, hash := range []string{r.RequestBodyHash, r.BodyHash} {
+				if hash != "" && !seen[hash] {
+					seen[hash] = true
+					hashes = append(hashes, hash)
+				}
+			}
+		}
+		return gcBlobs(tx, hashes)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Stream implements Store, records are read in chunks so fn can take its
+// time without keeping a query open.
+func (s *SQL) Stream(q Query, fn func(*capture.Record) error) error {
+	remaining := q.Limit
+
+	for {
+		n := streamChunkSize
+		if q.Limit > 0 && remaining < n {
+			n = remaining
+		}
+		if n == 0 {
+			return nil
+		}
+
+		var records []*capture.Record
+		if err := s.find(q).Select(recordColumns...).Offset(q.Offset).Limit(n).All(&records); err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			if err := loadBodies(s.sess, record); err != nil {
+				return err
+			}
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+
+		if len(records) < n {
+			return nil
+		}
+
+		q.AfterID = records[len(records)-1].ID
+		q.Offset = 0
+		remaining -= len(records)
+	}
+}
+
+// Close implements Store.
+func (s *SQL) Close() error {
+	return s.sess.Close()
+}
@@ -0,0 +1,400 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"upper.io/db.v3/lib/sqlbuilder"
+	"upper.io/db.v3/sqlite"
+)
+
+// sqliteIncrementalVacuum is the value of PRAGMA auto_vacuum for
+// incremental mode.
+const sqliteIncrementalVacuum = 2
+
+// column is a column added to an existing table.
+type column struct {
+	name string
+	def  string
+}
+
+// sqliteMigrations are applied in order, the version of the schema is the
+// number of migrations that were applied.
+var sqliteMigrations = []migration{
+	{"create capture table", execSQL(`CREATE TABLE IF NOT EXISTS "` + CaptureTable + `" (
+	"id" INTEGER PRIMARY KEY,
+	"uuid" VARCHAR(36) NOT NULL,
+	"origin" VARCHAR(255),
+	"method" VARCHAR(10),
+	"status" INTEGER,
+	"content_type" VARCHAR(255),
+	"content_length" INTEGER,
+	"host" VARCHAR(255),
+	"url" TEXT,
+	"scheme" VARCHAR(10),
+	"path" TEXT,
+	"header" TEXT,
+	"body" BLOB,
+	"keywords" BLOB,
+	"request_header" TEXT,
+	"request_body" BLOB,
+	"date_start" DATETIME,
+	"date_end" DATETIME,
+	"time_taken" INTEGER
+)`)},
+	{"add TLS metadata to captures", addColumns(CaptureTable,
+		column{"client_tls_version", "VARCHAR(16)"},
+		column{"client_tls_cipher", "VARCHAR(64)"},
+		column{"client_tls_alpn", "VARCHAR(32)"},
+		column{"client_tls_sni", "VARCHAR(255)"},
+		column{"client_tls_ja3", "TEXT"},
+		column{"client_tls_ja3_hash", "VARCHAR(32)"},
+		column{"client_tls_ja4", "VARCHAR(64)"},
+		column{"upstream_tls_version", "VARCHAR(16)"},
+		column{"upstream_tls_cipher", "VARCHAR(64)"},
+		column{"upstream_tls_alpn", "VARCHAR(32)"},
+		column{"upstream_tls_ocsp", "BOOLEAN"},
+		column{"upstream_tls_chain", "TEXT"},
+	)},
+	{"add connection metadata to captures", addColumns(CaptureTable,
+		column{"client_local_addr", "VARCHAR(255)"},
+		column{"client_tls_random", "VARCHAR(64)"},
+		column{"upstream_local_addr", "VARCHAR(255)"},
+		column{"upstream_remote_addr", "VARCHAR(255)"},
+		column{"upstream_tls_random", "VARCHAR(64)"},
+	)},
+	{"add error to captures", addColumns(CaptureTable,
+		column{"error", "TEXT"},
+	)},
+	{"add upstream override to captures", addColumns(CaptureTable,
+		column{"upstream_override", "VARCHAR(255)"},
+	)},
+	{"create dns_query table", execSQL(`CREATE TABLE IF NOT EXISTS "` + DNSQueryTable + `" (
+	"id" INTEGER PRIMARY KEY,
+	"time" DATETIME,
+	"client" VARCHAR(255),
+	"proto" VARCHAR(8),
+	"name" VARCHAR(255),
+	"type" VARCHAR(16),
+	"rcode" VARCHAR(16),
+	"answer" TEXT,
+	"intercepted" BOOLEAN,
+	"error" TEXT,
+	"time_taken" INTEGER
+)`)},
+	{"index captures", execSQL(
+		`CREATE INDEX IF NOT EXISTS "capture_uuid" ON "`+CaptureTable+`" ("uuid")`,
+		`CREATE INDEX IF NOT EXISTS "capture_host" ON "`+CaptureTable+`" ("host")`,
+		`CREATE INDEX IF NOT EXISTS "capture_status" ON "`+CaptureTable+`" ("status")`,
+		`CREATE INDEX IF NOT EXISTS "capture_date_start" ON "`+CaptureTable+`" ("date_start")`,
+	)},
+	{"move bodies to blob table", steps(
+		execSQL(`CREATE TABLE IF NOT EXISTS "`+BlobTable+`" (
+	"hash" VARCHAR(64) PRIMARY KEY,
+	"encoding" VARCHAR(16) NOT NULL DEFAULT '',
+	"size" INTEGER,
+	"data" BLOB
+)`),
+		addColumns(CaptureTable,
+			column{"request_body_hash", "VARCHAR(64)"},
+			column{"body_hash", "VARCHAR(64)"},
+		),
+		moveBodiesToBlobs,
+		execSQL(
+			`CREATE INDEX IF NOT EXISTS "capture_body_hash" ON "`+CaptureTable+`" ("body_hash")`,
+			`CREATE INDEX IF NOT EXISTS "capture_request_body_hash" ON "`+CaptureTable+`" ("request_body_hash")`,
+		),
+	)},
+	{"split declared and sniffed content types", steps(
+		addColumns(CaptureTable,
+			column{"sniffed_content_type", "VARCHAR(255)"},
+		),
+		splitContentTypes,
+	)},
+	{"add trailers to captures", addColumns(CaptureTable,
+		column{"trailer", "TEXT"},
+	)},
+	{"add protocol versions to captures", addColumns(CaptureTable,
+		column{"proto", "VARCHAR(16)"},
+		column{"upstream_proto", "VARCHAR(16)"},
+	)},
+	{"add interim responses to captures", addColumns(CaptureTable,
+		column{"interim", "TEXT"},
+	)},
+}
+
+// tableColumns returns the names of the columns of a table.
+func tableColumns(tx sqlbuilder.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query(`PRAGMA table_info("` + table + `")`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := map[string]bool{}
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, kind       string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &kind, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// addColumns returns a migration step that adds the columns that are missing
+// from a table.
+func addColumns(table string, columns ...column) func(tx sqlbuilder.Tx) error {
+	return func(tx sqlbuilder.Tx) error {
+		existing, err := tableColumns(tx, table)
+		if err != nil {
+			return err
+		}
+		for _, c := range columns {
+			if existing[c.name] {
+				continue
+			}
+			if _, err := tx.Exec(fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN "%s" %s`, table, c.name, c.def)); err != nil {
+				return fmt.Errorf("%s.%s: %v", table, c.name, err)
+			}
+		}
+		return nil
+	}
+}
+
+// hasTables tells whether the database has any tables besides the schema
+// table, that is, whether it has data worth a backup.
+func hasTables(sess sqlbuilder.Database) (bool, error) {
+	var n int
+	row, err := sess.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name != ?`, schemaTable)
+	if err != nil {
+		return false, err
+	}
+	if err := row.Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// backupDB writes a copy of the database next to it and returns its path,
+// databases without data are not copied.
+func backupDB(sess sqlbuilder.Database, databaseName string, version int) (string, error) {
+	populated, err := hasTables(sess)
+	if err != nil || !populated {
+		return "", err
+	}
+
+	prefix := fmt.Sprintf("%s.v%d-%s", databaseName, version, time.Now().Format("20060102-150405"))
+	// SQLite refuses to VACUUM while the session's cached statements are
+	// around, so this goes straight to the driver.
+	driver, ok := sess.Driver().(*sql.DB)
+	if !ok {
+		return "", errors.New("unexpected database driver")
+	}
+	backup := prefix + ".bak"
+	for i := 2; ; i++ {
+		_, err := driver.Exec(`VACUUM INTO '` + strings.Replace(backup, "'", "''", -1) + `'`)
+		if err == nil {
+			return backup, nil
+		}
+		// Processes that share the database may back it up at the same
+		// time.
+		if _, statErr := os.Stat(backup); statErr != nil || i > 10 {
+			return "", err
+		}
+		backup = fmt.Sprintf("%s-%d.bak", prefix, i)
+	}
+}
+
+// SQLite is a Store backed by a SQLite database.
+type SQLite struct {
+	*SQL
+
+	driver *sql.DB
+}
+
+var _ Compactor = (*SQLite)(nil)
+
+// OpenSQLite opens the SQLite database at databaseName, creating it if it
+// does not exist, and brings its schema up to date. Read-only databases must
+// exist and be up to date already.
+func OpenSQLite(databaseName string, opts Options) (*SQLite, error) {
+	options := map[string]string{
+		// Write-ahead logging lets readers (the API and the terminal UI)
+		// work while records are being saved.
+		"_journal_mode": "WAL",
+		"_synchronous":  "NORMAL",
+		// Transactions that start reading and write later would fail
+		// instead of waiting for a concurrent writer.
+		"_txlock": "immediate",
+	}
+	if opts.ReadOnly {
+		if _, err := os.Stat(databaseName); err != nil {
+			return nil, err
+		}
+		// Opening the file itself read-only would fail when there's no
+		// shared memory file left by a writer, so the connection refuses
+		// changes instead.
+		options = map[string]string{"_query_only": "1"}
+	}
+
+	sess, err := sqlite.Open(sqlite.ConnectionURL{
+		Database: databaseName,
+		Options:  options,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	driver, ok := sess.Driver().(*sql.DB)
+	if !ok {
+		sess.Close()
+		return nil, errors.New("unexpected database driver")
+	}
+
+	if opts.ReadOnly {
+		err = checkSchema(sess, sqliteMigrations)
+	} else {
+		// The database is backed up once, before either the migrations or
+		// the vacuum change it.
+		backedUp := false
+		backup := func(version int) (string, error) {
+			if backedUp {
+				return "", nil
+			}
+			path, err := backupDB(sess, databaseName, version)
+			backedUp = err == nil
+			return path, err
+		}
+		// Immediate transactions lock the database, migrations need no
+		// other lock.
+		if err = migrate(sess, sqliteMigrations, nil, backup); err == nil {
+			sess.ClearCache()
+			if err = enableIncrementalVacuum(sess, driver, backup); err != nil {
+				err = fmt.Errorf("failed to enable incremental vacuum: %v", err)
+			}
+		}
+	}
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+
+	sess.ClearCache()
+
+	return &SQLite{
+		SQL:    &SQL{sess: sess, compress: opts.Compress},
+		driver: driver,
+	}, nil
+}
+
+// enableIncrementalVacuum lets Compact give free pages back to the system,
+// databases created by older versions are backed up and rebuilt once to allow
+// it.
+func enableIncrementalVacuum(sess sqlbuilder.Database, driver *sql.DB, backup func(version int) (string, error)) error {
+	ctx := context.Background()
+
+	// The setting is applied by VACUUM on the same connection.
+	conn, err := driver.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var mode int
+	if err := conn.QueryRowContext(ctx, `PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		return err
+	}
+	if mode == sqliteIncrementalVacuum {
+		return nil
+	}
+
+	populated, err := hasTables(sess)
+	if err != nil {
+		return err
+	}
+	if populated {
+		version, err := schemaVersion(sess)
+		if err != nil {
+			return err
+		}
+		path, err := backup(version)
+		if err != nil {
+			return fmt.Errorf("failed to back up database: %v", err)
+		}
+		if path != "" {
+			log.Printf("Enabling incremental vacuum, this may take a while on large databases, backup saved to %s", path)
+		} else {
+			log.Printf("Enabling incremental vacuum, this may take a while on large databases")
+		}
+	}
+
+	if _, err := conn.ExecContext(ctx, `PRAGMA auto_vacuum = INCREMENTAL`); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, `VACUUM`)
+	return err
+}
+
+// Size implements Compactor, it returns the size of the pages in use.
+func (s *SQLite) Size() (int64, error) {
+	var pageCount, freePages, pageSize int64
+
+	pragmas := []struct {
+		name  string
+		value *int64
+	}{
+		{"page_count", &pageCount},
+		{"freelist_count", &freePages},
+		{"page_size", &pageSize},
+	}
+	for _, p := range pragmas {
+		if err := s.driver.QueryRow(`PRAGMA ` + p.name).Scan(p.value); err != nil {
+			return 0, err
+		}
+	}
+
+	return (pageCount - freePages) * pageSize, nil
+}
+
+// Compact implements Compactor, free pages are given back to the system with
+// an incremental vacuum.
+func (s *SQLite) Compact() error {
+	if _, err := s.driver.Exec(`PRAGMA incremental_vacuum`); err != nil {
+		return err
+	}
+	// The database file shrinks once the log is written back to it.
+	_, err := s.driver.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`)
+	return err
+}
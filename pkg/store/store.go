@@ -0,0 +1,117 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Package store saves captured records. SQLite is the default backend,
+// PostgreSQL lets a team share captures from several proxies and the
+// in-memory store is meant for tests.
+package store
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+)
+
+const (
+	// CaptureTable holds captured records.
+	CaptureTable = `capture`
+	// DNSQueryTable holds the queries answered by the DNS server.
+	DNSQueryTable = `dns_query`
+)
+
+var reUnsafeChars = regexp.MustCompile(`[^\p{L}\p{N}\s\.]`)
+
+// ErrNotFound is returned by Get when there's no record with the given UUID.
+var ErrNotFound = errors.New("record not found")
+
+// Query selects records, the zero value selects all of them.
+type Query struct {
+	// Search holds space separated terms, all of them must match the
+	// record's keywords, host, origin, path, content type, method, scheme or
+	// status.
+	Search string
+	// AfterID selects records with greater IDs, it's used to follow new
+	// records.
+	AfterID uint64
+	// Before selects records that started before the given time.
+	Before time.Time
+	// Offset skips the first matching records.
+	Offset int
+	// Limit is the maximum number of records returned, zero means no limit.
+	Limit int
+}
+
+// Options configure a store.
+type Options struct {
+	// Compress enables zstd compression of bodies at rest.
+	Compress bool
+	// ReadOnly opens an existing database without changing it, its schema
+	// must be up to date since migrations are not applied.
+	ReadOnly bool
+}
+
+// Store saves and retrieves captured records.
+type Store interface {
+	// Insert saves records in a single transaction and sets their IDs and
+	// body hashes.
+	Insert(records ...*capture.Record) error
+
+	// Get returns the record with the given UUID, including its bodies.
+	Get(uuid string) (*capture.Record, error)
+
+	// Query returns the metadata of the records that match q ordered by ID,
+	// and the number of records that match q regardless of its Offset and
+	// Limit.
+	Query(q Query) ([]capture.RecordMeta, uint64, error)
+
+	// Delete removes the records with the given UUIDs and returns how many
+	// were removed, bodies no other record refers to are removed as well.
+	Delete(uuids ...string) (int, error)
+
+	// Stream calls fn with every record that matches q, bodies included, in
+	// ID order. It stops at the first error returned by fn.
+	Stream(q Query, fn func(*capture.Record) error) error
+
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// Open opens the store described by dsn: a postgres:// URL, "memory:" or the
+// path to a SQLite database, which is created if it does not exist.
+func Open(dsn string, opts Options) (Store, error) {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return OpenPostgreSQL(dsn, opts)
+	case dsn == "memory:":
+		return NewMemory(), nil
+	}
+	return OpenSQLite(dsn, opts)
+}
+
+// searchTerms splits a search query into terms, dropping characters that are
+// not allowed.
+func searchTerms(q string) []string {
+	q = reUnsafeChars.ReplaceAllString(q, " ")
+	return strings.Fields(q)
+}
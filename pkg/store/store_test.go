@@ -0,0 +1,472 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/dnsserver"
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+)
+
+func newTestRecord(i int) *capture.Record {
+	r := &capture.Record{
+		RequestBody: []byte(fmt.Sprintf("request %d", i)),
+		Body:        []byte{0, 1, 2, byte(i)},
+	}
+	r.UUID = fmt.Sprintf("uuid-%04d", i)
+	r.Method = "GET"
+	r.Status = 200
+	r.Host = "example.com"
+	r.URL = fmt.Sprintf("http://example.com/%d", i)
+	r.Path = fmt.Sprintf("/%d", i)
+	r.DateStart = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	r.Header = capture.Header{Header: http.Header{"Content-Type": {"text/plain"}}}
+	r.Trailer = capture.Header{Header: http.Header{"Grpc-Status": {fmt.Sprint(i)}}}
+	if i%2 == 1 {
+		r.Method = "POST"
+		r.Status = 404
+		r.Host = "api.example.com"
+		r.Proto, r.UpstreamProto = "HTTP/2.0", "HTTP/1.1"
+		r.Interim = capture.InterimResponses{{Status: 103, Header: http.Header{"Link": {"</fox.css>; rel=preload"}}}}
+	}
+	return r
+}
+
+func uuids(records []capture.RecordMeta) string {
+	var s []string
+	for _, r := range records {
+		s = append(s, r.UUID)
+	}
+	return fmt.Sprint(s)
+}
+
+// testStore runs the same checks on every Store implementation.
+func testStore(t *testing.T, s Store) {
+	var records []*capture.Record
+	for i := 0; i < 5; i++ {
+		records = append(records, newTestRecord(i))
+	}
+	records[2].Keywords = []byte("ユニコード überprüfung ")
+	if err := s.Insert(records...); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range records {
+		if r.ID == 0 || (i > 0 && r.ID <= records[i-1].ID) {
+			t.Fatalf("expecting increasing IDs, got %d for record %d", r.ID, i)
+		}
+	}
+
+	r, err := s.Get("uuid-0003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(r.RequestBody) != "request 3" || string(r.Body) != "\x00\x01\x02\x03" {
+		t.Fatalf("unexpected bodies %q and %q", r.RequestBody, r.Body)
+	}
+	if r.Header.Get("Content-Type") != "text/plain" || r.Trailer.Get("Grpc-Status") != "3" || r.Method != "POST" || r.Proto != "HTTP/2.0" || r.UpstreamProto != "HTTP/1.1" || len(r.Interim) != 1 || r.Interim[0].Status != 103 || r.Interim[0].Header.Get("Link") == "" {
+		t.Fatalf("unexpected record %#v", r.RecordMeta)
+	}
+
+	if _, err := s.Get("missing"); err != ErrNotFound {
+		t.Fatalf("expecting ErrNotFound, got %v", err)
+	}
+
+	found, total, err := s.Query(Query{Offset: 1, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 5 || uuids(found) != "[uuid-0001 uuid-0002]" {
+		t.Fatalf("unexpected page %s of %d", uuids(found), total)
+	}
+
+	found, total, err = s.Query(Query{Search: "api POST"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || uuids(found) != "[uuid-0001 uuid-0003]" {
+		t.Fatalf("unexpected search results %s of %d", uuids(found), total)
+	}
+
+	found, _, err = s.Query(Query{Search: "Überprüfung ユニコード"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuids(found) != "[uuid-0002]" {
+		t.Fatalf("unexpected results for non-ASCII keywords: %s", uuids(found))
+	}
+
+	found, _, err = s.Query(Query{Search: "404", AfterID: records[1].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuids(found) != "[uuid-0003]" {
+		t.Fatalf("unexpected results after ID %d: %s", records[1].ID, uuids(found))
+	}
+
+	started := records[0].DateStart
+	if _, total, _ := s.Query(Query{Before: started}); total != 0 {
+		t.Fatalf("expecting no records before %v, got %d", started, total)
+	}
+	if _, total, _ := s.Query(Query{Before: started.Add(time.Second)}); total != 5 {
+		t.Fatalf("expecting 5 records before %v, got %d", started.Add(time.Second), total)
+	}
+
+	var streamed []string
+	err = s.Stream(Query{Offset: 1}, func(r *capture.Record) error {
+		if len(r.Body) != 4 {
+			return fmt.Errorf("expecting the body of %s", r.UUID)
+		}
+		streamed = append(streamed, r.UUID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(streamed) != "[uuid-0001 uuid-0002 uuid-0003 uuid-0004]" {
+		t.Fatalf("unexpected stream %v", streamed)
+	}
+
+	stop := errors.New("stop")
+	err = s.Stream(Query{}, func(r *capture.Record) error {
+		return stop
+	})
+	if err != stop {
+		t.Fatalf("expecting the error returned by fn, got %v", err)
+	}
+
+	n, err := s.Delete("uuid-0000", "uuid-0004", "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expecting 2 records to be deleted, got %d", n)
+	}
+	if _, total, _ := s.Query(Query{}); total != 3 {
+		t.Fatalf("expecting 3 records left, got %d", total)
+	}
+	if _, err := s.Get("uuid-0000"); err != ErrNotFound {
+		t.Fatalf("expecting deleted record to be gone, got %v", err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+	testConcurrentBlobs(t, NewMemory())
+	testDNSLog(t, NewMemory())
+
+	m := NewMemory()
+	a, b := newTestRecord(0), newTestRecord(1)
+	b.RequestBody = a.RequestBody
+	if err := m.Insert(a, b); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.blobs) != 3 {
+		t.Fatalf("expecting identical bodies to be saved once, got %d blobs", len(m.blobs))
+	}
+	if _, err := m.Delete(a.UUID, b.UUID); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.blobs) != 0 {
+		t.Fatalf("expecting blobs to be removed, got %d", len(m.blobs))
+	}
+}
+
+func countBlobs(t *testing.T, s *SQLite) int {
+	var n int
+	row, err := s.Session().QueryRow(`SELECT COUNT(*) FROM "` + BlobTable + `"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := row.Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSQLiteBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hyperfox-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSQLite(filepath.Join(dir, "blobs.db"), Options{Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	bundle := []byte(strings.Repeat("function noop() {}\n", 1000))
+
+	records := []*capture.Record{newTestRecord(0), newTestRecord(1), newTestRecord(2)}
+	for _, r := range records {
+		r.RequestBody = nil
+	}
+	records[0].Body = bundle
+	records[1].Body = bundle
+
+	if err := s.Insert(records...); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(bundle)
+	if hash := hex.EncodeToString(sum[:]); records[0].BodyHash != hash || records[1].BodyHash != hash {
+		t.Fatalf("expecting body hash %s, got %s and %s", hash, records[0].BodyHash, records[1].BodyHash)
+	}
+	if records[0].RequestBodyHash != "" {
+		t.Fatalf("expecting no hash for empty bodies, got %q", records[0].RequestBodyHash)
+	}
+
+	// The bundle is saved once, compressed.
+	if n := countBlobs(t, s); n != 2 {
+		t.Fatalf("expecting 2 blobs, got %d", n)
+	}
+	var (
+		encoding string
+		size     int
+	)
+	row, err := s.Session().QueryRow(`SELECT "encoding", LENGTH("data") FROM "`+BlobTable+`" WHERE "hash" = ?`, records[0].BodyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := row.Scan(&encoding, &size); err != nil {
+		t.Fatal(err)
+	}
+	if encoding != encodingZstd || size >= len(bundle) {
+		t.Fatalf("expecting a compressed blob, got %q encoding and %d bytes", encoding, size)
+	}
+
+	r, err := s.Get(records[1].UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(r.Body) != string(bundle) {
+		t.Fatal("expecting the original body")
+	}
+
+	// Identical responses are found by hash.
+	found, _, err := s.Query(Query{Search: records[0].BodyHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuids(found) != "[uuid-0000 uuid-0001]" {
+		t.Fatalf("unexpected records with the same body %s", uuids(found))
+	}
+
+	// Blobs are removed along with the last record that refers to them.
+	if _, err := s.Delete(records[0].UUID); err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(t, s); n != 2 {
+		t.Fatalf("expecting blobs in use to be kept, got %d", n)
+	}
+	if _, err := s.Delete(records[1].UUID); err != nil {
+		t.Fatal(err)
+	}
+	if n := countBlobs(t, s); n != 1 {
+		t.Fatalf("expecting the bundle to be removed, got %d blobs", n)
+	}
+}
+
+// testConcurrentBlobs deletes records while others that share their bodies
+// are being inserted, every record left must still have its bodies.
+func testConcurrentBlobs(t *testing.T, s Store) {
+	const rounds = 100
+
+	record := func(prefix string, i int) *capture.Record {
+		r := newTestRecord(1)
+		r.UUID = fmt.Sprintf("%s-%04d", prefix, i)
+		return r
+	}
+
+	for i := 0; i < rounds; i++ {
+		if err := s.Insert(record("old", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		for i := 0; i < rounds; i++ {
+			if err := s.Insert(record("new", i)); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	go func() {
+		for i := 0; i < rounds; i++ {
+			if _, err := s.Delete(record("old", i).UUID); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var uuids []string
+	for i := 0; i < rounds; i++ {
+		r, err := s.Get(record("new", i).UUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(r.RequestBody) != "request 1" {
+			t.Fatalf("%s: unexpected request body %q", r.UUID, r.RequestBody)
+		}
+		uuids = append(uuids, r.UUID)
+	}
+	if _, err := s.Delete(uuids...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testDNSLog(t *testing.T, l DNSLog) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	names := []string{"example.com.", "api.example.com.", "example.org."}
+	var queries []*dnsserver.Query
+	for i := 0; i < 9; i++ {
+		queries = append(queries, &dnsserver.Query{
+			Time:   start.Add(time.Duration(i) * time.Second),
+			Client: fmt.Sprintf("10.0.0.%d:53000", i%2+1),
+			Proto:  "udp",
+			Name:   names[i%len(names)],
+			Type:   "A",
+			Rcode:  "NOERROR",
+			Answer: "127.0.0.1",
+		})
+	}
+	queries[8].Type, queries[8].Rcode, queries[8].Answer = "AAAA", "NXDOMAIN", ""
+
+	if err := l.InsertDNSQueries(queries...); err != nil {
+		t.Fatal(err)
+	}
+	for i, q := range queries {
+		if q.ID == 0 || (i > 0 && q.ID <= queries[i-1].ID) {
+			t.Fatalf("expecting increasing IDs, got %d after %d", q.ID, queries[i-1].ID)
+		}
+	}
+
+	tests := []struct {
+		q     Query
+		names string
+		total uint64
+	}{
+		{Query{}, "example.com. api.example.com. example.org. example.com. api.example.com. example.org. example.com. api.example.com. example.org.", 9},
+		{Query{Limit: 2, Offset: 1}, "api.example.com. example.org.", 9},
+		{Query{Search: "api"}, "api.example.com. api.example.com. api.example.com.", 3},
+		{Query{Search: "example.com 10.0.0.2"}, "api.example.com. example.com. api.example.com.", 3},
+		{Query{Search: "NXDOMAIN"}, "example.org.", 1},
+		{Query{Search: "AAAA"}, "example.org.", 1},
+		{Query{AfterID: uint64(queries[6].ID)}, "api.example.com. example.org.", 2},
+		{Query{Before: start.Add(2 * time.Second)}, "example.com. api.example.com.", 2},
+		{Query{Offset: 20}, "", 9},
+	}
+	for _, tt := range tests {
+		found, total, err := l.DNSQueries(tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, q := range found {
+			got = append(got, q.Name)
+		}
+		if strings.Join(got, " ") != tt.names || total != tt.total {
+			t.Fatalf("%+v: expecting %q (%d), got %q (%d)", tt.q, tt.names, tt.total, strings.Join(got, " "), total)
+		}
+	}
+
+	found, _, err := l.DNSQueries(Query{Search: "NXDOMAIN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := found[0]; got.ID != queries[8].ID || got.Type != "AAAA" || got.Client != "10.0.0.1:53000" || !got.Time.Equal(queries[8].Time) {
+		t.Fatalf("unexpected query %+v", got)
+	}
+
+	n, err := l.DeleteDNSQueries(queries[0].ID, queries[1].ID, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, total, _ := l.DNSQueries(Query{}); n != 2 || total != 7 {
+		t.Fatalf("expecting 2 queries to be deleted and 7 to be kept, got %d and %d", n, total)
+	}
+}
+
+func TestSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hyperfox-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(filepath.Join(dir, "store.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	testStore(t, s)
+	testConcurrentBlobs(t, s)
+	testDNSLog(t, s.(DNSLog))
+}
+
+// TestPostgreSQL runs against the database given by HYPERFOX_TEST_POSTGRES,
+// e.g. postgres://postgres@127.0.0.1/hyperfox_test?sslmode=disable. The
+// capture table is emptied first.
+func TestPostgreSQL(t *testing.T) {
+	dsn := os.Getenv("HYPERFOX_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("HYPERFOX_TEST_POSTGRES is not set")
+	}
+
+	s, err := OpenPostgreSQL(dsn, Options{Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Session().Exec(`TRUNCATE "` + CaptureTable + `", "` + BlobTable + `", "` + DNSQueryTable + `"`); err != nil {
+		t.Fatal(err)
+	}
+
+	testStore(t, s)
+	testConcurrentBlobs(t, s)
+	testDNSLog(t, s)
+}
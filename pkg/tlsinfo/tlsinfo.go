@@ -0,0 +1,328 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Package tlsinfo summarizes TLS handshakes seen by the proxy on both the
+// client and the upstream side.
+package tlsinfo
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+type (
+	contextKey      struct{}
+	clientConnKey   struct{}
+	upstreamConnKey struct{}
+)
+
+const (
+	extServerName = 0x0000
+	extALPN       = 0x0010
+)
+
+// ClientHello holds the parts of a client's TLS ClientHello message that are
+// relevant for fingerprinting.
+type ClientHello struct {
+	ServerName        string
+	SupportedVersions []uint16
+	CipherSuites      []uint16
+	Extensions        []uint16
+	SupportedCurves   []tls.CurveID
+	SupportedPoints   []uint8
+	SignatureSchemes  []tls.SignatureScheme
+	SupportedProtos   []string
+}
+
+// CertSummary describes a single certificate of a chain.
+type CertSummary struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// NewClientHello copies the fingerprinting information from the given
+// *tls.ClientHelloInfo.
+func NewClientHello(info *tls.ClientHelloInfo) *ClientHello {
+	return &ClientHello{
+		ServerName:        info.ServerName,
+		SupportedVersions: append([]uint16(nil), info.SupportedVersions...),
+		CipherSuites:      append([]uint16(nil), info.CipherSuites...),
+		Extensions:        append([]uint16(nil), info.Extensions...),
+		SupportedCurves:   append([]tls.CurveID(nil), info.SupportedCurves...),
+		SupportedPoints:   append([]uint8(nil), info.SupportedPoints...),
+		SignatureSchemes:  append([]tls.SignatureScheme(nil), info.SignatureSchemes...),
+		SupportedProtos:   append([]string(nil), info.SupportedProtos...),
+	}
+}
+
+// NewContext returns a copy of ctx that carries the given ClientHello.
+func NewContext(ctx context.Context, hello *ClientHello) context.Context {
+	return context.WithValue(ctx, contextKey{}, hello)
+}
+
+// FromContext returns the ClientHello stored in ctx, if any.
+func FromContext(ctx context.Context) *ClientHello {
+	hello, _ := ctx.Value(contextKey{}).(*ClientHello)
+	return hello
+}
+
+// ConnInfo identifies one side of a proxied exchange, so it can be matched
+// with packet captures and key logs.
+type ConnInfo struct {
+	LocalAddr  string
+	RemoteAddr string
+	// Random is the hex encoded TLS client random of the session, it is only
+	// known when key logging is enabled.
+	Random string
+	// Override describes the host override used to reach the upstream
+	// server, if any.
+	Override string
+}
+
+// NewClientConnContext returns a copy of ctx that carries information on the
+// client's connection.
+func NewClientConnContext(ctx context.Context, conn *ConnInfo) context.Context {
+	return context.WithValue(ctx, clientConnKey{}, conn)
+}
+
+// ClientConnFromContext returns information on the client's connection, if
+// any.
+func ClientConnFromContext(ctx context.Context) *ConnInfo {
+	conn, _ := ctx.Value(clientConnKey{}).(*ConnInfo)
+	return conn
+}
+
+// NewUpstreamConnContext returns a copy of ctx that carries information on
+// the upstream connection.
+func NewUpstreamConnContext(ctx context.Context, conn *ConnInfo) context.Context {
+	return context.WithValue(ctx, upstreamConnKey{}, conn)
+}
+
+// UpstreamConnFromContext returns information on the upstream connection, if
+// any.
+func UpstreamConnFromContext(ctx context.Context) *ConnInfo {
+	conn, _ := ctx.Value(upstreamConnKey{}).(*ConnInfo)
+	return conn
+}
+
+// isGREASE reports whether v is one of the reserved GREASE values (RFC 8701)
+// that must be ignored when fingerprinting.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func maxVersion(versions []uint16) uint16 {
+	var max uint16
+	for _, v := range versions {
+		if !isGREASE(v) && v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+func joinUint16(values []uint16, sep string, format string) string {
+	s := make([]string, 0, len(values))
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		s = append(s, fmt.Sprintf(format, v))
+	}
+	return strings.Join(s, sep)
+}
+
+// JA3 returns the JA3 fingerprint string and its MD5 hash.
+func (h *ClientHello) JA3() (string, string) {
+	curves := make([]uint16, len(h.SupportedCurves))
+	for i := range h.SupportedCurves {
+		curves[i] = uint16(h.SupportedCurves[i])
+	}
+	points := make([]uint16, len(h.SupportedPoints))
+	for i := range h.SupportedPoints {
+		points[i] = uint16(h.SupportedPoints[i])
+	}
+
+	version := maxVersion(h.SupportedVersions)
+	if version > tls.VersionTLS12 {
+		// The legacy version field of a TLS 1.3 ClientHello is always TLS 1.2.
+		version = tls.VersionTLS12
+	}
+
+	s := strings.Join([]string{
+		fmt.Sprintf("%d", version),
+		joinUint16(h.CipherSuites, "-", "%d"),
+		joinUint16(h.Extensions, "-", "%d"),
+		joinUint16(curves, "-", "%d"),
+		joinUint16(points, "-", "%d"),
+	}, ",")
+
+	return s, fmt.Sprintf("%x", md5.Sum([]byte(s)))
+}
+
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))[:12]
+}
+
+func sortedUint16(values []uint16) []uint16 {
+	s := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			s = append(s, v)
+		}
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s
+}
+
+// JA4 returns a JA4 fingerprint for the ClientHello.
+func (h *ClientHello) JA4() string {
+	var version string
+	switch maxVersion(h.SupportedVersions) {
+	case tls.VersionTLS13:
+		version = "13"
+	case tls.VersionTLS12:
+		version = "12"
+	case tls.VersionTLS11:
+		version = "11"
+	case tls.VersionTLS10:
+		version = "10"
+	default:
+		version = "00"
+	}
+
+	sni := "i"
+	if h.ServerName != "" && net.ParseIP(h.ServerName) == nil {
+		sni = "d"
+	}
+
+	alpn := "00"
+	if len(h.SupportedProtos) > 0 && len(h.SupportedProtos[0]) > 0 {
+		p := h.SupportedProtos[0]
+		alpn = string(p[0]) + string(p[len(p)-1])
+	}
+
+	ciphers := sortedUint16(h.CipherSuites)
+	extensions := sortedUint16(h.Extensions)
+
+	countable := make([]uint16, 0, len(extensions))
+	for _, e := range extensions {
+		if e != extServerName && e != extALPN {
+			countable = append(countable, e)
+		}
+	}
+
+	clamp := func(n int) int {
+		if n > 99 {
+			return 99
+		}
+		return n
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", version, sni, clamp(len(ciphers)), clamp(len(extensions)), alpn)
+	b := truncatedHash(joinUint16(ciphers, ",", "%04x"))
+
+	schemes := make([]uint16, len(h.SignatureSchemes))
+	for i := range h.SignatureSchemes {
+		schemes[i] = uint16(h.SignatureSchemes[i])
+	}
+	c := joinUint16(countable, ",", "%04x")
+	if len(schemes) > 0 {
+		c = c + "_" + joinUint16(schemes, ",", "%04x")
+	}
+
+	return a + "_" + b + "_" + truncatedHash(c)
+}
+
+// VersionName returns a human readable name for a TLS version.
+func VersionName(version uint16) string {
+	switch version {
+	case 0:
+		return ""
+	case tls.VersionSSL30:
+		return "SSLv3"
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// ParseVersion parses a TLS version like "1.2" or "TLS 1.2". An empty string
+// yields zero.
+func ParseVersion(s string) (uint16, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	v = strings.TrimPrefix(v, "tls")
+	v = strings.TrimSpace(strings.TrimPrefix(v, "v"))
+	switch v {
+	case "":
+		return 0, nil
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", s)
+}
+
+// CipherSuiteName returns the standard name of a cipher suite.
+func CipherSuiteName(id uint16) string {
+	if id == 0 {
+		return ""
+	}
+	return tls.CipherSuiteName(id)
+}
+
+// Chain summarizes the given certificate chain.
+func Chain(certs []*x509.Certificate) []CertSummary {
+	chain := make([]CertSummary, 0, len(certs))
+	for _, cert := range certs {
+		chain = append(chain, CertSummary{
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+		})
+	}
+	return chain
+}
@@ -0,0 +1,73 @@
+package tlsinfo
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestJA3(t *testing.T) {
+	// The example of the JA3 reference implementation
+	// (https://github.com/salesforce/ja3), with GREASE values added.
+	hello := &ClientHello{
+		SupportedVersions: []uint16{tls.VersionTLS10},
+		CipherSuites:      []uint16{0x1a1a, 47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		Extensions:        []uint16{0x2a2a, 0, 10, 11},
+		SupportedCurves:   []tls.CurveID{0x3a3a, 23, 24, 25},
+		SupportedPoints:   []uint8{0},
+	}
+
+	s, hash := hello.JA3()
+	if s != "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0" {
+		t.Fatalf("unexpected JA3 string %q", s)
+	}
+	if hash != "ada70206e40642a3e4461f35503241d5" {
+		t.Fatalf("unexpected JA3 hash %q", hash)
+	}
+
+	hello.SupportedVersions = []uint16{0x0a0a, tls.VersionTLS13, tls.VersionTLS12}
+	if s, _ := hello.JA3(); !strings.HasPrefix(s, "771,") {
+		t.Fatalf("expecting TLS 1.2 legacy version, got %q", s)
+	}
+}
+
+func TestJA4(t *testing.T) {
+	// The Chrome example of the JA4 specification
+	// (https://github.com/FoxIO-LLC/ja4), with GREASE values added and
+	// cipher suites and extensions out of order.
+	hello := &ClientHello{
+		ServerName:        "example.org",
+		SupportedVersions: []uint16{0x0a0a, tls.VersionTLS13, tls.VersionTLS12},
+		CipherSuites: []uint16{
+			0x1a1a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+			0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+		},
+		Extensions: []uint16{
+			0x2a2a, 0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010,
+			0x0005, 0x000d, 0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x4469,
+			0x0015, 0x3a3a,
+		},
+		SupportedProtos: []string{"h2", "http/1.1"},
+		SignatureSchemes: []tls.SignatureScheme{
+			0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601,
+		},
+	}
+
+	if ja4 := hello.JA4(); ja4 != "t13d1516h2_8daaf6152771_e5627efa2ab1" {
+		t.Fatalf("unexpected JA4 %q", ja4)
+	}
+
+	hello.ServerName = "10.0.0.1"
+	if ja4 := hello.JA4(); ja4 != "t13i1516h2_8daaf6152771_e5627efa2ab1" {
+		t.Fatalf("expecting IP marker, got %q", ja4)
+	}
+}
+
+func TestVersionName(t *testing.T) {
+	if VersionName(tls.VersionTLS12) != "TLS 1.2" {
+		t.Fatal("expecting TLS 1.2")
+	}
+	if VersionName(0) != "" {
+		t.Fatal("expecting empty name")
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tui
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/malfunkt/hyperfox/pkg/content"
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+)
+
+// maxBodyView limits how much of a decoded body is shown in a pane.
+const maxBodyView = 256 << 10
+
+// NewRequest rebuilds the request of a captured record, so it can be sent
+// again.
+func NewRequest(record *capture.Record) (*http.Request, error) {
+	req, err := http.NewRequest(record.Method, record.URL, bytes.NewReader(record.RequestBody))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, vv := range record.RequestHeader.Header {
+		for _, v := range vv {
+			req.Header.Add(k, v)
+		}
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+
+	// Let the transport work out the framing of the body.
+	req.Header.Del("Content-Length")
+	req.Header.Del("Transfer-Encoding")
+	req.ContentLength = int64(len(record.RequestBody))
+
+	return req, nil
+}
+
+func writeHeader(w io.Writer, header http.Header) {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range header[k] {
+			fmt.Fprintf(w, "%s: %s\r\n", k, v)
+		}
+	}
+}
+
+// proto returns the version of HTTP of a message, records made before it
+// was captured are assumed to be HTTP/1.1.
+func proto(version string) string {
+	if version == "" {
+		return "HTTP/1.1"
+	}
+	return version
+}
+
+// WriteWire writes the captured request and response of record to w, as
+// they were sent on the wire.
+func WriteWire(w io.Writer, record *capture.Record) error {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%s %s %s\r\n", record.Method, record.URL, proto(record.Proto))
+	writeHeader(&buf, record.RequestHeader.Header)
+	buf.WriteString("\r\n")
+	buf.Write(record.RequestBody)
+	if len(record.RequestBody) > 0 {
+		buf.WriteString("\r\n")
+	}
+
+	for _, res := range record.Interim {
+		fmt.Fprintf(&buf, "\r\n%s %d %s\r\n", proto(record.UpstreamProto), res.Status, http.StatusText(res.Status))
+		writeHeader(&buf, res.Header)
+	}
+
+	fmt.Fprintf(&buf, "\r\n%s %d %s\r\n", proto(record.UpstreamProto), record.Status, http.StatusText(record.Status))
+	writeHeader(&buf, record.Header.Header)
+	buf.WriteString("\r\n")
+	buf.Write(record.Body)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func isText(body []byte) bool {
+	if !utf8.Valid(body) {
+		return false
+	}
+	for _, c := range body {
+		if c < ' ' && c != '\n' && c != '\r' && c != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// formatMessage returns the lines shown in a pane for a request or response:
+// its first line, headers and decoded body.
+func formatMessage(first string, header http.Header, body []byte) []string {
+	var buf bytes.Buffer
+
+	buf.WriteString(first + "\n")
+	writeHeader(&buf, header)
+	buf.WriteString("\n")
+
+	decoded, err := content.Decode(header, body)
+	if err != nil {
+		fmt.Fprintf(&buf, "(%v, showing raw body)\n", err)
+	}
+
+	// Text in other charsets is shown as UTF-8.
+	if text, _, err := content.ToUTF8(header.Get("Content-Type"), decoded); err == nil {
+		decoded = text
+	}
+
+	var truncated int
+	if len(decoded) > maxBodyView {
+		n := maxBodyView
+		// Don't cut a multi-byte character in half.
+		for i := n; i > n-utf8.UTFMax; i-- {
+			if utf8.RuneStart(decoded[i]) {
+				n = i
+				break
+			}
+		}
+		truncated = len(decoded) - n
+		decoded = decoded[:n]
+	}
+
+	if isText(decoded) {
+		buf.Write(decoded)
+	} else {
+		fmt.Fprintf(&buf, "(binary body, %d bytes)\n", len(decoded)+truncated)
+		buf.WriteString(hex.Dump(decoded))
+	}
+	if truncated > 0 {
+		fmt.Fprintf(&buf, "\n(%d more bytes)", truncated)
+	}
+
+	text := strings.Replace(buf.String(), "\r\n", "\n", -1)
+	text = strings.Replace(text, "\t", "    ", -1)
+	return strings.Split(strings.TrimRight(text, "\n"), "\n")
+}
+
+func requestLines(record *capture.Record) []string {
+	return formatMessage(record.Method+" "+record.URL, record.RequestHeader.Header, record.RequestBody)
+}
+
+func responseLines(record *capture.Record) []string {
+	if record.Error != "" && record.Status == 0 {
+		return []string{"error: " + record.Error}
+	}
+	first := fmt.Sprintf("%d %s", record.Status, http.StatusText(record.Status))
+	return formatMessage(first, record.Header.Header, record.Body)
+}
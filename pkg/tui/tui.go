@@ -0,0 +1,657 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Package tui implements a full-screen terminal interface for browsing
+// captured records.
+package tui
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+)
+
+const (
+	fetchSize           = 500
+	maxRecords          = 10000
+	defaultPollInterval = time.Second
+)
+
+const (
+	focusList = iota
+	focusRequest
+	focusResponse
+)
+
+const helpLine = "[/] search  [tab] switch pane  [j/k] move  [r] replay  [e] export  [q] quit"
+
+// Source provides the records shown by the UI.
+type Source interface {
+	// Records returns up to limit records with an ID greater than afterID
+	// that match the search query q, ordered by ID.
+	Records(q string, afterID uint64, limit int) ([]capture.RecordMeta, error)
+
+	// Record returns the record with the given UUID, including its bodies.
+	Record(uuid string) (*capture.Record, error)
+}
+
+// Options configures a UI.
+type Options struct {
+	// Replay sends the request of a record again, it returns a short
+	// description of the outcome. Replaying is disabled if nil.
+	Replay func(*capture.Record) (string, error)
+
+	// ExportDir is the directory records are exported to, defaults to the
+	// working directory.
+	ExportDir string
+
+	// PollInterval is how often the UI looks for new records, defaults to
+	// one second.
+	PollInterval time.Duration
+}
+
+// quitEvent is posted to the event loop by Close.
+type quitEvent struct{}
+
+// replayResult is posted to the event loop when a replay finishes.
+type replayResult struct {
+	result string
+	err    error
+}
+
+// UI lists captured records and shows the details of the selected one.
+type UI struct {
+	screen tcell.Screen
+	src    Source
+	opts   Options
+
+	query    string
+	records  []capture.RecordMeta
+	lastID   uint64
+	selected int
+	top      int
+	follow   bool
+
+	record   *capture.Record
+	reqLines []string
+	resLines []string
+	scroll   [3]int
+	focus    int
+
+	prompt  bool
+	input   []rune
+	message string
+
+	logMu   sync.Mutex
+	logLine string
+
+	quit      bool
+	ready     chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// New creates a UI that draws on screen and reads records from src.
+func New(screen tcell.Screen, src Source, opts Options) *UI {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultPollInterval
+	}
+	return &UI{
+		screen: screen,
+		src:    src,
+		opts:   opts,
+		follow: true,
+		ready:  make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+// Run initializes the screen and shows the UI until the user quits.
+func (u *UI) Run() error {
+	if err := u.screen.Init(); err != nil {
+		return err
+	}
+	defer u.screen.Fini()
+	close(u.ready)
+
+	u.reload()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(u.opts.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				u.Refresh()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for !u.quit {
+		select {
+		case <-u.closed:
+			return nil
+		default:
+		}
+
+		u.draw()
+		ev := u.screen.PollEvent()
+		if ev == nil {
+			return nil
+		}
+		u.handleEvent(ev)
+	}
+
+	return nil
+}
+
+// post sends data to the event loop, it's dropped if Run hasn't started.
+func (u *UI) post(data interface{}) {
+	select {
+	case <-u.ready:
+		_ = u.screen.PostEvent(tcell.NewEventInterrupt(data))
+	default:
+	}
+}
+
+// Refresh makes the UI look for new records right away. It can be called
+// from any goroutine.
+func (u *UI) Refresh() {
+	u.post(nil)
+}
+
+// Close makes Run return. It can be called from any goroutine.
+func (u *UI) Close() {
+	u.closeOnce.Do(func() { close(u.closed) })
+	u.post(quitEvent{})
+}
+
+type logWriter struct {
+	u *UI
+}
+
+func (w logWriter) Write(b []byte) (int, error) {
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+
+	w.u.logMu.Lock()
+	w.u.logLine = lines[len(lines)-1]
+	w.u.logMu.Unlock()
+
+	w.u.Refresh()
+	return len(b), nil
+}
+
+// Writer returns an io.Writer that shows the last line written to it on the
+// status line, use it to keep other output from breaking the screen (e.g.
+// with log.SetOutput).
+func (u *UI) Writer() io.Writer {
+	return logWriter{u: u}
+}
+
+func (u *UI) handleEvent(ev tcell.Event) {
+	switch ev := ev.(type) {
+	case *tcell.EventResize:
+		u.screen.Sync()
+	case *tcell.EventInterrupt:
+		if _, ok := ev.Data().(quitEvent); ok {
+			u.quit = true
+			return
+		}
+		if res, ok := ev.Data().(replayResult); ok {
+			if res.err != nil {
+				u.message = "replay failed: " + res.err.Error()
+			} else {
+				u.message = "replayed: " + res.result
+			}
+		}
+		u.poll()
+	case *tcell.EventKey:
+		u.handleKey(ev)
+	}
+}
+
+// reload fetches the records that match the current query from scratch.
+func (u *UI) reload() {
+	u.records, u.lastID = nil, 0
+	u.selected, u.top = 0, 0
+	u.follow = true
+	u.record = nil
+	u.poll()
+}
+
+// poll fetches the records added since the last call.
+func (u *UI) poll() {
+	for {
+		records, err := u.src.Records(u.query, u.lastID, fetchSize)
+		if err != nil {
+			u.message = "error: " + err.Error()
+			return
+		}
+		if len(records) > 0 {
+			u.records = append(u.records, records...)
+			u.lastID = records[len(records)-1].ID
+		}
+		if len(records) < fetchSize {
+			break
+		}
+	}
+
+	if n := len(u.records) - maxRecords; n > 0 {
+		u.records = append([]capture.RecordMeta(nil), u.records[n:]...)
+		u.selected -= n
+		u.top -= n
+		if u.selected < 0 {
+			u.selected = 0
+		}
+		if u.top < 0 {
+			u.top = 0
+		}
+	}
+
+	if u.follow && len(u.records) > 0 {
+		u.selected = len(u.records) - 1
+	}
+	u.loadSelected()
+}
+
+// loadSelected loads the details of the selected record.
+func (u *UI) loadSelected() {
+	if len(u.records) == 0 {
+		u.record, u.reqLines, u.resLines = nil, nil, nil
+		return
+	}
+
+	uuid := u.records[u.selected].UUID
+	if u.record != nil && u.record.UUID == uuid {
+		return
+	}
+
+	record, err := u.src.Record(uuid)
+	if err != nil {
+		u.message = "error: " + err.Error()
+		return
+	}
+
+	u.record = record
+	u.reqLines = requestLines(record)
+	u.resLines = responseLines(record)
+	u.scroll[focusRequest], u.scroll[focusResponse] = 0, 0
+}
+
+// layout returns the height of the record list and of the detail panes.
+func (u *UI) layout() (listHeight, paneHeight int) {
+	_, height := u.screen.Size()
+
+	// Title, pane titles and status lines.
+	rows := height - 3
+	if rows < 2 {
+		return 1, 1
+	}
+	listHeight = rows * 2 / 5
+	if listHeight < 1 {
+		listHeight = 1
+	}
+	return listHeight, rows - listHeight
+}
+
+func (u *UI) move(n int) {
+	if u.focus != focusList {
+		u.scroll[u.focus] += n
+		if u.scroll[u.focus] < 0 {
+			u.scroll[u.focus] = 0
+		}
+		return
+	}
+
+	if len(u.records) == 0 {
+		return
+	}
+
+	u.selected += n
+	if u.selected < 0 {
+		u.selected = 0
+	}
+	if u.selected >= len(u.records) {
+		u.selected = len(u.records) - 1
+	}
+	u.follow = u.selected == len(u.records)-1
+	u.loadSelected()
+}
+
+func (u *UI) pageLength() int {
+	listHeight, paneHeight := u.layout()
+	if u.focus == focusList {
+		return listHeight
+	}
+	return paneHeight
+}
+
+func (u *UI) handleKey(ev *tcell.EventKey) {
+	if u.prompt {
+		u.handlePrompt(ev)
+		return
+	}
+
+	u.message = ""
+
+	const far = 1 << 30
+
+	switch ev.Key() {
+	case tcell.KeyCtrlC:
+		u.quit = true
+	case tcell.KeyTab:
+		u.focus = (u.focus + 1) % 3
+	case tcell.KeyBacktab:
+		u.focus = (u.focus + 2) % 3
+	case tcell.KeyEnter:
+		if u.focus == focusList {
+			u.focus = focusRequest
+		}
+	case tcell.KeyEscape:
+		u.focus = focusList
+	case tcell.KeyUp:
+		u.move(-1)
+	case tcell.KeyDown:
+		u.move(1)
+	case tcell.KeyPgUp:
+		u.move(-u.pageLength())
+	case tcell.KeyPgDn:
+		u.move(u.pageLength())
+	case tcell.KeyHome:
+		u.move(-far)
+	case tcell.KeyEnd:
+		u.move(far)
+	case tcell.KeyRune:
+		switch ev.Rune() {
+		case 'q':
+			u.quit = true
+		case 'j':
+			u.move(1)
+		case 'k':
+			u.move(-1)
+		case 'g':
+			u.move(-far)
+		case 'G':
+			u.move(far)
+		case '/':
+			u.prompt = true
+			u.input = []rune(u.query)
+		case 'r':
+			u.replay()
+		case 'e':
+			u.export()
+		case '?':
+			u.message = helpLine
+		}
+	}
+}
+
+func (u *UI) handlePrompt(ev *tcell.EventKey) {
+	switch ev.Key() {
+	case tcell.KeyEnter:
+		u.prompt = false
+		u.query = strings.TrimSpace(string(u.input))
+		u.reload()
+	case tcell.KeyEscape, tcell.KeyCtrlC:
+		u.prompt = false
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if n := len(u.input); n > 0 {
+			u.input = u.input[:n-1]
+		}
+	case tcell.KeyCtrlU:
+		u.input = nil
+	case tcell.KeyRune:
+		u.input = append(u.input, ev.Rune())
+	}
+}
+
+// replay sends the selected request again in the background.
+func (u *UI) replay() {
+	if u.opts.Replay == nil {
+		u.message = "replay is not available"
+		return
+	}
+	if u.record == nil {
+		return
+	}
+
+	record := u.record
+	u.message = "replaying " + record.Method + " " + record.URL + "..."
+
+	go func() {
+		result, err := u.opts.Replay(record)
+		u.post(replayResult{result: result, err: err})
+	}()
+}
+
+// export writes the selected record to a file, in wire format.
+func (u *UI) export() {
+	if u.record == nil {
+		return
+	}
+
+	name := filepath.Join(u.opts.ExportDir, u.record.UUID+".http")
+	if err := u.writeExport(name); err != nil {
+		u.message = "export failed: " + err.Error()
+		return
+	}
+	u.message = "exported to " + name
+}
+
+func (u *UI) writeExport(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := WriteWire(f, u.record); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func statusStyle(status int) tcell.Style {
+	style := tcell.StyleDefault
+	switch {
+	case status >= 500:
+		return style.Foreground(tcell.ColorRed)
+	case status >= 400:
+		return style.Foreground(tcell.ColorYellow)
+	case status >= 300:
+		return style.Foreground(tcell.ColorTeal)
+	case status >= 200:
+		return style.Foreground(tcell.ColorGreen)
+	}
+	return style.Dim(true)
+}
+
+// drawText prints s at x, y, using at most width cells.
+func (u *UI) drawText(x, y, width int, style tcell.Style, s string) {
+	for _, r := range s {
+		if width <= 0 {
+			return
+		}
+		if !unicode.IsPrint(r) {
+			r = '.'
+		}
+		u.screen.SetContent(x, y, r, nil, style)
+		x++
+		width--
+	}
+	for ; width > 0; width-- {
+		u.screen.SetContent(x, y, ' ', nil, style)
+		x++
+	}
+}
+
+// wrap splits lines that are longer than width.
+func wrap(lines []string, width int) []string {
+	if width < 1 {
+		return nil
+	}
+
+	var wrapped []string
+	for _, line := range lines {
+		runes := []rune(line)
+		for len(runes) > width {
+			wrapped = append(wrapped, string(runes[:width]))
+			runes = runes[width:]
+		}
+		wrapped = append(wrapped, string(runes))
+	}
+	return wrapped
+}
+
+func formatRecord(r *capture.RecordMeta) string {
+	target := r.Host + r.Path
+	if target == "" {
+		target = r.URL
+	}
+	duration := time.Duration(r.TimeTaken).Round(time.Millisecond)
+	return fmt.Sprintf("%s %-7s %3d %8s %9d  %s",
+		r.DateStart.Format("15:04:05"), r.Method, r.Status, duration, r.ContentLength, target)
+}
+
+func (u *UI) drawList(width, height int) {
+	if u.selected < u.top {
+		u.top = u.selected
+	}
+	if u.selected >= u.top+height {
+		u.top = u.selected - height + 1
+	}
+
+	for row := 0; row < height; row++ {
+		i := u.top + row
+		if i >= len(u.records) {
+			break
+		}
+		r := &u.records[i]
+
+		style := statusStyle(r.Status)
+		if i == u.selected {
+			style = style.Reverse(true).Bold(u.focus == focusList)
+		}
+		u.drawText(0, 1+row, width, style, formatRecord(r))
+	}
+}
+
+func (u *UI) drawPane(pane, x, y, width, height int, lines []string) {
+	wrapped := wrap(lines, width)
+
+	maxScroll := len(wrapped) - height
+	if maxScroll < 0 {
+		maxScroll = 0
+	}
+	if u.scroll[pane] > maxScroll {
+		u.scroll[pane] = maxScroll
+	}
+
+	for row := 0; row < height && u.scroll[pane]+row < len(wrapped); row++ {
+		style := tcell.StyleDefault
+		if u.scroll[pane]+row == 0 {
+			style = style.Bold(true)
+		}
+		u.drawText(x, y+row, width, style, wrapped[u.scroll[pane]+row])
+	}
+}
+
+func (u *UI) drawStatus(width, y int) {
+	bar := tcell.StyleDefault.Reverse(true)
+
+	if u.prompt {
+		text := "search: " + string(u.input)
+		u.drawText(0, y, width, tcell.StyleDefault, text)
+		u.screen.ShowCursor(len([]rune(text)), y)
+		return
+	}
+	u.screen.HideCursor()
+
+	status := u.message
+	if status == "" {
+		u.logMu.Lock()
+		status = u.logLine
+		u.logMu.Unlock()
+	}
+	if status == "" {
+		status = helpLine
+		bar = tcell.StyleDefault.Dim(true)
+	}
+	u.drawText(0, y, width, bar, status)
+}
+
+func (u *UI) draw() {
+	u.screen.Clear()
+	defer u.screen.Show()
+
+	width, height := u.screen.Size()
+	if height < 6 || width < 20 {
+		u.drawText(0, 0, width, tcell.StyleDefault, "terminal is too small")
+		return
+	}
+
+	listHeight, paneHeight := u.layout()
+
+	title := fmt.Sprintf(" Hyperfox  %d records", len(u.records))
+	if u.query != "" {
+		title += "  search: " + u.query
+	}
+	if u.follow {
+		title += "  [following]"
+	}
+	u.drawText(0, 0, width, tcell.StyleDefault.Reverse(true).Bold(true), title)
+
+	u.drawList(width, listHeight)
+
+	paneWidth := (width - 1) / 2
+	y := 1 + listHeight
+
+	titleStyle := func(pane int) tcell.Style {
+		style := tcell.StyleDefault.Reverse(true)
+		if u.focus == pane {
+			return style.Bold(true)
+		}
+		return style.Dim(true)
+	}
+	u.drawText(0, y, paneWidth, titleStyle(focusRequest), " Request")
+	u.drawText(paneWidth, y, 1, tcell.StyleDefault.Reverse(true), " ")
+	u.drawText(paneWidth+1, y, width-paneWidth-1, titleStyle(focusResponse), " Response")
+
+	for row := 1; row <= paneHeight; row++ {
+		u.screen.SetContent(paneWidth, y+row, tcell.RuneVLine, nil, tcell.StyleDefault.Dim(true))
+	}
+	u.drawPane(focusRequest, 0, y+1, paneWidth, paneHeight, u.reqLines)
+	u.drawPane(focusResponse, paneWidth+1, y+1, width-paneWidth-1, paneHeight, u.resLines)
+
+	u.drawStatus(width, height-1)
+}
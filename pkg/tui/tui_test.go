@@ -0,0 +1,346 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package tui
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+)
+
+type memSource struct {
+	records []*capture.Record
+	queries []string
+}
+
+func (s *memSource) add(method, url string, status int, header http.Header, body []byte) {
+	r := &capture.Record{Body: body}
+	r.ID = uint64(len(s.records) + 1)
+	r.UUID = "uuid-" + string(rune('a'+len(s.records)))
+	r.Method = method
+	r.URL = url
+	r.Status = status
+	r.DateStart = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	r.RequestHeader = capture.Header{Header: http.Header{"Accept": {"*/*"}}}
+	r.Header = capture.Header{Header: header}
+	s.records = append(s.records, r)
+}
+
+func (s *memSource) Records(q string, afterID uint64, limit int) ([]capture.RecordMeta, error) {
+	s.queries = append(s.queries, q)
+
+	var records []capture.RecordMeta
+	for _, r := range s.records {
+		if r.ID <= afterID || !strings.Contains(r.URL, q) {
+			continue
+		}
+		if len(records) == limit {
+			break
+		}
+		records = append(records, r.RecordMeta)
+	}
+	return records, nil
+}
+
+func (s *memSource) Record(uuid string) (*capture.Record, error) {
+	for _, r := range s.records {
+		if r.UUID == uuid {
+			return r, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newTestUI(t *testing.T, src Source, opts Options) (*UI, tcell.SimulationScreen) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	screen.SetSize(120, 30)
+
+	u := New(screen, src, opts)
+	close(u.ready)
+	u.reload()
+	u.draw()
+	return u, screen
+}
+
+func screenText(screen tcell.SimulationScreen) string {
+	cells, width, _ := screen.GetContents()
+
+	var buf strings.Builder
+	for i, cell := range cells {
+		if len(cell.Runes) > 0 {
+			buf.WriteRune(cell.Runes[0])
+		}
+		if (i+1)%width == 0 {
+			buf.WriteString("\n")
+		}
+	}
+	return buf.String()
+}
+
+func press(u *UI, keys ...interface{}) {
+	for _, k := range keys {
+		switch k := k.(type) {
+		case rune:
+			u.handleEvent(tcell.NewEventKey(tcell.KeyRune, k, tcell.ModNone))
+		case string:
+			for _, r := range k {
+				u.handleEvent(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+			}
+		case tcell.Key:
+			u.handleEvent(tcell.NewEventKey(k, 0, tcell.ModNone))
+		}
+	}
+	u.draw()
+}
+
+func expectText(t *testing.T, screen tcell.SimulationScreen, expected ...string) {
+	t.Helper()
+
+	text := screenText(screen)
+	for _, s := range expected {
+		if !strings.Contains(text, s) {
+			t.Fatalf("expecting %q on screen, got:\n%s", s, text)
+		}
+	}
+}
+
+func TestListAndDetails(t *testing.T) {
+	src := &memSource{}
+	src.add("GET", "http://example.com/", 200, http.Header{"Content-Type": {"text/html"}}, []byte("<html></html>"))
+	src.add("POST", "http://api.example.com/v1/items", 201, http.Header{
+		"Content-Encoding": {"gzip"},
+		"Content-Type":     {"application/json"},
+	}, gzipped(t, `{"id": 7}`))
+
+	u, screen := newTestUI(t, src, Options{})
+	defer screen.Fini()
+
+	// The newest record is selected and its response body is decoded.
+	expectText(t, screen, "2 records", "GET     200", "http://api.example.com/v1/items",
+		"Content-Encoding: gzip", `{"id": 7}`)
+	if u.selected != 1 {
+		t.Fatalf("expecting the last record to be selected, got %d", u.selected)
+	}
+
+	press(u, 'k')
+	if u.selected != 0 || u.follow {
+		t.Fatalf("expecting the first record to be selected, got %d (follow: %v)", u.selected, u.follow)
+	}
+	expectText(t, screen, "<html></html>")
+	if strings.Contains(screenText(screen), `{"id": 7}`) {
+		t.Fatal("expecting the previous record to be gone")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	src := &memSource{}
+	src.add("GET", "http://example.com/", 200, nil, nil)
+	src.add("GET", "http://api.example.com/v1", 200, nil, nil)
+
+	u, screen := newTestUI(t, src, Options{})
+	defer screen.Fini()
+
+	press(u, '/', "api")
+	expectText(t, screen, "search: api")
+
+	press(u, tcell.KeyEnter)
+	if q := src.queries[len(src.queries)-1]; q != "api" {
+		t.Fatalf("expecting query %q, got %q", "api", q)
+	}
+	if len(u.records) != 1 {
+		t.Fatalf("expecting 1 record, got %d", len(u.records))
+	}
+	expectText(t, screen, "1 records  search: api")
+
+	// Escape leaves the query untouched.
+	press(u, '/', tcell.KeyBackspace2, tcell.KeyEscape)
+	if u.query != "api" {
+		t.Fatalf("expecting query to be kept, got %q", u.query)
+	}
+}
+
+func TestLiveUpdates(t *testing.T) {
+	src := &memSource{}
+	src.add("GET", "http://example.com/a", 200, nil, nil)
+
+	u, screen := newTestUI(t, src, Options{})
+	defer screen.Fini()
+
+	src.add("GET", "http://example.com/b", 404, nil, nil)
+	u.handleEvent(tcell.NewEventInterrupt(nil))
+	u.draw()
+
+	if len(u.records) != 2 || u.selected != 1 || u.record.UUID != "uuid-b" {
+		t.Fatalf("expecting the new record to be selected, got %d records, selected %d", len(u.records), u.selected)
+	}
+	expectText(t, screen, "http://example.com/b")
+
+	// Selection stays put when not following.
+	press(u, 'g')
+	src.add("GET", "http://example.com/c", 200, nil, nil)
+	u.handleEvent(tcell.NewEventInterrupt(nil))
+
+	if len(u.records) != 3 || u.selected != 0 {
+		t.Fatalf("expecting selection to be kept, got %d records, selected %d", len(u.records), u.selected)
+	}
+}
+
+func TestReplayAndExport(t *testing.T) {
+	src := &memSource{}
+	src.add("POST", "http://example.com/form", 200, nil, []byte("ok"))
+	src.records[0].RequestBody = []byte("a=1")
+
+	dir, err := ioutil.TempDir("", "hyperfox-tui")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	replayed := make(chan *capture.Record, 1)
+	u, screen := newTestUI(t, src, Options{
+		ExportDir: dir,
+		Replay: func(r *capture.Record) (string, error) {
+			replayed <- r
+			return "200 OK", nil
+		},
+	})
+	defer screen.Fini()
+
+	press(u, 'r')
+	if r := <-replayed; r.UUID != "uuid-a" {
+		t.Fatalf("unexpected record %q", r.UUID)
+	}
+	u.handleEvent(screen.PollEvent())
+	u.draw()
+	expectText(t, screen, "replayed: 200 OK")
+
+	press(u, 'e')
+	expectText(t, screen, "exported to")
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "uuid-a.http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "POST http://example.com/form HTTP/1.1\r\nAccept: */*\r\n\r\na=1\r\n\r\nHTTP/1.1 200 OK\r\n\r\nok"
+	if string(data) != expected {
+		t.Fatalf("expecting %q, got %q", expected, data)
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+	r := &capture.Record{RequestBody: []byte("a=1")}
+	r.Method = "POST"
+	r.URL = "http://10.0.0.1/form"
+	r.RequestHeader = capture.Header{Header: http.Header{
+		"Host":           {"example.com"},
+		"Content-Length": {"99"},
+		"Content-Type":   {"application/x-www-form-urlencoded"},
+	}}
+
+	req, err := NewRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.Host != "example.com" || req.Header.Get("Host") != "" {
+		t.Fatalf("expecting Host to be moved to the request, got %q", req.Host)
+	}
+	if req.ContentLength != 3 || req.Header.Get("Content-Length") != "" {
+		t.Fatalf("expecting content length to match the body, got %d", req.ContentLength)
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "application/x-www-form-urlencoded" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fw.Write([]byte("raw deflate"))
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	header := http.Header{"Content-Encoding": {"deflate"}}
+	if lines := formatMessage("200 OK", header, buf.Bytes()); lines[len(lines)-1] != "raw deflate" {
+		t.Fatalf("expecting decoded body, got %q", lines)
+	}
+
+	header = http.Header{"Content-Encoding": {"compress"}}
+	if lines := formatMessage("200 OK", header, []byte("x")); !strings.Contains(lines[3], "unsupported content encoding") {
+		t.Fatalf("expecting an error for unsupported encodings, got %q", lines)
+	}
+
+	if lines := formatMessage("200 OK", nil, []byte{0, 1, 2}); lines[2] != "(binary body, 3 bytes)" {
+		t.Fatalf("expecting binary body notice, got %q", lines[2])
+	}
+}
+
+func TestClose(t *testing.T) {
+	screen := tcell.NewSimulationScreen("UTF-8")
+
+	u := New(screen, &memSource{}, Options{})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- u.Run()
+	}()
+	u.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expecting Run to return after Close")
+	}
+}
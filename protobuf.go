@@ -0,0 +1,58 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/malfunkt/hyperfox/pkg/content"
+)
+
+var (
+	flagProto     = flag.String("proto", "", "Comma separated .proto files or descriptor sets used to decode Protobuf and gRPC messages.")
+	flagProtoPath = flag.String("proto-path", "", "Comma separated directories where imports of --proto files are looked for.")
+)
+
+// protoSchema decodes Protobuf messages in the API, messages are decoded
+// without a schema when it's nil.
+var protoSchema *content.Schema
+
+// splitList splits a comma separated flag value.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// loadProtoSchema reads the files given by --proto.
+func loadProtoSchema() (*content.Schema, error) {
+	files := splitList(*flagProto)
+	if len(files) == 0 {
+		return nil, nil
+	}
+	return content.LoadSchema(files, splitList(*flagProtoPath))
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+	"github.com/malfunkt/hyperfox/pkg/store"
+)
+
+const recordQueueSize = 1024
+
+var (
+	flagBatchSize     = flag.Int("db-batch-size", 100, "Maximum number of captured records saved in a single transaction.")
+	flagFlushInterval = flag.Duration("db-flush-interval", 500*time.Millisecond, "Maximum time captured records wait before being saved.")
+)
+
+// recordWriter saves captured records to the store from a single
+// goroutine, records are grouped in transactions of up to batchSize records
+// or whatever arrived within flushInterval. Senders block when the queue is
+// full, so a slow store slows down the proxy instead of piling up work.
+type recordWriter struct {
+	store         store.Store
+	records       chan *capture.Record
+	batchSize     int
+	flushInterval time.Duration
+
+	// onFlush is called with the ID of the last record saved by a batch.
+	onFlush func(lastID int64)
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// newRecordWriter starts a recordWriter that saves records to st.
+func newRecordWriter(st store.Store, batchSize int, flushInterval time.Duration, onFlush func(int64)) *recordWriter {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+
+	w := &recordWriter{
+		store:         st,
+		records:       make(chan *capture.Record, recordQueueSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		onFlush:       onFlush,
+		quit:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w
+}
+
+// Queue returns the channel captured records are sent to.
+func (w *recordWriter) Queue() chan *capture.Record {
+	return w.records
+}
+
+// Close saves the records that are still queued and stops the writer.
+// Records sent after Close are never saved.
+func (w *recordWriter) Close() {
+	close(w.quit)
+	<-w.done
+}
+
+func (w *recordWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*capture.Record, 0, w.batchSize)
+
+	add := func(r *capture.Record) {
+		batch = append(batch, r)
+		if len(batch) >= w.batchSize {
+			w.flush(batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case r := <-w.records:
+			add(r)
+		case <-ticker.C:
+			if len(batch) > 0 {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		case <-w.quit:
+			for {
+				select {
+				case r := <-w.records:
+					add(r)
+				default:
+					if len(batch) > 0 {
+						w.flush(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// insert saves records in a single transaction and returns the ID of the
+// last one.
+func (w *recordWriter) insert(records []*capture.Record) (int64, error) {
+	if err := w.store.Insert(records...); err != nil {
+		return 0, err
+	}
+	return int64(records[len(records)-1].ID), nil
+}
+
+func (w *recordWriter) flush(batch []*capture.Record) {
+	lastID, err := w.insert(batch)
+	if err != nil {
+		log.Printf("Failed to save %d records, retrying one by one: %q", len(batch), err)
+
+		// Keep a bad record from taking the rest of the batch with it.
+		for _, r := range batch {
+			id, err := w.insert([]*capture.Record{r})
+			if err != nil {
+				log.Printf("Failed to save to database: %q", err)
+				continue
+			}
+			lastID = id
+		}
+	}
+
+	if lastID > 0 && w.onFlush != nil {
+		w.onFlush(lastID)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/plugins/capture"
+	"github.com/malfunkt/hyperfox/pkg/store"
+)
+
+func newTestRecord(i int) *capture.Record {
+	r := &capture.Record{}
+	r.UUID = fmt.Sprintf("uuid-%04d", i)
+	r.Method = "GET"
+	r.URL = fmt.Sprintf("http://example.com/%d", i)
+	return r
+}
+
+func newTestStore(t *testing.T) (store.Store, func()) {
+	dir, err := ioutil.TempDir("", "hyperfox-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := store.OpenSQLite(filepath.Join(dir, "records.db"), store.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return st, func() {
+		st.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRecordWriterBatches(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	var (
+		mu      sync.Mutex
+		flushes []int64
+	)
+	w := newRecordWriter(st, 10, time.Hour, func(lastID int64) {
+		mu.Lock()
+		flushes = append(flushes, lastID)
+		mu.Unlock()
+	})
+
+	for i := 0; i < 25; i++ {
+		w.Queue() <- newTestRecord(i)
+	}
+	w.Close()
+
+	records, _, err := st.Query(store.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 25 {
+		t.Fatalf("expecting 25 records, got %d", len(records))
+	}
+	for i, r := range records {
+		if expected := fmt.Sprintf("uuid-%04d", i); r.UUID != expected {
+			t.Fatalf("expecting record %d to be %q, got %q", i, expected, r.UUID)
+		}
+	}
+
+	// Two full batches plus the rest, drained on Close.
+	if fmt.Sprint(flushes) != "[10 20 25]" {
+		t.Fatalf("unexpected flushes %v", flushes)
+	}
+}
+
+func TestRecordWriterFlushInterval(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	flushed := make(chan int64, 1)
+	w := newRecordWriter(st, 100, 10*time.Millisecond, func(lastID int64) {
+		flushed <- lastID
+	})
+	defer w.Close()
+
+	w.Queue() <- newTestRecord(1)
+
+	select {
+	case id := <-flushed:
+		if id != 1 {
+			t.Fatalf("expecting record 1 to be saved, got %d", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expecting the record to be saved before the batch is full")
+	}
+}
+
+func TestRecordWriterBadRecord(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+
+	w := newRecordWriter(st, 10, time.Hour, nil)
+
+	bad := newTestRecord(1)
+	bad.ID = 1 // Taken by the first record.
+	for _, r := range []*capture.Record{newTestRecord(0), bad, newTestRecord(2)} {
+		w.Queue() <- r
+	}
+	w.Close()
+
+	_, n, err := st.Query(store.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expecting the good records to be saved, got %d", n)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/malfunkt/hyperfox/pkg/store"
+)
+
+var (
+	flagRetentionMaxAge   = flag.Duration("retention-max-age", 0, "Delete captures and DNS queries older than this (e.g. 168h).")
+	flagRetentionMaxCount = flag.Int("retention-max-count", 0, "Keep at most this many captures and as many DNS queries, the oldest are deleted first.")
+	flagRetentionMaxSize  = flag.Int64("retention-max-size", 0, "Keep the SQLite database under this many megabytes, the oldest captures and DNS queries are deleted first.")
+	flagRetentionInterval = flag.Duration("retention-interval", 5*time.Minute, "How often retention limits are enforced.")
+)
+
+// retentionPolicy returns the retention limits given by the --retention-*
+// flags.
+func retentionPolicy() store.Retention {
+	return store.Retention{
+		MaxAge:   *flagRetentionMaxAge,
+		MaxCount: *flagRetentionMaxCount,
+		MaxSize:  *flagRetentionMaxSize << 20,
+	}
+}
+
+// prune enforces r on st and logs how many captures and DNS queries were
+// deleted.
+func prune(st store.Store, r store.Retention) {
+	captures, queries, err := store.Prune(st, r, time.Now())
+	if err != nil {
+		log.Printf("Prune: %q", err)
+	}
+	if captures > 0 || queries > 0 {
+		log.Printf("Pruned %d captures and %d DNS queries", captures, queries)
+	}
+}
+
+// startRetention enforces r on st every interval, until the returned
+// function is called.
+func startRetention(st store.Store, r store.Retention, interval time.Duration) func() {
+	if r == (store.Retention{}) {
+		return func() {}
+	}
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		prune(st, r)
+		for {
+			select {
+			case <-ticker.C:
+				prune(st, r)
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-done
+	}
+}
@@ -22,6 +22,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"flag"
 	"fmt"
@@ -30,6 +31,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/cors"
@@ -67,6 +69,11 @@ func (ca catchAllFS) Open(name string) (http.File, error) {
 
 var apiAuthToken string
 
+var (
+	services   []*http.Server
+	servicesMu sync.Mutex
+)
+
 func init() {
 	cookie := make([]byte, 8)
 	_, err := rand.Read(cookie)
@@ -104,7 +111,7 @@ func apiServer() (string, error) {
 
 	cors := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
 		AllowCredentials: true,
 		MaxAge:           0,
@@ -117,24 +124,49 @@ func apiServer() (string, error) {
 
 	r.Route("/records", func(r chi.Router) {
 		r.Get("/", capturesHandler)
+		r.Delete("/", deleteRecordsHandler)
+		r.Get("/export", exportHandler)
 
 		r.Route("/{uuid}", func(r chi.Router) {
 			r.Get("/", recordMetaHandler)
+			r.Delete("/", deleteRecordHandler)
 
 			r.Route("/request", func(r chi.Router) {
 				r.Get("/", requestContentHandler)
 				r.Get("/raw", requestWireHandler)
+				r.Get("/decoded", requestDecodedHandler)
+				r.Get("/parsed", requestParsedHandler)
+				r.Get("/parts/{part}", requestPartHandler)
 				r.Get("/embed", requestEmbedHandler)
 			})
 
 			r.Route("/response", func(r chi.Router) {
 				r.Get("/", responseContentHandler)
 				r.Get("/raw", responseWireHandler)
+				r.Get("/decoded", responseDecodedHandler)
+				r.Get("/parsed", responseParsedHandler)
+				r.Get("/parts/{part}", responsePartHandler)
 				r.Get("/embed", responseEmbedHandler)
 			})
 		})
 	})
 
+	r.Route("/hosts", func(r chi.Router) {
+		r.Get("/", hostsHandler)
+		r.Post("/", setHostHandler)
+		r.Delete("/{pattern}", deleteHostHandler)
+	})
+
+	r.Route("/dns", func(r chi.Router) {
+		r.Get("/queries", dnsQueriesHandler)
+
+		r.Route("/targets", func(r chi.Router) {
+			r.Get("/", dnsTargetsHandler)
+			r.Post("/", addDNSTargetHandler)
+			r.Delete("/{pattern}", deleteDNSTargetHandler)
+		})
+	})
+
 	r.HandleFunc("/live", liveHandler)
 
 	host, port, err := net.SplitHostPort(*flagAPIAddr)
@@ -157,12 +189,7 @@ func apiServer() (string, error) {
 	}
 
 	// Serving API.
-	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Fatalf("ListenAndServe: %v", err)
-			return
-		}
-	}()
+	serveService(srv)
 
 	return apiAddr, nil
 }
@@ -193,15 +220,38 @@ func uiServer(apiAddr string) (string, error) {
 		Handler: http.FileServer(&catchAllFS{statikFS}),
 	}
 
-	// Serving API.
+	// Serving UI.
+	serveService(srv)
+
+	return uiAddr, nil
+}
+
+// serveService starts srv in the background and keeps track of it, so it can
+// be shut down.
+func serveService(srv *http.Server) {
+	servicesMu.Lock()
+	services = append(services, srv)
+	servicesMu.Unlock()
+
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Fatalf("ListenAndServe: %v", err)
-			return
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatalf("ListenAndServe: %v", err)
 		}
 	}()
+}
 
-	return uiAddr, nil
+// shutdownServices stops the UI and API servers.
+func shutdownServices(ctx context.Context) error {
+	servicesMu.Lock()
+	defer servicesMu.Unlock()
+
+	var err error
+	for _, srv := range services {
+		if serr := srv.Shutdown(ctx); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
 }
 
 func localAddr() (string, error) {
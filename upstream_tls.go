@@ -0,0 +1,187 @@
+// Copyright (c) 2012-today José Nieto, https://xiam.io
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/malfunkt/hyperfox/pkg/proxy"
+	"github.com/malfunkt/hyperfox/pkg/tlsinfo"
+)
+
+var (
+	flagUpstreamCA        = flag.String("upstream-ca", "", "Path to a PEM file with extra root CAs trusted for upstream servers.")
+	flagUpstreamInsecure  = flag.Bool("upstream-insecure", false, "Skip verification of upstream certificates.")
+	flagUpstreamTLSMin    = flag.String("upstream-tls-min", "", "Minimum TLS version for upstream connections (e.g. 1.2).")
+	flagUpstreamTLSMax    = flag.String("upstream-tls-max", "", "Maximum TLS version for upstream connections (e.g. 1.3).")
+	flagUpstreamCert      = flag.String("upstream-cert", "", "Path to a client certificate presented to upstream servers.")
+	flagUpstreamKey       = flag.String("upstream-key", "", "Path to the key of --upstream-cert.")
+	flagUpstreamTLSConfig = flag.String("upstream-tls-config", "", "Path to a JSON file with per-host upstream TLS settings.")
+)
+
+type clientCertificateOptions struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// upstreamTLSOptions is the configuration file representation of
+// proxy.UpstreamTLS.
+type upstreamTLSOptions struct {
+	RootCAs            []string                   `json:"root_cas"`
+	InsecureSkipVerify bool                       `json:"insecure_skip_verify"`
+	MinVersion         string                     `json:"min_version"`
+	MaxVersion         string                     `json:"max_version"`
+	ClientCertificates []clientCertificateOptions `json:"client_certificates"`
+	ServerName         string                     `json:"server_name"`
+}
+
+func (o *upstreamTLSOptions) isZero() bool {
+	return len(o.RootCAs) == 0 &&
+		!o.InsecureSkipVerify &&
+		o.MinVersion == "" &&
+		o.MaxVersion == "" &&
+		len(o.ClientCertificates) == 0 &&
+		o.ServerName == ""
+}
+
+func loadCertificates(file string) ([]*x509.Certificate, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, buf = pem.Decode(buf)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %q", file)
+	}
+	return certs, nil
+}
+
+func (o *upstreamTLSOptions) settings() (*proxy.UpstreamTLS, error) {
+	var err error
+
+	settings := &proxy.UpstreamTLS{
+		InsecureSkipVerify: o.InsecureSkipVerify,
+		ServerName:         o.ServerName,
+	}
+
+	if settings.MinVersion, err = tlsinfo.ParseVersion(o.MinVersion); err != nil {
+		return nil, err
+	}
+	if settings.MaxVersion, err = tlsinfo.ParseVersion(o.MaxVersion); err != nil {
+		return nil, err
+	}
+
+	for _, file := range o.RootCAs {
+		certs, err := loadCertificates(file)
+		if err != nil {
+			return nil, err
+		}
+		settings.RootCAs = append(settings.RootCAs, certs...)
+	}
+
+	for _, pair := range o.ClientCertificates {
+		cert, err := tls.LoadX509KeyPair(pair.Cert, pair.Key)
+		if err != nil {
+			return nil, err
+		}
+		settings.Certificates = append(settings.Certificates, cert)
+	}
+
+	return settings, nil
+}
+
+// setupUpstreamTLS configures upstream TLS settings from command line flags
+// (applied to all hosts) and from the --upstream-tls-config file.
+func setupUpstreamTLS(p *proxy.Proxy) error {
+	defaults := upstreamTLSOptions{
+		InsecureSkipVerify: *flagUpstreamInsecure,
+		MinVersion:         *flagUpstreamTLSMin,
+		MaxVersion:         *flagUpstreamTLSMax,
+	}
+	if *flagUpstreamCA != "" {
+		defaults.RootCAs = []string{*flagUpstreamCA}
+	}
+	if *flagUpstreamCert != "" || *flagUpstreamKey != "" {
+		defaults.ClientCertificates = []clientCertificateOptions{
+			{Cert: *flagUpstreamCert, Key: *flagUpstreamKey},
+		}
+	}
+
+	if !defaults.isZero() {
+		settings, err := defaults.settings()
+		if err != nil {
+			return err
+		}
+		if err := p.SetUpstreamTLS("*", settings); err != nil {
+			return err
+		}
+	}
+
+	if *flagUpstreamTLSConfig == "" {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(*flagUpstreamTLSConfig)
+	if err != nil {
+		return err
+	}
+
+	hosts := map[string]upstreamTLSOptions{}
+	if err := json.Unmarshal(buf, &hosts); err != nil {
+		return err
+	}
+
+	for pattern, opts := range hosts {
+		settings, err := opts.settings()
+		if err != nil {
+			return fmt.Errorf("%s: %v", pattern, err)
+		}
+		if err := p.SetUpstreamTLS(pattern, settings); err != nil {
+			return fmt.Errorf("%s: %v", pattern, err)
+		}
+	}
+
+	return nil
+}
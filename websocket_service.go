@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -87,3 +88,17 @@ func wsRemoveConn(conn *websocket.Conn) {
 func wsSendMessage(conn *websocket.Conn, message interface{}) error {
 	return conn.WriteJSON(message)
 }
+
+// wsCloseAll says goodbye to all WebSocket clients and closes their
+// connections.
+func wsCloseAll() {
+	wsMu.Lock()
+	defer wsMu.Unlock()
+
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down")
+	for conn := range wsClients {
+		_ = conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		conn.Close()
+		delete(wsClients, conn)
+	}
+}